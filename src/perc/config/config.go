@@ -0,0 +1,299 @@
+package config
+
+import (
+  "fmt"
+  "time"
+  "bytes"
+  "io/ioutil"
+  
+  "perc/route"
+  "perc/health"
+  "perc/outlier"
+  "perc/proxyproto"
+  "perc/tlsconfig"
+  "perc/discovery/provider"
+)
+
+import (
+  "gopkg.in/yaml.v3"
+)
+
+// A configuration error at a particular position in a configuration file
+type Error struct {
+  File    string
+  Line    int
+  Column  int
+  Err     error
+}
+
+// Create an error positioned at a node
+func errorAt(file string, n *yaml.Node, err error) *Error {
+  return &Error{file, n.Line, n.Column, err}
+}
+
+// Describe the error
+func (e *Error) Error() string {
+  return fmt.Sprintf("%s:%d:%d: %v", e.File, e.Line, e.Column, e.Err)
+}
+
+// A duration, expressed in configuration as a string like '30s'. Set is true
+// when the duration is provided, so a zero duration can be configured.
+type Duration struct {
+  time.Duration
+  Set bool
+}
+
+// Unmarshal a duration. Errors are positioned at the value; the file is
+// filled in by Parse.
+func (d *Duration) UnmarshalYAML(n *yaml.Node) error {
+  var s string
+  err := n.Decode(&s)
+  if err != nil {
+    return err
+  }
+  v, err := time.ParseDuration(s)
+  if err != nil {
+    return errorAt("", n, fmt.Errorf("Invalid duration: %v", s))
+  }
+  d.Duration, d.Set = v, true
+  return nil
+}
+
+// Discovery configuration
+type Discovery struct {
+  Service   string    `yaml:"service"`
+  Domain    string    `yaml:"domain"`
+}
+
+// Metrics configuration
+type Metrics struct {
+  InfluxDB  string    `yaml:"influxdb"`
+}
+
+// Timeout configuration
+type Timeouts struct {
+  IO        Duration  `yaml:"io"`
+  Connect   Duration  `yaml:"connect"`
+  Read      Duration  `yaml:"read"`
+  Write     Duration  `yaml:"write"`
+  Cache     Duration  `yaml:"cache"`
+  Shutdown  Duration  `yaml:"shutdown"`
+}
+
+// Backend connection configuration. Numbers which are not provided are nil,
+// so zero can be configured.
+type Dial struct {
+  Attempts  *int      `yaml:"attempts"`
+  Budget    Duration  `yaml:"budget"`
+}
+
+// Connection limit configuration. Numbers which are not provided are nil, so
+// zero can be configured.
+type Limits struct {
+  Conns     *int      `yaml:"conns"`
+  Queue     Duration  `yaml:"queue"`
+  Rate      *float64  `yaml:"rate"`
+  Burst     *int      `yaml:"burst"`
+  Delay     Duration  `yaml:"delay"`
+}
+
+// A backend for a route
+type Backend struct {
+  Addr      string            `yaml:"addr"`
+  Params    map[string]string `yaml:"params"`
+}
+
+// A proxy route
+type Route struct {
+  Listen    string            `yaml:"listen"`
+  Params    map[string]string `yaml:"params"`
+  Backends  []Backend         `yaml:"backends"`
+}
+
+// Percolator configuration. This can be expressed in either YAML or JSON.
+type Config struct {
+  Discovery Discovery         `yaml:"discovery"`
+  Monitor   string            `yaml:"monitor"`
+  Metrics   Metrics           `yaml:"metrics"`
+  Timeouts  Timeouts          `yaml:"timeouts"`
+  Dial      Dial              `yaml:"dial"`
+  Limits    Limits            `yaml:"limits"`
+  Routes    []Route           `yaml:"routes"`
+  routes    []*route.Route
+}
+
+// Load and validate a configuration file
+func Load(p string) (*Config, error) {
+  d, err := ioutil.ReadFile(p)
+  if err != nil {
+    return nil, err
+  }
+  return Parse(p, d)
+}
+
+// Parse and validate configuration data. The file name is used to
+// describe the position of errors.
+func Parse(file string, d []byte) (*Config, error) {
+  var doc yaml.Node
+  err := yaml.Unmarshal(d, &doc)
+  if err != nil {
+    return nil, fmt.Errorf("%s: %v", file, err)
+  }
+  if len(doc.Content) < 1 {
+    return nil, fmt.Errorf("%s: Configuration is empty", file)
+  }
+  
+  conf := &Config{}
+  dec := yaml.NewDecoder(bytes.NewReader(d))
+  dec.KnownFields(true)
+  err = dec.Decode(conf)
+  if e, ok := err.(*Error); ok {
+    e.File = file
+    return nil, e
+  }else if err != nil {
+    return nil, fmt.Errorf("%s: %v", file, err)
+  }
+  
+  err = conf.validate(file, doc.Content[0])
+  if err != nil {
+    return nil, err
+  }
+  
+  return conf, nil
+}
+
+// Validate the configuration and produce routes. The provided node is the
+// document's root and is used to locate errors.
+func (c *Config) validate(file string, root *yaml.Node) error {
+  if c.Discovery.Service != "" && c.Discovery.Service != "none" {
+    if _, err := provider.Parse(c.Discovery.Service); err != nil {
+      return errorAt(file, lookup(root, "discovery", "service"), fmt.Errorf("Invalid discovery service: %v: %v", c.Discovery.Service, err))
+    }
+  }
+  
+  for _, e := range []struct{
+    Key string
+    Val Duration
+  }{
+    {"io", c.Timeouts.IO},
+    {"connect", c.Timeouts.Connect},
+    {"read", c.Timeouts.Read},
+    {"write", c.Timeouts.Write},
+    {"cache", c.Timeouts.Cache},
+    {"shutdown", c.Timeouts.Shutdown},
+  }{
+    if e.Val.Duration < 0 {
+      return errorAt(file, lookup(root, "timeouts", e.Key), fmt.Errorf("Invalid %v timeout: %v", e.Key, e.Val.Duration))
+    }
+  }
+  
+  if c.Dial.Attempts != nil && *c.Dial.Attempts < 0 {
+    return errorAt(file, lookup(root, "dial", "attempts"), fmt.Errorf("Invalid number of dial attempts: %v", *c.Dial.Attempts))
+  }
+  if c.Dial.Budget.Duration < 0 {
+    return errorAt(file, lookup(root, "dial", "budget"), fmt.Errorf("Invalid dial budget: %v", c.Dial.Budget.Duration))
+  }
+  
+  if c.Limits.Conns != nil && *c.Limits.Conns < 0 {
+    return errorAt(file, lookup(root, "limits", "conns"), fmt.Errorf("Invalid connection limit: %v", *c.Limits.Conns))
+  }
+  if c.Limits.Queue.Duration < 0 {
+    return errorAt(file, lookup(root, "limits", "queue"), fmt.Errorf("Invalid queue timeout: %v", c.Limits.Queue.Duration))
+  }
+  if c.Limits.Rate != nil && *c.Limits.Rate < 0 {
+    return errorAt(file, lookup(root, "limits", "rate"), fmt.Errorf("Invalid rate limit: %v", *c.Limits.Rate))
+  }
+  if c.Limits.Burst != nil && *c.Limits.Burst < 0 {
+    return errorAt(file, lookup(root, "limits", "burst"), fmt.Errorf("Invalid rate burst: %v", *c.Limits.Burst))
+  }
+  if c.Limits.Delay.Duration < 0 {
+    return errorAt(file, lookup(root, "limits", "delay"), fmt.Errorf("Invalid rate delay: %v", c.Limits.Delay.Duration))
+  }
+  
+  listen := make(map[string]struct{})
+  routes := make([]*route.Route, len(c.Routes))
+  for i, e := range c.Routes {
+    n := lookup(root, "routes", i)
+    if e.Listen == "" {
+      return errorAt(file, n, fmt.Errorf("Route does not define a listen address"))
+    }
+    network, _ := route.SplitNetwork(e.Listen)
+    if err := proxyproto.ValidateListener(network, e.Params); err != nil {
+      return errorAt(file, lookup(n, "params"), err)
+    }
+    if err := tlsconfig.ValidateListener(e.Params); err != nil {
+      return errorAt(file, lookup(n, "params"), err)
+    }
+    if len(e.Backends) < 1 {
+      return errorAt(file, n, fmt.Errorf("Route does not define any backends: %v", e.Listen))
+    }
+  
+    backends := make([]route.Backend, len(e.Backends))
+    for j, b := range e.Backends {
+      if b.Addr == "" {
+        return errorAt(file, lookup(n, "backends", j), fmt.Errorf("Backend does not define an address"))
+      }
+      backends[j] = route.Backend{Addr:b.Addr, Params:b.Params}
+      if err := health.Validate(backends[j]); err != nil {
+        return errorAt(file, lookup(n, "backends", j, "params"), err)
+      }
+      if err := outlier.Validate(backends[j]); err != nil {
+        return errorAt(file, lookup(n, "backends", j, "params"), err)
+      }
+      if err := proxyproto.Validate(backends[j]); err != nil {
+        return errorAt(file, lookup(n, "backends", j, "params"), err)
+      }
+      if err := tlsconfig.Validate(backends[j]); err != nil {
+        return errorAt(file, lookup(n, "backends", j, "params"), err)
+      }
+    }
+  
+    r, err := route.NewWithParams(e.Listen, e.Params, backends)
+    if err != nil {
+      return errorAt(file, n, err)
+    }
+    if _, ok := listen[r.Key()]; ok {
+      return errorAt(file, lookup(n, "listen"), fmt.Errorf("Multiple routes listen on: %v", r.Key()))
+    }
+    listen[r.Key()] = struct{}{}
+    routes[i] = r
+  }
+  
+  c.routes = routes
+  return nil
+}
+
+// Obtain the routes defined by the configuration
+func (c *Config) ProxyRoutes() []*route.Route {
+  return c.routes
+}
+
+// Find the node at the provided path of mapping keys and sequence indexes
+// beneath a node. If the path cannot be followed to its end, the deepest
+// node that was found is returned instead so errors are still positioned as
+// closely as possible.
+func lookup(n *yaml.Node, path ...interface{}) *yaml.Node {
+  for _, p := range path {
+    var next *yaml.Node
+    switch v := p.(type) {
+      case string:
+        if n.Kind == yaml.MappingNode {
+          for i := 0; i + 1 < len(n.Content); i += 2 {
+            if n.Content[i].Value == v {
+              next = n.Content[i+1]
+              break
+            }
+          }
+        }
+      case int:
+        if n.Kind == yaml.SequenceNode && v < len(n.Content) {
+          next = n.Content[v]
+        }
+    }
+    if next == nil {
+      return n
+    }
+    n = next
+  }
+  return n
+}
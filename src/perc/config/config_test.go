@@ -0,0 +1,97 @@
+package config
+
+import (
+  "time"
+  "testing"
+  
+  "perc/route"
+)
+
+import (
+  "github.com/stretchr/testify/assert"
+)
+
+const testYAML = `
+discovery:
+  service: etcd://us-east-1
+  domain: disc.example.com
+monitor: ":2222"
+metrics:
+  influxdb: metrics:8086
+timeouts:
+  connect: 5s
+  read: 1m
+routes:
+  # a discovered service
+  - listen: ":9000"
+    backends:
+      - addr: upstream
+        params:
+          tls: upstream.example.com
+  # static hosts
+  - listen: ":9001"
+    backends:
+      - addr: host:1234
+      - addr: other:5678
+`
+
+const testJSON = `{
+  "timeouts": {"write": "10s", "read": "0s"},
+  "routes": [
+    {"listen": ":9000", "backends": [{"addr": "host:1234", "params": {"tls": "host"}}]}
+  ]
+}`
+
+func TestParseConfig(t *testing.T) {
+  c, err := Parse("test.yml", []byte(testYAML))
+  if assert.Nil(t, err) {
+    assert.Equal(t, "etcd://us-east-1", c.Discovery.Service)
+    assert.Equal(t, "disc.example.com", c.Discovery.Domain)
+    assert.Equal(t, ":2222", c.Monitor)
+    assert.Equal(t, "metrics:8086", c.Metrics.InfluxDB)
+    assert.Equal(t, time.Second * 5, c.Timeouts.Connect.Duration)
+    assert.Equal(t, time.Minute, c.Timeouts.Read.Duration)
+    assert.Equal(t, time.Duration(0), c.Timeouts.Write.Duration)
+    assert.False(t, c.Timeouts.Write.Set)
+    r := c.ProxyRoutes()
+    if assert.Len(t, r, 2) {
+      assert.Equal(t, true, r[0].Equal(&route.Route{Listen:":9000", Backends:[]route.Backend{{Addr:"upstream", Params:map[string]string{"tls": "upstream.example.com"}}}, Service:true}))
+      assert.Equal(t, true, r[1].Equal(&route.Route{Listen:":9001", Backends:[]route.Backend{{Addr:"host:1234"},{Addr:"other:5678"}}}))
+    }
+  }
+  
+  c, err = Parse("test.json", []byte(testJSON))
+  if assert.Nil(t, err) {
+    assert.Equal(t, time.Second * 10, c.Timeouts.Write.Duration)
+    assert.Equal(t, Duration{0, true}, c.Timeouts.Read) // explicitly disabled
+    r := c.ProxyRoutes()
+    if assert.Len(t, r, 1) {
+      assert.Equal(t, true, r[0].Equal(&route.Route{Listen:":9000", Backends:[]route.Backend{{Addr:"host:1234", Params:map[string]string{"tls": "host"}}}}))
+    }
+  }
+}
+
+func TestConfigErrors(t *testing.T) {
+  testConfigError(t, "routes:\n  - listen: ':9000'\n    backends:\n      - addr: host:1234\n      - addr: service\n", "test.yml:2:5: Cannot mix host and service backends in the same route")
+  testConfigError(t, "routes:\n  - listen: ':9000'\n    backends:\n      - addr: host:1234\n      - params: {tls: x}\n", "test.yml:5:9: Backend does not define an address")
+  testConfigError(t, "routes:\n  - listen: ':9000'\n    backends: [{addr: a:1}]\n  - listen: ':9000'\n    backends: [{addr: b:1}]\n", "test.yml:4:13: Multiple routes listen on: :9000")
+  testConfigError(t, "routes:\n  - backends: [{addr: a:1}]\n", "test.yml:2:5: Route does not define a listen address")
+  testConfigError(t, "discovery:\n  service: nonsense\n", "test.yml:2:12: Invalid discovery service: nonsense: Malformed provider")
+  testConfigError(t, "routes:\n  - listen: ':9000'\n    backends:\n      - addr: host:1234\n        params: {check: smoke}\n", "test.yml:5:17: Unsupported check: smoke")
+  testConfigError(t, "routes:\n  - listen: ':9000'\n    params: {proxy_protocol: v3}\n    backends: [{addr: a:1}]\n", "test.yml:3:13: Unsupported PROXY protocol version: v3")
+  testConfigError(t, "routes:\n  - listen: ':9000'\n    params: {proxy_protocol: v1}\n    backends: [{addr: a:1}]\n", "test.yml:3:13: Accepting the PROXY protocol requires the proxy_trusted param")
+  testConfigError(t, "timeouts:\n  read: forever\n", "test.yml:2:9: Invalid duration: forever")
+  testConfigError(t, "timeouts:\n  read: -1s\n", "test.yml:2:9: Invalid read timeout: -1s")
+  testConfigError(t, "dial:\n  budget: -1s\n", "test.yml:2:11: Invalid dial budget: -1s")
+  testConfigError(t, "limits:\n  conns: -1\n", "test.yml:2:10: Invalid connection limit: -1")
+  testConfigError(t, "limits:\n  rate: -1\n", "test.yml:2:9: Invalid rate limit: -1")
+  testConfigError(t, "routes:\n  - listen: ':9000'\n    backend: []\n", "test.yml: yaml: unmarshal errors:\n  line 3: field backend not found in type config.Route")
+}
+
+func testConfigError(t *testing.T, in, expect string) bool {
+  _, err := Parse("test.yml", []byte(in))
+  if !assert.NotNil(t, err) {
+    return false
+  }
+  return assert.Equal(t, expect, err.Error())
+}
@@ -28,31 +28,33 @@ type cacheEntry struct {
 }
 
 /**
- * Obtain the next provider
+ * Obtain up to n providers, starting with the next provider in the rotation.
+ * The rotation advances by one provider on each call regardless of how many
+ * are requested, so the first provider returned is always balanced.
  */
 func (e *cacheEntry) Next(n int) []string {
   e.Lock()
   defer e.Unlock()
-  var r []string
   
   l := len(e.providers)
+  if l < 1 {
+    return nil
+  }
+  if n > l {
+    n = l
+  }
+  
   b := e.index % l
   u := b + n
-  a := n
-  
   if u > l {
-    a  = l - b
-    x := n - a // spillover
-    if x > b {
-      x = b
-    }
-    a += x
-    r = append(e.providers[b:u], e.providers[:x]...)
-  }else{
-    r = e.providers[b:u]
+    u = l
   }
   
-  e.index += a
+  r := make([]string, 0, n)
+  r = append(r, e.providers[b:u]...)
+  r = append(r, e.providers[:n - len(r)]...)
+  
+  e.index = (b + 1) % l
   return r
 }
 
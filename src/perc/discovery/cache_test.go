@@ -0,0 +1,21 @@
+package discovery
+
+import (
+  "sync"
+  "time"
+  "testing"
+  "github.com/stretchr/testify/assert"
+)
+
+func TestCacheEntryNext(t *testing.T) {
+  e := &cacheEntry{sync.Mutex{}, []string{"a", "b", "c"}, 0, time.Time{}}
+  assert.Equal(t, []string{"a"}, e.Next(1))
+  assert.Equal(t, []string{"b"}, e.Next(1))
+  assert.Equal(t, []string{"c", "a"}, e.Next(2))
+  assert.Equal(t, []string{"a", "b", "c"}, e.Next(10))
+  assert.Equal(t, []string{"b", "c", "a"}, e.Next(3))
+  assert.Equal(t, []string{"c"}, e.Next(1))
+  
+  e = &cacheEntry{sync.Mutex{}, nil, 0, time.Time{}}
+  assert.Equal(t, []string(nil), e.Next(1))
+}
@@ -0,0 +1,548 @@
+package health
+
+import (
+  "fmt"
+  "net"
+  "sync"
+  "time"
+  "strconv"
+  "context"
+  "net/http"
+  "crypto/tls"
+  
+  "perc/route"
+  "perc/proxyproto"
+  "perc/tlsconfig"
+)
+
+import (
+  "google.golang.org/grpc"
+  "google.golang.org/grpc/credentials"
+  "google.golang.org/grpc/credentials/insecure"
+  "google.golang.org/grpc/health/grpc_health_v1"
+  "github.com/bww/go-alert"
+  "github.com/bww/go-util/debug"
+  "github.com/rcrowley/go-metrics"
+)
+
+// Backend params which configure health checks
+const (
+  ParamCheck          = "check"           // the check to perform: tcp, tls, http, or grpc
+  ParamCheckInterval  = "check_interval"  // the interval between checks
+  ParamCheckTimeout   = "check_timeout"   // the timeout for an individual check
+  ParamCheckPath      = "check_path"      // the path requested by http checks
+  ParamCheckService   = "check_service"   // the service name checked by grpc checks
+  ParamCheckFall      = "check_fall"      // consecutive failures before a backend is unhealthy
+  ParamCheckRise      = "check_rise"      // consecutive successes before a backend is healthy again
+)
+
+const (
+  DefaultInterval = time.Second * 10
+  DefaultTimeout  = time.Second * 5
+  DefaultFall     = 2
+  DefaultRise     = 2
+)
+
+// Discovered backends which are not looked up for this long stop being checked
+const discoveredExpiry = time.Minute * 5
+
+var (
+  healthCheckRate metrics.Meter
+  healthCheckError metrics.Meter
+  healthCheckLatency metrics.Timer
+)
+
+func init() {
+  healthCheckRate = metrics.NewMeter()
+  metrics.Register("percolator.health.check.rate", healthCheckRate)
+  healthCheckError = metrics.NewMeter()
+  metrics.Register("percolator.health.check.error", healthCheckError)
+  healthCheckLatency = metrics.NewTimer()
+  metrics.Register("percolator.health.check.latency", healthCheckLatency)
+}
+
+// A check probes a backend address and returns an error if it is unhealthy
+type check func(cxt context.Context, addr string) error
+
+// A check specification, derived from backend params
+type spec struct {
+  kind      string
+  interval  time.Duration
+  timeout   time.Duration
+  fall      int
+  rise      int
+  check     check
+}
+
+// Create a check specification from backend params. If no check is
+// configured, nil is returned.
+func parseSpec(p map[string]string) (*spec, error) {
+  t, ok := p[ParamCheck]
+  if !ok {
+    return nil, nil
+  }
+  
+  var err error
+  s := &spec{kind:t, interval:DefaultInterval, timeout:DefaultTimeout, fall:DefaultFall, rise:DefaultRise}
+  if v, ok := p[ParamCheckInterval]; ok {
+    s.interval, err = time.ParseDuration(v)
+    if err != nil || s.interval <= 0 {
+      return nil, fmt.Errorf("Invalid check interval: %v", v)
+    }
+  }
+  if v, ok := p[ParamCheckTimeout]; ok {
+    s.timeout, err = time.ParseDuration(v)
+    if err != nil || s.timeout <= 0 {
+      return nil, fmt.Errorf("Invalid check timeout: %v", v)
+    }
+  }
+  if v, ok := p[ParamCheckFall]; ok {
+    s.fall, err = strconv.Atoi(v)
+    if err != nil || s.fall < 1 {
+      return nil, fmt.Errorf("Invalid check fall threshold: %v", v)
+    }
+  }
+  if v, ok := p[ParamCheckRise]; ok {
+    s.rise, err = strconv.Atoi(v)
+    if err != nil || s.rise < 1 {
+      return nil, fmt.Errorf("Invalid check rise threshold: %v", v)
+    }
+  }
+  
+  switch t {
+    case "tcp":
+      s.check = checkTCP(s.timeout, p)
+    case "tls":
+      s.check = checkTLS(s.timeout, p)
+    case "http":
+      s.check = checkHTTP(s.timeout, p)
+    case "grpc":
+      s.check = checkGRPC(s.timeout, p)
+    default:
+      return nil, fmt.Errorf("Unsupported check: %v", t)
+  }
+  
+  return s, nil
+}
+
+// Produce a key which identifies the check configured by backend params.
+// Params are normalized so that equivalent checks, like one which sets the
+// default interval and one which omits it, have the same key.
+func specKey(p map[string]string) string {
+  var k string
+  for _, e := range []string{ParamCheck, ParamCheckInterval, ParamCheckTimeout, ParamCheckPath, ParamCheckService, ParamCheckFall, ParamCheckRise, proxyproto.ParamProxyProtocol, tlsconfig.ParamTLS, tlsconfig.ParamCA, tlsconfig.ParamCert, tlsconfig.ParamKey, tlsconfig.ParamMinVersion, tlsconfig.ParamALPN} {
+    v, ok := p[e]
+    switch e {
+      case ParamCheckInterval:
+        v, ok = normalDuration(v, DefaultInterval), true
+      case ParamCheckTimeout:
+        v, ok = normalDuration(v, DefaultTimeout), true
+      case ParamCheckFall:
+        v, ok = normalInt(v, DefaultFall), true
+      case ParamCheckRise:
+        v, ok = normalInt(v, DefaultRise), true
+      case ParamCheckPath:
+        if v == "" || v[0] != '/' {
+          v = "/"+ v
+        }
+        ok = true
+    }
+    if ok {
+      k += e +"="+ v +";"
+    }
+  }
+  return k
+}
+
+// Normalize a duration param, which is the default if it is not set
+func normalDuration(v string, d time.Duration) string {
+  if v == "" {
+    return d.String()
+  }
+  if x, err := time.ParseDuration(v); err == nil {
+    return x.String()
+  }
+  return v
+}
+
+// Normalize an integer param, which is the default if it is not set
+func normalInt(v string, d int) string {
+  if v == "" {
+    return strconv.Itoa(d)
+  }
+  if x, err := strconv.Atoi(v); err == nil {
+    return strconv.Itoa(x)
+  }
+  return v
+}
+
+// Validate the health check params for a backend
+func Validate(b route.Backend) error {
+  _, err := parseSpec(b.Params)
+  return err
+}
+
+// The health status of a backend
+type Status struct {
+  Check       string    `json:"check"`
+  Healthy     bool      `json:"healthy"`
+  Failures    int       `json:"failures"`
+  LastCheck   time.Time `json:"last_check"`
+  LastError   string    `json:"last_error,omitempty"`
+}
+
+// Identifies a target. The same address may be checked differently by the
+// backends of different routes, in which case each check is a target.
+type targetKey struct {
+  addr      string
+  spec      string
+}
+
+// A backend being checked
+type target struct {
+  key       targetKey
+  addr      string
+  spec      *spec
+  static    bool
+  used      time.Time
+  status    Status
+  rise      int
+  stop      chan struct{}
+}
+
+// A checker probes backends on an interval and tracks their health.
+// Backends which are not being checked are always considered healthy.
+type Checker struct {
+  sync.Mutex
+  targets   map[targetKey]*target
+}
+
+// Create a checker
+func NewChecker() *Checker {
+  return &Checker{sync.Mutex{}, make(map[targetKey]*target)}
+}
+
+// Begin checking the static backends for the provided routes which configure
+// a check, and stop checking static backends which are no longer present.
+func (c *Checker) Routes(routes []*route.Route) {
+  c.Lock()
+  defer c.Unlock()
+  
+  present := make(map[targetKey]struct{})
+  for _, r := range routes {
+    if r.Service {
+      continue
+    }
+    for _, b := range r.Backends {
+      if t := c.watch(b.Addr, b.Params, true); t != nil {
+        present[t.key] = struct{}{}
+      }
+    }
+  }
+  
+  for k, e := range c.targets {
+    if _, ok := present[k]; !ok && e.static {
+      c.remove(e)
+    }
+  }
+}
+
+// Determine whether a backend address is healthy. If the backend configures
+// a check and the address is not already being checked, checking begins and
+// the address is considered healthy until it has been probed.
+func (c *Checker) Healthy(addr string, b route.Backend) bool {
+  c.Lock()
+  defer c.Unlock()
+  t := c.watch(addr, b.Params, false)
+  if t == nil {
+    return true
+  }
+  t.used = time.Now()
+  return t.status.Healthy
+}
+
+// Obtain the status of every backend being checked, by address. When an
+// address is checked differently by several backends, each check's status is
+// described by the address followed by its params.
+func (c *Checker) Status() map[string]Status {
+  c.Lock()
+  defer c.Unlock()
+  n := make(map[string]int)
+  for k := range c.targets {
+    n[k.addr]++
+  }
+  s := make(map[string]Status)
+  for k, e := range c.targets {
+    if n[k.addr] > 1 {
+      s[k.addr +" ("+ k.spec +")"] = e.status
+    }else{
+      s[k.addr] = e.status
+    }
+  }
+  return s
+}
+
+// Stop checking every backend
+func (c *Checker) Stop() {
+  c.Lock()
+  defer c.Unlock()
+  for _, e := range c.targets {
+    c.remove(e)
+  }
+}
+
+// Obtain the target for an address and the check its params configure,
+// creating and starting it if necessary. If the params don't configure a
+// check nil is returned. The checker must be locked.
+func (c *Checker) watch(addr string, p map[string]string, static bool) *target {
+  if _, ok := p[ParamCheck]; !ok {
+    return nil
+  }
+  k := targetKey{addr, specKey(p)}
+  if t, ok := c.targets[k]; ok {
+    if static {
+      t.static = true
+    }
+    return t
+  }
+  
+  s, err := parseSpec(p)
+  if err != nil {
+    alt.Errorf("health: %v: %v", addr, err)
+    return nil
+  }else if s == nil {
+    return nil
+  }
+  
+  t := &target{
+    key: k,
+    addr: addr,
+    spec: s,
+    static: static,
+    used: time.Now(),
+    status: Status{Check:s.kind, Healthy:true},
+    stop: make(chan struct{}),
+  }
+  
+  c.targets[k] = t
+  go c.run(t)
+  return t
+}
+
+// Stop checking a target. The checker must be locked.
+func (c *Checker) remove(t *target) {
+  if debug.VERBOSE {
+    alt.Debugf("health: Stopped checking: %v", t.addr)
+  }
+  delete(c.targets, t.key)
+  close(t.stop)
+}
+
+// Probe a target on its interval until it is stopped
+func (c *Checker) run(t *target) {
+  tick := time.NewTicker(t.spec.interval)
+  defer tick.Stop()
+  for {
+    c.probe(t)
+    select {
+      case <- t.stop:
+        return
+      case <- tick.C:
+    }
+    c.Lock()
+    if c.targets[t.key] == t && !t.static && time.Since(t.used) > discoveredExpiry {
+      c.remove(t)
+    }
+    c.Unlock()
+  }
+}
+
+// Probe a target once and update its status
+func (c *Checker) probe(t *target) {
+  healthCheckRate.Mark(1)
+  start := time.Now()
+  
+  cxt, cancel := context.WithTimeout(context.Background(), t.spec.timeout)
+  err := t.spec.check(cxt, t.addr)
+  cancel()
+  healthCheckLatency.Update(time.Since(start))
+  
+  c.Lock()
+  defer c.Unlock()
+  t.status.LastCheck = start
+  if err != nil {
+    healthCheckError.Mark(1)
+    t.rise = 0
+    t.status.Failures++
+    t.status.LastError = err.Error()
+    if t.status.Healthy && t.status.Failures >= t.spec.fall {
+      alt.Errorf("health: Backend is unhealthy: %v: %v", t.addr, err)
+      t.status.Healthy = false
+    }
+  }else{
+    t.rise++
+    t.status.Failures = 0
+    t.status.LastError = ""
+    if !t.status.Healthy && t.rise >= t.spec.rise {
+      alt.Errorf("health: Backend has recovered: %v", t.addr)
+      t.status.Healthy = true
+    }
+  }
+}
+
+// Check that a TCP connection can be established
+func checkTCP(timeout time.Duration, p map[string]string) check {
+  return func(cxt context.Context, addr string) error {
+    conn, err := dial(cxt, timeout, addr, p)
+    if err != nil {
+      return err
+    }
+    return conn.Close()
+  }
+}
+
+// Check that a TLS handshake can be completed
+func checkTLS(timeout time.Duration, p map[string]string) check {
+  return func(cxt context.Context, addr string) error {
+    conn, err := dial(cxt, timeout, addr, p)
+    if err != nil {
+      return err
+    }
+    defer conn.Close()
+    c, err := tlsConfig(addr, p)
+    if err != nil {
+      return err
+    }
+    conn.SetDeadline(time.Now().Add(timeout))
+    return tls.Client(conn, c).Handshake()
+  }
+}
+
+// Check that an HTTP GET request succeeds. Requests are made over TLS if
+// the backend uses TLS.
+func checkHTTP(timeout time.Duration, p map[string]string) check {
+  scheme := "http"
+  _, secure := p[tlsconfig.ParamTLS]
+  if secure {
+    scheme = "https"
+  }
+  path := p[ParamCheckPath]
+  if path == "" || path[0] != '/' {
+    path = "/"+ path
+  }
+  return func(cxt context.Context, addr string) error {
+    transport := &http.Transport{
+      DialContext: func(cxt context.Context, _, _ string) (net.Conn, error) {
+        return dial(cxt, timeout, addr, p)
+      },
+      DisableKeepAlives: true,
+    }
+    if secure {
+      c, err := tlsConfig(addr, p)
+      if err != nil {
+        return err
+      }
+      c = c.Clone()
+      c.NextProtos = nil // checks are made with HTTP/1.1
+      transport.TLSClientConfig = c
+    }
+    client := &http.Client{
+      Timeout: timeout,
+      Transport: transport,
+      CheckRedirect: func(*http.Request, []*http.Request) error {
+        return http.ErrUseLastResponse
+      },
+    }
+    req, err := http.NewRequest("GET", scheme +"://"+ host(addr) + path, nil)
+    if err != nil {
+      return err
+    }
+    rsp, err := client.Do(req.WithContext(cxt))
+    if err != nil {
+      return err
+    }
+    rsp.Body.Close()
+    if rsp.StatusCode < 200 || rsp.StatusCode > 399 {
+      return fmt.Errorf("Unexpected status: %v", rsp.Status)
+    }
+    return nil
+  }
+}
+
+// Check that a backend reports itself as serving using the gRPC health
+// checking protocol
+func checkGRPC(timeout time.Duration, p map[string]string) check {
+  _, secure := p[tlsconfig.ParamTLS]
+  service := p[ParamCheckService]
+  return func(cxt context.Context, addr string) error {
+    opt := grpc.WithTransportCredentials(insecure.NewCredentials())
+    if secure {
+      c, err := tlsConfig(addr, p)
+      if err != nil {
+        return err
+      }
+      opt = grpc.WithTransportCredentials(credentials.NewTLS(c))
+    }
+    dialer := grpc.WithContextDialer(func(cxt context.Context, _ string) (net.Conn, error) {
+      return dial(cxt, timeout, addr, p)
+    })
+    conn, err := grpc.NewClient("passthrough:///"+ host(addr), opt, dialer)
+    if err != nil {
+      return err
+    }
+    defer conn.Close()
+    rsp, err := grpc_health_v1.NewHealthClient(conn).Check(cxt, &grpc_health_v1.HealthCheckRequest{Service:service})
+    if err != nil {
+      return err
+    }
+    if rsp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+      return fmt.Errorf("Service is not serving: %v", rsp.Status)
+    }
+    return nil
+  }
+}
+
+// Connect to a backend for a check. If the backend expects the PROXY protocol
+// a header which does not describe any client is written first.
+func dial(cxt context.Context, timeout time.Duration, addr string, p map[string]string) (net.Conn, error) {
+  d := &net.Dialer{Timeout:timeout}
+  network, addr := route.SplitNetwork(addr)
+  conn, err := d.DialContext(cxt, network, addr)
+  if err != nil {
+    return nil, err
+  }
+  if v, ok := p[proxyproto.ParamProxyProtocol]; ok {
+    h, err := proxyproto.Local(v)
+    if err == nil {
+      conn.SetWriteDeadline(time.Now().Add(timeout))
+      _, err = conn.Write(h)
+      conn.SetWriteDeadline(time.Time{})
+    }
+    if err != nil {
+      conn.Close()
+      return nil, err
+    }
+  }
+  return conn, nil
+}
+
+// Obtain the host requests to a backend address are made for. Unix sockets
+// have no host, so requests to them are made for localhost.
+func host(addr string) string {
+  if n, _ := route.SplitNetwork(addr); n == route.NetworkUnix {
+    return "localhost"
+  }
+  return addr
+}
+
+// Obtain a TLS config for checking a backend. Backends which use TLS are
+// checked with the same config connections to them are made with; otherwise
+// the server name is the address' host.
+func tlsConfig(addr string, p map[string]string) (*tls.Config, error) {
+  c, err := tlsconfig.Client(p, addr)
+  if err != nil || c != nil {
+    return c, err
+  }
+  h, _, _ := net.SplitHostPort(addr)
+  return &tls.Config{ServerName:h}, nil
+}
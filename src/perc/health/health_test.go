@@ -0,0 +1,185 @@
+package health
+
+import (
+  "net"
+  "bufio"
+  "context"
+  "time"
+  "strings"
+  "testing"
+  "net/http"
+  "crypto/tls"
+  "net/http/httptest"
+  
+  "perc/route"
+  "perc/tlsconfig"
+  "perc/tlsconfig/tlstest"
+)
+
+import (
+  "github.com/stretchr/testify/assert"
+)
+
+func TestParseSpec(t *testing.T) {
+  s, err := parseSpec(map[string]string{"tls": "example.com"})
+  assert.Nil(t, err)
+  assert.Nil(t, s)
+  
+  s, err = parseSpec(map[string]string{"check": "http", "check_interval": "1s", "check_fall": "3"})
+  if assert.Nil(t, err) {
+    assert.Equal(t, "http", s.kind)
+    assert.Equal(t, time.Second, s.interval)
+    assert.Equal(t, DefaultTimeout, s.timeout)
+    assert.Equal(t, 3, s.fall)
+    assert.Equal(t, DefaultRise, s.rise)
+  }
+  
+  _, err = parseSpec(map[string]string{"check": "carrier-pigeon"})
+  assert.NotNil(t, err)
+  _, err = parseSpec(map[string]string{"check": "tcp", "check_interval": "often"})
+  assert.NotNil(t, err)
+  _, err = parseSpec(map[string]string{"check": "tcp", "check_rise": "0"})
+  assert.NotNil(t, err)
+}
+
+func TestCheckTCP(t *testing.T) {
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if !assert.Nil(t, err) {
+    return
+  }
+  go func() {
+    for {
+      c, err := l.Accept()
+      if err != nil {
+        return
+      }
+      c.Close()
+    }
+  }()
+  
+  addr := l.Addr().String()
+  b := route.Backend{Addr:addr, Params:map[string]string{"check": "tcp", "check_interval": "20ms", "check_fall": "2", "check_rise": "1"}}
+  r, err := route.New(":0", []route.Backend{b})
+  if !assert.Nil(t, err) {
+    return
+  }
+  
+  c := NewChecker()
+  defer c.Stop()
+  c.Routes([]*route.Route{r})
+  assert.True(t, c.Healthy(addr, b))
+  
+  l.Close()
+  <- time.After(time.Millisecond * 200)
+  assert.False(t, c.Healthy(addr, b))
+  assert.False(t, c.Status()[addr].Healthy)
+  
+  // backends which are not checked are always healthy
+  assert.True(t, c.Healthy("127.0.0.1:1", route.Backend{Addr:"127.0.0.1:1"}))
+  
+  // removing the route stops checking the backend
+  c.Routes(nil)
+  assert.Equal(t, 0, len(c.Status()))
+}
+
+func TestCheckPerBackend(t *testing.T) {
+  h := httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+    if req.URL.Path != "/ok" {
+      rsp.WriteHeader(http.StatusInternalServerError)
+    }
+  }))
+  defer h.Close()
+  
+  // two routes check the same address differently
+  addr := strings.TrimPrefix(h.URL, "http://")
+  a := route.Backend{Addr:addr, Params:map[string]string{"check": "http", "check_path": "/ok", "check_interval": "20ms", "check_fall": "1"}}
+  b := route.Backend{Addr:addr, Params:map[string]string{"check": "http", "check_path": "/bad", "check_interval": "20ms", "check_fall": "1"}}
+  r1, err := route.New(":0", []route.Backend{a})
+  if !assert.Nil(t, err) {
+    return
+  }
+  r2, err := route.New(":1", []route.Backend{b})
+  if !assert.Nil(t, err) {
+    return
+  }
+  
+  c := NewChecker()
+  defer c.Stop()
+  c.Routes([]*route.Route{r1, r2})
+  <- time.After(time.Millisecond * 200)
+  assert.True(t, c.Healthy(addr, a))
+  assert.False(t, c.Healthy(addr, b))
+  assert.Equal(t, 2, len(c.Status()))
+  
+  // equivalent params identify the same check
+  assert.Equal(t, specKey(map[string]string{"check": "tcp"}), specKey(map[string]string{"check": "tcp", "check_interval": "10s", "check_rise": "2", "check_path": "/"}))
+}
+
+func TestCheckProxyProtocol(t *testing.T) {
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if !assert.Nil(t, err) {
+    return
+  }
+  defer l.Close()
+  headers := make(chan string, 1)
+  go func() {
+    c, err := l.Accept()
+    if err != nil {
+      return
+    }
+    h, _ := bufio.NewReader(c).ReadString('\n')
+    headers <- h
+    c.Close()
+  }()
+  
+  s, err := parseSpec(map[string]string{"check": "tcp", "proxy_protocol": "v1"})
+  if !assert.Nil(t, err) {
+    return
+  }
+  assert.Nil(t, s.check(context.Background(), l.Addr().String()))
+  select {
+    case h := <- headers:
+      assert.Equal(t, "PROXY UNKNOWN\r\n", h)
+    case <- time.After(time.Second):
+      t.Errorf("No header received")
+  }
+}
+
+func TestCheckMutualTLS(t *testing.T) {
+  f, err := tlstest.Generate()
+  if !assert.Nil(t, err) {
+    return
+  }
+  defer f.Remove()
+  
+  // with TLS 1.3 a client only learns its certificate was rejected after the handshake
+  conf, err := tlsconfig.Server(map[string]string{tlsconfig.ParamCert: f.ServerCert, tlsconfig.ParamKey: f.ServerKey, tlsconfig.ParamClientCA: f.CA, tlsconfig.ParamMaxVersion: "1.2"})
+  if !assert.Nil(t, err) {
+    return
+  }
+  l, err := tls.Listen("tcp", "127.0.0.1:0", conf)
+  if !assert.Nil(t, err) {
+    return
+  }
+  defer l.Close()
+  go func() {
+    for {
+      c, err := l.Accept()
+      if err != nil {
+        return
+      }
+      c.(*tls.Conn).Handshake()
+      c.Close()
+    }
+  }()
+  
+  // checks present the client certificate connections are made with
+  s, err := parseSpec(map[string]string{"check": "tls", "tls": "localhost", "tls_ca": f.CA, "tls_cert": f.ClientCert, "tls_key": f.ClientKey})
+  if assert.Nil(t, err) {
+    assert.Nil(t, s.check(context.Background(), l.Addr().String()))
+  }
+  s, err = parseSpec(map[string]string{"check": "tls", "tls": "localhost", "tls_ca": f.CA})
+  if assert.Nil(t, err) {
+    assert.NotNil(t, s.check(context.Background(), l.Addr().String()))
+  }
+}
@@ -5,12 +5,19 @@ import (
   "fmt"
   "flag"
   "time"
+  "sync"
+  "bufio"
+  "strconv"
+  "syscall"
+  "context"
   "strings"
   "net/http"
+  "os/signal"
   "crypto/sha1"
   "encoding/json"
   
   "perc/route"
+  "perc/config"
   "perc/service"
   "perc/discovery"
 )
@@ -48,10 +55,20 @@ func main() {
   fReadTimeout  := cmdline.Duration ("timeout:read",    strToDur(coalesce(os.Getenv("HP_TIMEOUT_READ"), "1m")),             "The read timeout for client connections.")
   fWriteTimeout := cmdline.Duration ("timeout:write",   strToDur(coalesce(os.Getenv("HP_TIMEOUT_WRITE"), "1m")),            "The write timeout for client connections.")
   fCacheTimeout := cmdline.Duration ("timeout:cache",   strToDur(coalesce(os.Getenv("HP_TIMEOUT_CACHE"), "30s")),           "The timeout for cached service providers. This should not be significantly larger than the backend's expiration.")
+  fDrainTimeout := cmdline.Duration ("timeout:shutdown", strToDur(coalesce(os.Getenv("HP_TIMEOUT_SHUTDOWN"), "30s")),        "The amount of time open connections are given to finish on shutdown, or when their route is removed, before they are forcibly closed.")
+  fDialAttempts := cmdline.Int      ("dial:attempts",   strToInt(coalesce(os.Getenv("HP_DIAL_ATTEMPTS"), "3")),             "The maximum number of backends or service providers a client connection is attempted with before it is closed.")
+  fDialBudget   := cmdline.Duration ("dial:budget",     strToDur(coalesce(os.Getenv("HP_DIAL_BUDGET"), "0")),                "The overall time allowed to connect a client to a backend across every attempt, or zero for no limit. Each attempt is still limited by -timeout:connect.")
+  fLimitConns   := cmdline.Int      ("limit:conns",     strToInt(coalesce(os.Getenv("HP_LIMIT_CONNS"), "0")),               "The maximum number of client connections handled at once across every route, or zero for no limit. Routes and backends may set their own limits with the 'max_conns' param.")
+  fLimitQueue   := cmdline.Duration ("limit:queue",     strToDur(coalesce(os.Getenv("HP_LIMIT_QUEUE"), "0")),                "How long a client connection waits for a connection limit to be freed before it is rejected, or zero to reject it immediately. Routes may set their own with the 'queue_timeout' param.")
+  fLimitRate    := cmdline.Float64  ("limit:rate",      strToFloat(coalesce(os.Getenv("HP_LIMIT_RATE"), "0")),              "The rate, in connections per second, each client IP address may connect at across every route, or zero for no limit. Routes may set their own per-client limits with the 'rate' param.")
+  fLimitBurst   := cmdline.Int      ("limit:burst",     strToInt(coalesce(os.Getenv("HP_LIMIT_BURST"), "0")),               "The number of connections each client IP address may make at once before -limit:rate applies. Defaults to the rate, rounded up.")
+  fLimitDelay   := cmdline.Duration ("limit:delay",     strToDur(coalesce(os.Getenv("HP_LIMIT_DELAY"), "0")),                "How long a connection which exceeds -limit:rate may be delayed until it is allowed, or zero to close it immediately.")
   fOptimize     := cmdline.Bool     ("optimize",        strToBool(os.Getenv("HP_OPTIMIZE")),                                "Optimize data transfer, if possible, by enabling zero-copy transfer.")
   fDebug        := cmdline.Bool     ("debug",           strToBool(os.Getenv("HP_DEBUG")),                                   "Enable debugging mode.")
   fStack        := cmdline.Bool     ("debug:stack",     strToBool(os.Getenv("HP_DEBUG_STACK")),                             "Enable stack debugging mode.")
   fVerbose      := cmdline.Bool     ("verbose",         strToBool(os.Getenv("HP_VERBOSE")),                                 "Enable verbose debugging mode.")
+  fRoutes       := cmdline.String   ("routes",          os.Getenv("HP_ROUTES_FILE"),                                         "A file containing proxy routes, one per line, in the same form as -route. Blank lines and lines beginning with '#' are ignored. This file is re-read when routes are reloaded.")
+  fConfig       := cmdline.String   ("config",          os.Getenv("HP_CONFIG"),                                              "A YAML or JSON configuration file. Settings in this file are used unless they are provided on the command line or by their environment variable, and its routes are added to those otherwise defined. Only routes are updated when routes are reloaded.")
   cmdline.Var    (&proxyRoutes,      "route",                                                                               "Add a proxy route for the specified service as: 'listen_port=(host:port,...|service)'. Use this flag repeatedly for multiple routes.")
   cmdline.Parse(os.Args[1:])
   
@@ -60,10 +77,22 @@ func main() {
       proxyRoutes = append(proxyRoutes, strings.TrimSpace(e))
     }
   }
-  if len(proxyRoutes) < 1 {
-    fmt.Println("* * * No routes defined; use -route 'listen_port=(host:port,...|service)'")
+  if len(proxyRoutes) < 1 && *fRoutes == "" && *fConfig == "" {
+    fmt.Println("* * * No routes defined; use -route 'listen_port=(host:port,...|service)', -routes <file>, or -config <file>")
     os.Exit(-1)
   }
+  if *fConfig != "" {
+    conf, err := config.Load(*fConfig)
+    if err != nil {
+      fmt.Printf("* * * Could not load configuration: %v\n", err)
+      os.Exit(-1)
+    }
+    err = configure(cmdline, conf)
+    if err != nil {
+      fmt.Printf("* * * Invalid configuration: %v: %v\n", *fConfig, err)
+      os.Exit(-1)
+    }
+  }
   
   debug.DEBUG = *fDebug
   debug.VERBOSE = *fVerbose
@@ -130,16 +159,9 @@ func main() {
     }
   }
   
-  var routes []*route.Route
-  for _, e := range proxyRoutes {
-    r, err := route.Parse(e)
-    if err != nil {
-      panic(err)
-    }
-    if r.Service && disc == nil {
-      panic(fmt.Errorf("No discovery service is defined but a service is used in route: %v", e))
-    }
-    routes = append(routes, r)
+  routes, err := loadRoutes(proxyRoutes, *fRoutes, *fConfig, disc)
+  if err != nil {
+    panic(err)
   }
   
   if *fStack {
@@ -147,8 +169,11 @@ func main() {
     debug.DumpRoutinesOnInterrupt()
   }
   if *fOptimize {
-    fmt.Println("-----> Enabling OS-specific optimizations")
-    panic("OS-specific optimizations are broken!")
+    if service.ZeroCopy {
+      fmt.Println("-----> Enabling zero-copy transfer for plain TCP and Unix socket routes")
+    }else{
+      fmt.Println("-----> Zero-copy transfer is not supported on this platform; data will be copied")
+    }
   }
   if *fIOTimeout > 0 {
     *fReadTimeout = *fIOTimeout
@@ -163,9 +188,29 @@ func main() {
     ConnTimeout:  *fConnTimeout,
     ReadTimeout:  *fReadTimeout,
     WriteTimeout: *fWriteTimeout,
+    DrainTimeout: *fDrainTimeout,
+    DialAttempts: *fDialAttempts,
+    DialBudget:   *fDialBudget,
+    MaxConns:     *fLimitConns,
+    QueueTimeout: *fLimitQueue,
+    RateLimit:    *fLimitRate,
+    RateBurst:    *fLimitBurst,
+    RateDelay:    *fLimitDelay,
+    Optimize:     *fOptimize,
     Debug:        *fDebug,
   })
   
+  var reloadLock sync.Mutex
+  reload := func() error {
+    reloadLock.Lock()
+    defer reloadLock.Unlock()
+    routes, err := loadRoutes(proxyRoutes, *fRoutes, *fConfig, disc)
+    if err != nil {
+      return err
+    }
+    return svc.Reload(routes)
+  }
+  
   if *fMonitor != "" && *fMonitor != "none" {
     fmt.Printf("-----> Starting monitor and pprof at %v\n", *fMonitor)
     go func() {
@@ -174,11 +219,189 @@ func main() {
         rsp.WriteHeader(http.StatusOK)
         rsp.Write(d)
       })
+      http.HandleFunc("/v1/reload", func(rsp http.ResponseWriter, req *http.Request){
+        if req.Method != "POST" {
+          rsp.WriteHeader(http.StatusMethodNotAllowed)
+          return
+        }
+        fmt.Println("-----> Reloading routes (requested by monitor)")
+        err := reload()
+        if err != nil {
+          alt.Errorf("* * * Could not reload routes: %v", err)
+          rsp.WriteHeader(http.StatusBadRequest)
+          rsp.Write([]byte(err.Error()))
+          return
+        }
+        rsp.WriteHeader(http.StatusOK)
+      })
       alt.Errorf("* * * Could not monitor: %v", http.ListenAndServe(*fMonitor, nil))
     }()
   }
   
-  panic(svc.Run())
+  go func() {
+    sig := make(chan os.Signal, 1)
+    signal.Notify(sig, syscall.SIGHUP)
+    for range sig {
+      fmt.Println("-----> Reloading routes (received SIGHUP)")
+      err := reload()
+      if err != nil {
+        alt.Errorf("* * * Could not reload routes: %v", err)
+      }
+    }
+  }()
+  
+  go func() {
+    sig := make(chan os.Signal, 2)
+    signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+    fmt.Printf("-----> Received %v; shutting down (draining connections for up to %v)\n", <- sig, *fDrainTimeout)
+    go func() {
+      fmt.Printf("-----> Received %v again; exiting immediately\n", <- sig)
+      os.Exit(1)
+    }()
+    cxt, cancel := context.WithTimeout(context.Background(), *fDrainTimeout)
+    defer cancel()
+    err := svc.Shutdown(cxt)
+    if err != nil {
+      alt.Errorf("* * * Could not drain connections: %v", err)
+    }
+  }()
+  
+  err = svc.Run(context.Background())
+  if err != nil {
+    panic(err)
+  }
+  fmt.Println("-----> Shutdown complete")
+}
+
+// The environment variables which provide flags that may also be set in the
+// configuration file
+var flagEnv = map[string]string{
+  "monitor":          "HP_API_MONITOR",
+  "discovery":        "HP_DISCOVERY_SERVICE",
+  "domain":           "HP_DISCOVERY_DOMAIN",
+  "influxdb":         "HP_METRICS_INFLUXDB",
+  "timeout":          "HP_TIMEOUT",
+  "timeout:connect":  "HP_TIMEOUT_CONNECT",
+  "timeout:read":     "HP_TIMEOUT_READ",
+  "timeout:write":    "HP_TIMEOUT_WRITE",
+  "timeout:cache":    "HP_TIMEOUT_CACHE",
+  "timeout:shutdown": "HP_TIMEOUT_SHUTDOWN",
+  "dial:attempts":    "HP_DIAL_ATTEMPTS",
+  "dial:budget":      "HP_DIAL_BUDGET",
+  "limit:conns":      "HP_LIMIT_CONNS",
+  "limit:queue":      "HP_LIMIT_QUEUE",
+  "limit:rate":       "HP_LIMIT_RATE",
+  "limit:burst":      "HP_LIMIT_BURST",
+  "limit:delay":      "HP_LIMIT_DELAY",
+}
+
+// Apply settings from a configuration file to flags. A setting is provided,
+// in order of precedence, by its flag on the command line, then by its
+// environment variable, then by the configuration file, and otherwise takes
+// its default.
+func configure(cmdline *flag.FlagSet, conf *config.Config) error {
+  set := make(map[string]bool)
+  cmdline.Visit(func(f *flag.Flag){
+    set[f.Name] = true
+  })
+  for k, v := range flagEnv {
+    if os.Getenv(v) != "" {
+      set[k] = true
+    }
+  }
+  
+  settings := map[string]string{
+    "monitor":          conf.Monitor,
+    "discovery":        conf.Discovery.Service,
+    "domain":           conf.Discovery.Domain,
+    "influxdb":         conf.Metrics.InfluxDB,
+    "timeout":          durToStr(conf.Timeouts.IO),
+    "timeout:connect":  durToStr(conf.Timeouts.Connect),
+    "timeout:read":     durToStr(conf.Timeouts.Read),
+    "timeout:write":    durToStr(conf.Timeouts.Write),
+    "timeout:cache":    durToStr(conf.Timeouts.Cache),
+    "timeout:shutdown": durToStr(conf.Timeouts.Shutdown),
+    "dial:attempts":    intToStr(conf.Dial.Attempts),
+    "dial:budget":      durToStr(conf.Dial.Budget),
+    "limit:conns":      intToStr(conf.Limits.Conns),
+    "limit:queue":      durToStr(conf.Limits.Queue),
+    "limit:rate":       floatToStr(conf.Limits.Rate),
+    "limit:burst":      intToStr(conf.Limits.Burst),
+    "limit:delay":      durToStr(conf.Limits.Delay),
+  }
+  for k, v := range settings {
+    if v != "" && !set[k] {
+      err := cmdline.Set(k, v)
+      if err != nil {
+        return err
+      }
+    }
+  }
+  
+  return nil
+}
+
+// Parse the routes provided on the command line, in the routes file, and in
+// the configuration file, if any
+func loadRoutes(specs []string, file, conf string, disc discovery.Service) ([]*route.Route, error) {
+  if file != "" {
+    f, err := readRoutes(file)
+    if err != nil {
+      return nil, err
+    }
+    specs = append(append([]string(nil), specs...), f...)
+  }
+  
+  var routes []*route.Route
+  for _, e := range specs {
+    r, err := route.Parse(e)
+    if err != nil {
+      return nil, err
+    }
+    routes = append(routes, r)
+  }
+  
+  if conf != "" {
+    c, err := config.Load(conf)
+    if err != nil {
+      return nil, err
+    }
+    routes = append(routes, c.ProxyRoutes()...)
+  }
+  
+  if len(routes) < 1 {
+    return nil, fmt.Errorf("No routes defined")
+  }
+  for _, e := range routes {
+    if e.Service && disc == nil {
+      return nil, fmt.Errorf("No discovery service is defined but a service is used in route: %v", e)
+    }
+  }
+  
+  return routes, nil
+}
+
+// Read route specs from a file, one per line
+func readRoutes(p string) ([]string, error) {
+  f, err := os.Open(p)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+  
+  var specs []string
+  scanner := bufio.NewScanner(f)
+  for scanner.Scan() {
+    l := strings.TrimSpace(scanner.Text())
+    if l != "" && l[0] != '#' {
+      specs = append(specs, l)
+    }
+  }
+  if err := scanner.Err(); err != nil {
+    return nil, err
+  }
+  
+  return specs, nil
 }
 
 // String to bool
@@ -195,6 +418,48 @@ func strToDur(s string) time.Duration {
   return d
 }
 
+// String to int
+func strToInt(s string) int {
+  v, err := strconv.Atoi(s)
+  if err != nil {
+    panic(err)
+  }
+  return v
+}
+
+// String to float
+func strToFloat(s string) float64 {
+  v, err := strconv.ParseFloat(s, 64)
+  if err != nil {
+    panic(err)
+  }
+  return v
+}
+
+// Configured int to string; an int which is not set is empty
+func intToStr(v *int) string {
+  if v == nil {
+    return ""
+  }
+  return strconv.Itoa(*v)
+}
+
+// Configured float to string; a float which is not set is empty
+func floatToStr(v *float64) string {
+  if v == nil {
+    return ""
+  }
+  return strconv.FormatFloat(*v, 'g', -1, 64)
+}
+
+// Configured duration to string; a duration which is not set is empty
+func durToStr(d config.Duration) string {
+  if !d.Set {
+    return ""
+  }
+  return d.Duration.String()
+}
+
 // Return the first non-empty string from those provided
 func coalesce(v... string) string {
   for _, e := range v {
@@ -0,0 +1,43 @@
+package main
+
+import (
+  "flag"
+  "time"
+  "testing"
+  
+  "perc/config"
+)
+
+import (
+  "github.com/stretchr/testify/assert"
+)
+
+func TestConfigure(t *testing.T) {
+  c, err := config.Parse("test.yml", []byte("timeouts:\n  read: 5s\n  write: 5s\ndial:\n  attempts: 0\nlimits:\n  conns: 5\n  rate: 0\n  burst: 0\n"))
+  if !assert.Nil(t, err) {
+    return
+  }
+  t.Setenv("HP_LIMIT_CONNS", "7")
+  
+  cmdline := flag.NewFlagSet("test", flag.ContinueOnError)
+  fReadTimeout  := cmdline.Duration ("timeout:read",  time.Minute, "")
+  fWriteTimeout := cmdline.Duration ("timeout:write", time.Minute, "")
+  fDialAttempts := cmdline.Int      ("dial:attempts", 3, "")
+  fLimitConns   := cmdline.Int      ("limit:conns",   7, "") // the default is taken from the environment
+  fLimitRate    := cmdline.Float64  ("limit:rate",    10, "")
+  fLimitBurst   := cmdline.Int      ("limit:burst",   10, "")
+  if !assert.Nil(t, cmdline.Parse([]string{"-timeout:read=1s"})) {
+    return
+  }
+  
+  // flags take precedence over the environment, which takes precedence over
+  // the file, and zero may be configured
+  if assert.Nil(t, configure(cmdline, c)) {
+    assert.Equal(t, time.Second, *fReadTimeout)
+    assert.Equal(t, 5 * time.Second, *fWriteTimeout)
+    assert.Equal(t, 0, *fDialAttempts)
+    assert.Equal(t, 7, *fLimitConns)
+    assert.Equal(t, float64(0), *fLimitRate)
+    assert.Equal(t, 0, *fLimitBurst)
+  }
+}
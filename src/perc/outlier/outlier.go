@@ -0,0 +1,329 @@
+package outlier
+
+import (
+  "fmt"
+  "sync"
+  "time"
+  "strconv"
+  
+  "perc/route"
+)
+
+import (
+  "github.com/bww/go-alert"
+  "github.com/rcrowley/go-metrics"
+)
+
+// Backend params which configure outlier detection. Detection is disabled
+// unless a failure count or rate is provided.
+const (
+  ParamFailures   = "outlier_failures"  // consecutive dial failures before a backend is ejected; unset or 0 disables
+  ParamRate       = "outlier_rate"      // the failure rate, between 0 and 1, at which a backend is ejected; unset disables
+  ParamWindow     = "outlier_window"    // the window over which the failure rate is measured
+  ParamMinimum    = "outlier_minimum"   // the minimum number of attempts in a window before the failure rate is considered
+  ParamEject      = "outlier_eject"     // how long a backend is ejected for the first time
+  ParamEjectMax   = "outlier_eject_max" // the longest a backend is ejected for after repeated ejections
+)
+
+const (
+  DefaultFailures = 0
+  DefaultWindow   = time.Minute
+  DefaultMinimum  = 10
+  DefaultEject    = time.Second * 10
+  DefaultEjectMax = time.Minute * 5
+)
+
+// Backends which have not been used for this long are forgotten
+const stateExpiry = time.Minute * 10
+
+var (
+  outlierEjectRate metrics.Meter
+)
+
+func init() {
+  outlierEjectRate = metrics.NewMeter()
+  metrics.Register("percolator.outlier.eject.rate", outlierEjectRate)
+}
+
+// An outlier detection policy, derived from backend params
+type policy struct {
+  failures  int
+  rate      float64
+  window    time.Duration
+  minimum   int
+  eject     time.Duration
+  ejectMax  time.Duration
+}
+
+// Create a policy from backend params
+func parsePolicy(p map[string]string) (policy, error) {
+  var err error
+  c := policy{DefaultFailures, 0, DefaultWindow, DefaultMinimum, DefaultEject, DefaultEjectMax}
+  if v, ok := p[ParamFailures]; ok {
+    c.failures, err = strconv.Atoi(v)
+    if err != nil || c.failures < 0 {
+      return c, fmt.Errorf("Invalid outlier failure count: %v", v)
+    }
+  }
+  if v, ok := p[ParamRate]; ok {
+    c.rate, err = strconv.ParseFloat(v, 64)
+    if err != nil || c.rate <= 0 || c.rate > 1 {
+      return c, fmt.Errorf("Invalid outlier failure rate: %v", v)
+    }
+  }
+  if v, ok := p[ParamWindow]; ok {
+    c.window, err = time.ParseDuration(v)
+    if err != nil || c.window <= 0 {
+      return c, fmt.Errorf("Invalid outlier window: %v", v)
+    }
+  }
+  if v, ok := p[ParamMinimum]; ok {
+    c.minimum, err = strconv.Atoi(v)
+    if err != nil || c.minimum < 1 {
+      return c, fmt.Errorf("Invalid outlier minimum: %v", v)
+    }
+  }
+  if v, ok := p[ParamEject]; ok {
+    c.eject, err = time.ParseDuration(v)
+    if err != nil || c.eject <= 0 {
+      return c, fmt.Errorf("Invalid outlier ejection time: %v", v)
+    }
+  }
+  if v, ok := p[ParamEjectMax]; ok {
+    c.ejectMax, err = time.ParseDuration(v)
+    if err != nil || c.ejectMax <= 0 {
+      return c, fmt.Errorf("Invalid outlier maximum ejection time: %v", v)
+    }
+  }
+  if c.ejectMax < c.eject {
+    c.ejectMax = c.eject
+  }
+  return c, nil
+}
+
+// Does the policy eject backends at all
+func (p policy) enabled() bool {
+  return p.failures > 0 || p.rate > 0
+}
+
+// Describe the policy
+func (p policy) String() string {
+  return fmt.Sprintf("failures=%d;rate=%v;window=%v;minimum=%d;eject=%v;eject_max=%v", p.failures, p.rate, p.window, p.minimum, p.eject, p.ejectMax)
+}
+
+// Produce a key which identifies the outlier params of a backend, so they
+// need only be parsed once
+func paramKey(p map[string]string) string {
+  var k string
+  for _, e := range []string{ParamFailures, ParamRate, ParamWindow, ParamMinimum, ParamEject, ParamEjectMax} {
+    if v, ok := p[e]; ok {
+      k += e +"="+ v +";"
+    }
+  }
+  return k
+}
+
+// Validate the outlier detection params for a backend
+func Validate(b route.Backend) error {
+  _, err := parsePolicy(b.Params)
+  return err
+}
+
+// The outlier status of a backend
+type Status struct {
+  Ejected       bool      `json:"ejected"`
+  EjectedUntil  time.Time `json:"ejected_until,omitempty"`
+  Ejections     int       `json:"ejections"`
+  Consecutive   int       `json:"consecutive_failures"`
+  Attempts      int       `json:"window_attempts"`
+  Failures      int       `json:"window_failures"`
+}
+
+// Failure tracking for a backend
+type state struct {
+  consecutive int
+  attempts    int
+  failures    int
+  window      time.Time
+  ejections   int
+  until       time.Time
+  probation   bool
+  used        time.Time
+}
+
+// Identifies the failures tracked for an address under a policy. Backends with
+// the same address but different policies are tracked separately.
+type stateKey struct {
+  addr    string
+  policy  policy
+}
+
+// A detector tracks dial failures for backends and ejects those which fail
+// too often. Ejected backends are re-admitted after an ejection period which
+// doubles each time the backend is ejected again, up to a maximum.
+type Detector struct {
+  sync.Mutex
+  backends  map[stateKey]*state
+  policies  map[string]policy
+  swept     time.Time
+}
+
+// Create a detector
+func NewDetector() *Detector {
+  return &Detector{sync.Mutex{}, make(map[stateKey]*state), make(map[string]policy), time.Now()}
+}
+
+// Determine whether a backend address is available; that is, not ejected
+func (d *Detector) Available(addr string, b route.Backend) bool {
+  d.Lock()
+  defer d.Unlock()
+  p, ok := d.policy(b.Params)
+  if !ok {
+    return true
+  }
+  if e, ok := d.backends[stateKey{addr, p}]; ok {
+    return !time.Now().Before(e.until)
+  }
+  return true
+}
+
+// Record a successful connection to a backend address
+func (d *Detector) Success(addr string, b route.Backend) {
+  d.record(addr, b, true)
+}
+
+// Record a failed connection to a backend address
+func (d *Detector) Failure(addr string, b route.Backend) {
+  d.record(addr, b, false)
+}
+
+// Obtain the status of every backend which has failed or been ejected, by
+// address. When an address is tracked under several policies, each is
+// described by the address followed by its policy.
+func (d *Detector) Status() map[string]Status {
+  d.Lock()
+  defer d.Unlock()
+  now := time.Now()
+  n := make(map[string]int)
+  for k := range d.backends {
+    n[k.addr]++
+  }
+  s := make(map[string]Status)
+  for k, e := range d.backends {
+    if e.failures > 0 || e.ejections > 0 {
+      x := Status{Ejections:e.ejections, Consecutive:e.consecutive, Attempts:e.attempts, Failures:e.failures}
+      if now.Before(e.until) {
+        x.Ejected, x.EjectedUntil = true, e.until
+      }
+      if n[k.addr] > 1 {
+        s[k.addr +" ("+ k.policy.String() +")"] = x
+      }else{
+        s[k.addr] = x
+      }
+    }
+  }
+  return s
+}
+
+// Obtain the policy configured by backend params, parsing them only the first
+// time they are seen. If the params don't enable detection false is returned.
+// The detector must be locked.
+func (d *Detector) policy(p map[string]string) (policy, bool) {
+  k := paramKey(p)
+  c, ok := d.policies[k]
+  if !ok {
+    var err error
+    c, err = parsePolicy(p)
+    if err != nil {
+      c = policy{} // validated when routes are loaded
+    }
+    d.policies[k] = c
+  }
+  return c, c.enabled()
+}
+
+// Record the result of a connection attempt
+func (d *Detector) record(addr string, b route.Backend, ok bool) {
+  d.Lock()
+  defer d.Unlock()
+  p, enabled := d.policy(b.Params)
+  if !enabled {
+    return
+  }
+  now := time.Now()
+  d.sweep(now)
+  
+  k := stateKey{addr, p}
+  e, exists := d.backends[k]
+  if !exists {
+    if ok && p.rate == 0 {
+      return // nothing to track for healthy backends
+    }
+    e = &state{window:now}
+    d.backends[k] = e
+  }
+  e.used = now
+  
+  if now.Sub(e.window) > p.window {
+    e.attempts, e.failures, e.window = 0, 0, now
+  }
+  if e.ejections > 0 && !e.probation && now.Sub(e.until) > p.ejectMax {
+    e.ejections = 0 // it has been a while; forget previous ejections
+  }
+  
+  e.attempts++
+  if ok {
+    e.consecutive = 0
+    e.probation = false
+    return
+  }
+  
+  e.failures++
+  e.consecutive++
+  if now.Before(e.until) {
+    return // already ejected
+  }
+  switch {
+    case e.probation:
+      d.eject(addr, e, p, now, "failed after re-admission")
+    case p.failures > 0 && e.consecutive >= p.failures:
+      d.eject(addr, e, p, now, fmt.Sprintf("%d consecutive failures", e.consecutive))
+    case p.rate > 0 && e.attempts >= p.minimum && float64(e.failures) / float64(e.attempts) >= p.rate:
+      d.eject(addr, e, p, now, fmt.Sprintf("%d of %d attempts failed", e.failures, e.attempts))
+  }
+}
+
+// Eject a backend. The detector must be locked.
+func (d *Detector) eject(addr string, e *state, p policy, now time.Time, reason string) {
+  t := p.eject
+  for i := 0; i < e.ejections && t < p.ejectMax; i++ {
+    t *= 2
+  }
+  if t > p.ejectMax {
+    t = p.ejectMax
+  }
+  
+  outlierEjectRate.Mark(1)
+  alt.Errorf("outlier: Ejecting backend for %v: %v: %s", t, addr, reason)
+  
+  e.ejections++
+  e.until = now.Add(t)
+  e.probation = true
+  e.consecutive = 0
+  e.attempts, e.failures, e.window = 0, 0, now
+}
+
+// Forget backends which have not been used recently, and the policies of
+// params which may no longer be used. The detector must be locked.
+func (d *Detector) sweep(now time.Time) {
+  if now.Sub(d.swept) < time.Minute {
+    return
+  }
+  for k, e := range d.backends {
+    if now.Sub(e.used) > stateExpiry && !now.Before(e.until) {
+      delete(d.backends, k)
+    }
+  }
+  d.policies = make(map[string]policy)
+  d.swept = now
+}
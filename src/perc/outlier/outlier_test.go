@@ -0,0 +1,97 @@
+package outlier
+
+import (
+  "time"
+  "strings"
+  "testing"
+  
+  "perc/route"
+)
+
+import (
+  "github.com/stretchr/testify/assert"
+)
+
+func TestConsecutiveFailures(t *testing.T) {
+  d := NewDetector()
+  b := route.Backend{Addr:"a:1", Params:map[string]string{"outlier_failures": "3", "outlier_eject": "50ms"}}
+  
+  d.Failure(b.Addr, b)
+  d.Failure(b.Addr, b)
+  d.Success(b.Addr, b)
+  d.Failure(b.Addr, b)
+  d.Failure(b.Addr, b)
+  assert.True(t, d.Available(b.Addr, b))
+  d.Failure(b.Addr, b)
+  assert.False(t, d.Available(b.Addr, b))
+  assert.True(t, d.Status()[b.Addr].Ejected)
+  
+  // re-admitted after the ejection period, then ejected for twice as long on failure
+  <- time.After(time.Millisecond * 60)
+  assert.True(t, d.Available(b.Addr, b))
+  d.Failure(b.Addr, b)
+  assert.False(t, d.Available(b.Addr, b))
+  assert.Equal(t, 2, d.Status()[b.Addr].Ejections)
+  <- time.After(time.Millisecond * 60)
+  assert.False(t, d.Available(b.Addr, b))
+  <- time.After(time.Millisecond * 50)
+  assert.True(t, d.Available(b.Addr, b))
+  
+  // succeeding after re-admission ends probation
+  d.Success(b.Addr, b)
+  d.Failure(b.Addr, b)
+  assert.True(t, d.Available(b.Addr, b))
+}
+
+func TestFailureRate(t *testing.T) {
+  d := NewDetector()
+  b := route.Backend{Addr:"a:1", Params:map[string]string{"outlier_failures": "0", "outlier_rate": "0.5", "outlier_minimum": "4"}}
+  
+  d.Success(b.Addr, b)
+  d.Failure(b.Addr, b)
+  d.Success(b.Addr, b)
+  assert.True(t, d.Available(b.Addr, b))
+  d.Failure(b.Addr, b)
+  assert.False(t, d.Available(b.Addr, b))
+  
+  assert.True(t, d.Available("b:1", b))
+}
+
+func TestDisabled(t *testing.T) {
+  d := NewDetector()
+  b := route.Backend{Addr:"a:1"}
+  for i := 0; i < 100; i++ {
+    d.Failure(b.Addr, b)
+  }
+  assert.True(t, d.Available(b.Addr, b))
+  assert.Len(t, d.Status(), 0)
+}
+
+func TestPolicyPerBackend(t *testing.T) {
+  d := NewDetector()
+  a := route.Backend{Addr:"a:1", Params:map[string]string{"outlier_failures": "1"}}
+  b := route.Backend{Addr:"a:1", Params:map[string]string{"outlier_failures": "2"}}
+  c := route.Backend{Addr:"a:1", Params:map[string]string{"outlier_failures": "1", "outlier_eject": DefaultEject.String()}}
+  
+  // failures through one backend don't eject the same address for another
+  d.Failure(a.Addr, a)
+  assert.False(t, d.Available(a.Addr, a))
+  assert.True(t, d.Available(b.Addr, b))
+  // but equivalent policies are the same
+  assert.False(t, d.Available(c.Addr, c))
+  
+  d.Failure(b.Addr, b)
+  s := d.Status()
+  if assert.Len(t, s, 2) {
+    for k, v := range s {
+      assert.Contains(t, k, "a:1 (failures=")
+      assert.Equal(t, v.Ejected, strings.Contains(k, "failures=1;"))
+    }
+  }
+}
+
+func TestValidate(t *testing.T) {
+  assert.Nil(t, Validate(route.Backend{Addr:"a:1"}))
+  assert.NotNil(t, Validate(route.Backend{Addr:"a:1", Params:map[string]string{"outlier_rate": "2"}}))
+  assert.NotNil(t, Validate(route.Backend{Addr:"a:1", Params:map[string]string{"outlier_eject": "soon"}}))
+}
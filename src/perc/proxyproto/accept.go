@@ -0,0 +1,259 @@
+package proxyproto
+
+import (
+  "fmt"
+  "io"
+  "net"
+  "time"
+  "bufio"
+  "bytes"
+  "strings"
+  "strconv"
+  "encoding/binary"
+  
+  "perc/route"
+)
+
+// Listener params which configure accepting PROXY protocol headers
+const (
+  ParamProxyTrusted = "proxy_trusted" // comma-separated CIDRs which headers are accepted from; required except on Unix routes
+)
+
+// Accept either PROXY protocol version on a listener
+const Any = "any"
+
+// How long a client has to send a header once it has connected
+const HeaderTimeout = time.Second * 5
+
+// The longest a v1 header may be
+const maxLengthV1 = 107
+
+// Returned when a connection cannot be closed for writing
+var ErrNoCloseWrite = fmt.Errorf("Connection cannot be closed for writing")
+
+// An acceptor reads PROXY protocol headers from client connections accepted
+// from trusted sources
+type Acceptor struct {
+  version string
+  trusted []*net.IPNet
+}
+
+// Create an acceptor from the params of a listener on the provided network.
+// If the params do not enable the PROXY protocol, nil is returned. Since a
+// header determines the address a client is identified by, the sources headers
+// are trusted from must be provided, except for Unix sockets, whose clients
+// have no address and are trusted by the socket's mode.
+func NewAcceptor(network string, p map[string]string) (*Acceptor, error) {
+  v, ok := p[ParamProxyProtocol]
+  if !ok {
+    return nil, nil
+  }
+  if v != V1 && v != V2 && v != Any {
+    return nil, fmt.Errorf("Unsupported PROXY protocol version: %v", v)
+  }
+  a := &Acceptor{version:v}
+  t, ok := p[ParamProxyTrusted]
+  if network == route.NetworkUnix {
+    if ok {
+      return nil, fmt.Errorf("The %v param is not supported for %v routes", ParamProxyTrusted, route.NetworkUnix)
+    }
+    return a, nil
+  }
+  if !ok || strings.TrimSpace(t) == "" {
+    return nil, fmt.Errorf("Accepting the PROXY protocol requires the %v param", ParamProxyTrusted)
+  }
+  for _, e := range strings.Split(t, ",") {
+    _, n, err := net.ParseCIDR(strings.TrimSpace(e))
+    if err != nil {
+      return nil, fmt.Errorf("Invalid trusted PROXY protocol source: %v", e)
+    }
+    a.trusted = append(a.trusted, n)
+  }
+  return a, nil
+}
+
+// Validate the PROXY protocol params for a listener on the provided network
+func ValidateListener(network string, p map[string]string) error {
+  _, err := NewAcceptor(network, p)
+  return err
+}
+
+// Determine whether an address is a trusted source of headers. Every client
+// of a Unix socket is trusted; otherwise only clients in the trusted ranges.
+func (a *Acceptor) Trusted(addr net.Addr) bool {
+  if _, ok := addr.(*net.UnixAddr); ok {
+    return a.trusted == nil
+  }
+  t, ok := addr.(*net.TCPAddr)
+  if !ok {
+    return false
+  }
+  for _, e := range a.trusted {
+    if e.Contains(t.IP) {
+      return true
+    }
+  }
+  return false
+}
+
+// Read the header from a client connection. If the connection is from a
+// trusted source, a connection which reports the addresses described by its
+// header is returned; otherwise the connection is returned as-is. A trusted
+// source must send a header within the header timeout.
+func (a *Acceptor) Accept(c net.Conn) (net.Conn, error) {
+  if !a.Trusted(c.RemoteAddr()) {
+    return c, nil
+  }
+  c.SetReadDeadline(time.Now().Add(HeaderTimeout))
+  r := bufio.NewReader(c)
+  src, dst, err := Read(r, a.version)
+  if err != nil {
+    return nil, err
+  }
+  c.SetReadDeadline(time.Time{})
+  return &Conn{c, r, src, dst}, nil
+}
+
+// Read a header of the provided version, or either version. If the header does
+// not describe a proxied TCP connection nil addresses are returned.
+func Read(r *bufio.Reader, version string) (net.Addr, net.Addr, error) {
+  b, err := r.Peek(len(signature))
+  if err != nil {
+    return nil, nil, fmt.Errorf("Could not read PROXY protocol header: %v", err)
+  }
+  if bytes.Equal(b, signature) {
+    if version == V1 {
+      return nil, nil, fmt.Errorf("Unexpected PROXY protocol version: %v", V2)
+    }
+    return readV2(r)
+  }else if bytes.HasPrefix(b, []byte("PROXY ")) {
+    if version == V2 {
+      return nil, nil, fmt.Errorf("Unexpected PROXY protocol version: %v", V1)
+    }
+    return readV1(r)
+  }else{
+    return nil, nil, fmt.Errorf("Missing PROXY protocol header")
+  }
+}
+
+// Read a v1 (text) header
+func readV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+  var line []byte
+  for len(line) <= maxLengthV1 {
+    b, err := r.ReadByte()
+    if err != nil {
+      return nil, nil, fmt.Errorf("Could not read PROXY protocol header: %v", err)
+    }
+    line = append(line, b)
+    if b == '\n' {
+      break
+    }
+  }
+  if !bytes.HasSuffix(line, []byte("\r\n")) {
+    return nil, nil, fmt.Errorf("Invalid PROXY protocol header")
+  }
+  
+  f := strings.Split(string(line[:len(line)-2]), " ")
+  if len(f) > 1 && f[1] == "UNKNOWN" {
+    return nil, nil, nil
+  }
+  if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+    return nil, nil, fmt.Errorf("Invalid PROXY protocol header: %q", line)
+  }
+  src, err := tcpAddr(f[2], f[4])
+  if err != nil {
+    return nil, nil, err
+  }
+  dst, err := tcpAddr(f[3], f[5])
+  if err != nil {
+    return nil, nil, err
+  }
+  return src, dst, nil
+}
+
+// Read a v2 (binary) header
+func readV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+  h := make([]byte, len(signature) + 4)
+  if _, err := io.ReadFull(r, h); err != nil {
+    return nil, nil, fmt.Errorf("Could not read PROXY protocol header: %v", err)
+  }
+  cmd, fam := h[12], h[13]
+  b := make([]byte, binary.BigEndian.Uint16(h[14:]))
+  if _, err := io.ReadFull(r, b); err != nil {
+    return nil, nil, fmt.Errorf("Could not read PROXY protocol header: %v", err)
+  }
+  
+  switch cmd {
+    case cmdLocal:
+      return nil, nil, nil
+    case cmdProxy:
+    default:
+      return nil, nil, fmt.Errorf("Invalid PROXY protocol command: %#x", cmd)
+  }
+  
+  var n int
+  switch fam {
+    case famTCP4:
+      n = net.IPv4len
+    case famTCP6:
+      n = net.IPv6len
+    default:
+      return nil, nil, nil // not a TCP connection; the addresses are not meaningful to us
+  }
+  if len(b) < n * 2 + 4 {
+    return nil, nil, fmt.Errorf("Invalid PROXY protocol address block")
+  }
+  src := &net.TCPAddr{IP:net.IP(b[:n]), Port:int(binary.BigEndian.Uint16(b[n*2:]))}
+  dst := &net.TCPAddr{IP:net.IP(b[n:n*2]), Port:int(binary.BigEndian.Uint16(b[n*2+2:]))}
+  return src, dst, nil
+}
+
+// Parse a TCP address from a v1 header
+func tcpAddr(host, port string) (*net.TCPAddr, error) {
+  ip := net.ParseIP(host)
+  if ip == nil {
+    return nil, fmt.Errorf("Invalid PROXY protocol address: %v", host)
+  }
+  p, err := strconv.ParseUint(port, 10, 16)
+  if err != nil {
+    return nil, fmt.Errorf("Invalid PROXY protocol port: %v", port)
+  }
+  return &net.TCPAddr{IP:ip, Port:int(p)}, nil
+}
+
+// A client connection which was accepted with a PROXY protocol header and
+// reports the addresses of the connection it describes
+type Conn struct {
+  net.Conn
+  reader    *bufio.Reader
+  src, dst  net.Addr
+}
+
+// Read from the connection, beginning with anything buffered after the header
+func (c *Conn) Read(b []byte) (int, error) {
+  return c.reader.Read(b)
+}
+
+// Close the connection for writing, if the underlying connection supports it
+func (c *Conn) CloseWrite() error {
+  if w, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+    return w.CloseWrite()
+  }
+  return ErrNoCloseWrite
+}
+
+// The address of the original client
+func (c *Conn) RemoteAddr() net.Addr {
+  if c.src != nil {
+    return c.src
+  }
+  return c.Conn.RemoteAddr()
+}
+
+// The address the original client connected to
+func (c *Conn) LocalAddr() net.Addr {
+  if c.dst != nil {
+    return c.dst
+  }
+  return c.Conn.LocalAddr()
+}
@@ -0,0 +1,115 @@
+package proxyproto
+
+import (
+  "io"
+  "net"
+  "bufio"
+  "bytes"
+  "strings"
+  "testing"
+  "io/ioutil"
+)
+
+import (
+  "github.com/stretchr/testify/assert"
+)
+
+func TestRead(t *testing.T) {
+  src := &net.TCPAddr{IP:net.ParseIP("10.0.0.1").To4(), Port:51234}
+  dst := &net.TCPAddr{IP:net.ParseIP("10.0.0.2").To4(), Port:443}
+  for _, v := range []string{V1, V2} {
+    h, err := Header(v, src, dst)
+    if !assert.Nil(t, err) {
+      continue
+    }
+    r := bufio.NewReader(bytes.NewReader(append(h, []byte("payload")...)))
+    s, d, err := Read(r, Any)
+    if assert.Nil(t, err, v) {
+      assert.Equal(t, src.String(), s.String())
+      assert.Equal(t, dst.String(), d.String())
+      rest, _ := ioutil.ReadAll(r)
+      assert.Equal(t, "payload", string(rest))
+    }
+  }
+  
+  for _, v := range []string{V1, V2} {
+    h, _ := Local(v)
+    s, d, err := Read(bufio.NewReader(bytes.NewReader(h)), v)
+    if assert.Nil(t, err, v) {
+      assert.Nil(t, s)
+      assert.Nil(t, d)
+    }
+  }
+  
+  h, _ := Header(V2, src, dst)
+  _, _, err := Read(bufio.NewReader(bytes.NewReader(h)), V1)
+  assert.NotNil(t, err)
+  _, _, err = Read(bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n")), Any)
+  assert.NotNil(t, err)
+  _, _, err = Read(bufio.NewReader(strings.NewReader("PROXY TCP4 10.0.0.1 10.0.0.2 99999 443\r\n")), Any)
+  assert.NotNil(t, err)
+  _, _, err = Read(bufio.NewReader(strings.NewReader("PROXY TCP4 "+ strings.Repeat("1", 200) +"\r\n")), Any)
+  assert.NotNil(t, err)
+}
+
+func TestAcceptor(t *testing.T) {
+  a, err := NewAcceptor("tcp", map[string]string{})
+  assert.Nil(t, err)
+  assert.Nil(t, a)
+  
+  _, err = NewAcceptor("tcp", map[string]string{ParamProxyProtocol: "v3"})
+  assert.NotNil(t, err)
+  _, err = NewAcceptor("tcp", map[string]string{ParamProxyProtocol: Any, ParamProxyTrusted: "10.0.0.0/8, nonsense"})
+  assert.NotNil(t, err)
+  
+  // trusted sources must be provided, except on unix sockets, whose peers have no address
+  _, err = NewAcceptor("tcp", map[string]string{ParamProxyProtocol: Any})
+  assert.NotNil(t, err)
+  _, err = NewAcceptor("tcp", map[string]string{ParamProxyProtocol: Any, ParamProxyTrusted: " "})
+  assert.NotNil(t, err)
+  _, err = NewAcceptor("unix", map[string]string{ParamProxyProtocol: Any, ParamProxyTrusted: "10.0.0.0/8"})
+  assert.NotNil(t, err)
+  a, err = NewAcceptor("unix", map[string]string{ParamProxyProtocol: Any})
+  if assert.Nil(t, err) {
+    assert.True(t, a.Trusted(&net.UnixAddr{Name:"@", Net:"unix"}))
+    assert.False(t, a.Trusted(&net.TCPAddr{IP:net.ParseIP("192.168.1.1")}))
+  }
+  a, err = NewAcceptor("tcp", map[string]string{ParamProxyProtocol: Any, ParamProxyTrusted: "10.0.0.0/8, fd00::/8"})
+  if assert.Nil(t, err) {
+    assert.True(t, a.Trusted(&net.TCPAddr{IP:net.ParseIP("10.1.2.3")}))
+    assert.True(t, a.Trusted(&net.TCPAddr{IP:net.ParseIP("fd00::1")}))
+    assert.False(t, a.Trusted(&net.TCPAddr{IP:net.ParseIP("192.168.1.1")}))
+    assert.False(t, a.Trusted(&net.UnixAddr{Name:"@", Net:"unix"}))
+  }
+}
+
+func TestCloseWrite(t *testing.T) {
+  // a connection which cannot be half-closed reports the sentinel
+  a, b := net.Pipe()
+  defer a.Close()
+  defer b.Close()
+  c := &Conn{Conn:a, reader:bufio.NewReader(a)}
+  assert.Equal(t, ErrNoCloseWrite, c.CloseWrite())
+  
+  // one which can is closed for writing beneath the wrapper
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer l.Close()
+  x, err := net.Dial("tcp", l.Addr().String())
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer x.Close()
+  y, err := l.Accept()
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer y.Close()
+  c = &Conn{Conn:x, reader:bufio.NewReader(x)}
+  if assert.Nil(t, c.CloseWrite()) {
+    _, err = y.Read(make([]byte, 1))
+    assert.Equal(t, io.EOF, err)
+  }
+}
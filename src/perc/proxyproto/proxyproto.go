@@ -0,0 +1,100 @@
+package proxyproto
+
+import (
+  "fmt"
+  "net"
+  "bytes"
+  "encoding/binary"
+  
+  "perc/route"
+)
+
+// The param which enables PROXY protocol headers. On a backend it is the
+// version of the header sent to the backend; on a listener it is the version
+// of the header accepted from clients.
+const ParamProxyProtocol = "proxy_protocol"
+
+// PROXY protocol versions
+const (
+  V1 = "v1"
+  V2 = "v2"
+)
+
+// The v2 header signature
+var signature = []byte{0x0d, 0x0a, 0x0d, 0x0a, 0x00, 0x0d, 0x0a, 0x51, 0x55, 0x49, 0x54, 0x0a}
+
+// v2 commands and address families
+const (
+  cmdLocal  = 0x20
+  cmdProxy  = 0x21
+  famUnspec = 0x00
+  famTCP4   = 0x11
+  famTCP6   = 0x21
+)
+
+// Validate the PROXY protocol params for a backend
+func Validate(b route.Backend) error {
+  if v, ok := b.Params[ParamProxyProtocol]; ok && v != V1 && v != V2 {
+    return fmt.Errorf("Unsupported PROXY protocol version: %v", v)
+  }
+  return nil
+}
+
+// Produce a header describing a connection proxied from the source address to
+// the destination address. If either address is not a TCP address the header
+// does not describe the connection.
+func Header(version string, src, dst net.Addr) ([]byte, error) {
+  s, sok := src.(*net.TCPAddr)
+  d, dok := dst.(*net.TCPAddr)
+  if !sok || !dok {
+    return Local(version)
+  }
+  switch version {
+    case V1:
+      return headerV1(s, d), nil
+    case V2:
+      return headerV2(s, d), nil
+    default:
+      return nil, fmt.Errorf("Unsupported PROXY protocol version: %v", version)
+  }
+}
+
+// Produce a header which does not describe a proxied connection. This is
+// used for connections originated by the proxy itself, like health checks.
+func Local(version string) ([]byte, error) {
+  switch version {
+    case V1:
+      return []byte("PROXY UNKNOWN\r\n"), nil
+    case V2:
+      return append(append([]byte(nil), signature...), cmdLocal, famUnspec, 0, 0), nil
+    default:
+      return nil, fmt.Errorf("Unsupported PROXY protocol version: %v", version)
+  }
+}
+
+// Produce a v1 (text) header
+func headerV1(src, dst *net.TCPAddr) []byte {
+  proto, s, d := "TCP4", src.IP.To4(), dst.IP.To4()
+  if s == nil || d == nil {
+    proto, s, d = "TCP6", src.IP.To16(), dst.IP.To16()
+  }
+  return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, s, d, src.Port, dst.Port))
+}
+
+// Produce a v2 (binary) header
+func headerV2(src, dst *net.TCPAddr) []byte {
+  fam, s, d := byte(famTCP4), src.IP.To4(), dst.IP.To4()
+  if s == nil || d == nil {
+    fam, s, d = famTCP6, src.IP.To16(), dst.IP.To16()
+  }
+  b := &bytes.Buffer{}
+  b.Write(signature)
+  b.WriteByte(cmdProxy)
+  b.WriteByte(fam)
+  binary.Write(b, binary.BigEndian, uint16(len(s) + len(d) + 4))
+  b.Write(s)
+  b.Write(d)
+  binary.Write(b, binary.BigEndian, uint16(src.Port))
+  binary.Write(b, binary.BigEndian, uint16(dst.Port))
+  return b.Bytes()
+}
@@ -0,0 +1,63 @@
+package proxyproto
+
+import (
+  "net"
+  "testing"
+  
+  "perc/route"
+)
+
+import (
+  "github.com/stretchr/testify/assert"
+)
+
+func TestHeaderV1(t *testing.T) {
+  src := &net.TCPAddr{IP:net.ParseIP("10.0.0.1"), Port:51234}
+  dst := &net.TCPAddr{IP:net.ParseIP("10.0.0.2"), Port:443}
+  h, err := Header(V1, src, dst)
+  if assert.Nil(t, err) {
+    assert.Equal(t, "PROXY TCP4 10.0.0.1 10.0.0.2 51234 443\r\n", string(h))
+  }
+  
+  src = &net.TCPAddr{IP:net.ParseIP("fe80::1"), Port:51234}
+  dst = &net.TCPAddr{IP:net.ParseIP("fe80::2"), Port:443}
+  h, err = Header(V1, src, dst)
+  if assert.Nil(t, err) {
+    assert.Equal(t, "PROXY TCP6 fe80::1 fe80::2 51234 443\r\n", string(h))
+  }
+  
+  h, err = Header(V1, &net.UnixAddr{Name:"/tmp/a", Net:"unix"}, dst)
+  if assert.Nil(t, err) {
+    assert.Equal(t, "PROXY UNKNOWN\r\n", string(h))
+  }
+}
+
+func TestHeaderV2(t *testing.T) {
+  src := &net.TCPAddr{IP:net.ParseIP("10.0.0.1"), Port:0x1234}
+  dst := &net.TCPAddr{IP:net.ParseIP("10.0.0.2"), Port:443}
+  h, err := Header(V2, src, dst)
+  if assert.Nil(t, err) {
+    e := append([]byte(nil), signature...)
+    e = append(e, 0x21, 0x11, 0, 12, 10, 0, 0, 1, 10, 0, 0, 2, 0x12, 0x34, 0x01, 0xbb)
+    assert.Equal(t, e, h)
+  }
+  
+  src = &net.TCPAddr{IP:net.ParseIP("fe80::1"), Port:1}
+  dst = &net.TCPAddr{IP:net.ParseIP("fe80::2"), Port:2}
+  h, err = Header(V2, src, dst)
+  if assert.Nil(t, err) {
+    assert.Equal(t, 16 + 36, len(h))
+    assert.Equal(t, byte(0x21), h[13])
+  }
+  
+  h, err = Local(V2)
+  if assert.Nil(t, err) {
+    assert.Equal(t, append(append([]byte(nil), signature...), 0x20, 0x00, 0, 0), h)
+  }
+}
+
+func TestValidate(t *testing.T) {
+  assert.Nil(t, Validate(route.Backend{Addr:"a:1"}))
+  assert.Nil(t, Validate(route.Backend{Addr:"a:1", Params:map[string]string{ParamProxyProtocol: V2}}))
+  assert.NotNil(t, Validate(route.Backend{Addr:"a:1", Params:map[string]string{ParamProxyProtocol: "v3"}}))
+}
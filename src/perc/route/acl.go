@@ -0,0 +1,104 @@
+package route
+
+import (
+  "fmt"
+  "net"
+  "strings"
+)
+
+// Listener params which control which clients may connect to a route
+const (
+  ParamAllow  = "allow"   // comma-separated CIDRs or addresses which may connect; unset allows every client not denied
+  ParamDeny   = "deny"    // comma-separated CIDRs or addresses which may not connect
+  ParamACLLog = "acl_log" // log denied clients when 'true'
+)
+
+// An access control list for the clients of a route. A client is denied if
+// its address is in a denied range, or if allowed ranges are provided and its
+// address is not in any of them.
+type ACL struct {
+  allow []*net.IPNet
+  deny  []*net.IPNet
+  Log   bool
+}
+
+// Obtain the access control list for this route. If the route does not
+// restrict its clients, nil is returned.
+func (r *Route) ACL() (*ACL, error) {
+  a, d := r.Params[ParamAllow], r.Params[ParamDeny]
+  if a == "" && d == "" {
+    return nil, nil
+  }
+  allow, err := parseRanges(a)
+  if err != nil {
+    return nil, fmt.Errorf("Invalid allowed clients: %v", err)
+  }
+  deny, err := parseRanges(d)
+  if err != nil {
+    return nil, fmt.Errorf("Invalid denied clients: %v", err)
+  }
+  return &ACL{allow, deny, r.Params[ParamACLLog] == "true"}, nil
+}
+
+// Determine whether a client address may connect. Addresses which cannot be
+// parsed are denied.
+func (a *ACL) Permit(addr string) bool {
+  if a == nil {
+    return true
+  }
+  ip := net.ParseIP(addr)
+  if ip == nil {
+    return false
+  }
+  for _, e := range a.deny {
+    if e.Contains(ip) {
+      return false
+    }
+  }
+  if a.allow == nil {
+    return true
+  }
+  for _, e := range a.allow {
+    if e.Contains(ip) {
+      return true
+    }
+  }
+  return false
+}
+
+// Parse comma-separated CIDRs or addresses, which are single address ranges
+func parseRanges(s string) ([]*net.IPNet, error) {
+  if s == "" {
+    return nil, nil
+  }
+  var r []*net.IPNet
+  for _, e := range strings.Split(s, ",") {
+    e = strings.TrimSpace(e)
+    if ip := net.ParseIP(e); ip != nil {
+      if v := ip.To4(); v != nil {
+        ip = v
+      }
+      r = append(r, &net.IPNet{IP:ip, Mask:net.CIDRMask(len(ip) * 8, len(ip) * 8)})
+      continue
+    }
+    _, n, err := net.ParseCIDR(e)
+    if err != nil {
+      return nil, fmt.Errorf("%v", e)
+    }
+    r = append(r, n)
+  }
+  return r, nil
+}
+
+// Validate the access control params for a listener
+func validateACL(p map[string]string) error {
+  r := &Route{Params:p}
+  _, err := r.ACL()
+  if err != nil {
+    return err
+  }
+  if v, ok := p[ParamACLLog]; ok && v != "true" && v != "false" {
+    return fmt.Errorf("Invalid ACL logging: %v", v)
+  }
+  return nil
+}
@@ -0,0 +1,51 @@
+package route
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+)
+
+func TestACL(t *testing.T) {
+  r, err := Parse(`:8080(allow='10.0.0.0/8, 192.168.1.1, fd00::/8', deny='10.1.0.0/16', acl_log='true')=a:1`)
+  if assert.Nil(t, err) {
+    a, err := r.ACL()
+    if assert.Nil(t, err) {
+      assert.True(t, a.Log)
+      assert.True(t, a.Permit("10.0.0.1"))
+      assert.False(t, a.Permit("10.1.2.3"))
+      assert.True(t, a.Permit("192.168.1.1"))
+      assert.False(t, a.Permit("192.168.1.2"))
+      assert.True(t, a.Permit("fd00::1"))
+      assert.False(t, a.Permit("::1"))
+      assert.False(t, a.Permit("<unknown>"))
+    }
+  }
+  
+  r, err = Parse(`:8080(deny='127.0.0.1')=a:1`)
+  if assert.Nil(t, err) {
+    a, err := r.ACL()
+    if assert.Nil(t, err) {
+      assert.False(t, a.Log)
+      assert.False(t, a.Permit("127.0.0.1"))
+      assert.True(t, a.Permit("127.0.0.2"))
+    }
+  }
+  
+  r, err = Parse(`:8080=a:1`)
+  if assert.Nil(t, err) {
+    a, err := r.ACL()
+    assert.Nil(t, err)
+    assert.Nil(t, a)
+    assert.True(t, a.Permit("127.0.0.1"))
+  }
+  
+  for _, e := range []string{
+    `:8080(allow='10.0.0.0/33')=a:1`,
+    `:8080(deny='nowhere')=a:1`,
+    `:8080(deny='10.0.0.1', acl_log='maybe')=a:1`,
+    `unix:/var/run/perc.sock(allow='10.0.0.0/8')=a:1`,
+  }{
+    _, err := Parse(e)
+    assert.NotNil(t, err, e)
+  }
+}
@@ -0,0 +1,49 @@
+package route
+
+import (
+  "fmt"
+  "time"
+)
+
+const (
+  ParamAffinity     = "affinity"
+  ParamAffinityTTL  = "affinity_ttl"
+)
+
+// Session affinity modes
+const (
+  AffinityClientIP = "client_ip"
+)
+
+// How long a client remains bound to a backend after its last connection by default
+const DefaultAffinityTTL = time.Minute * 30
+
+// Obtain the session affinity mode and TTL for this route, which are the
+// affinity params of the backends that specify them. If affinity is not
+// enabled the mode is empty.
+func (r *Route) Affinity() (string, time.Duration) {
+  m, ok := r.Param(ParamAffinity)
+  if !ok {
+    return "", 0
+  }
+  ttl := DefaultAffinityTTL
+  if v, ok := r.Param(ParamAffinityTTL); ok {
+    if d, err := time.ParseDuration(v); err == nil && d > 0 {
+      ttl = d
+    }
+  }
+  return m, ttl
+}
+
+// Validate the affinity params for a backend
+func validateAffinity(b Backend) error {
+  if v, ok := b.Params[ParamAffinity]; ok && v != AffinityClientIP {
+    return fmt.Errorf("Unsupported session affinity: %v", v)
+  }
+  if v, ok := b.Params[ParamAffinityTTL]; ok {
+    if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+      return fmt.Errorf("Invalid session affinity TTL: %v", v)
+    }
+  }
+  return nil
+}
@@ -0,0 +1,296 @@
+package route
+
+import (
+  "fmt"
+  "sort"
+  "sync"
+  "strconv"
+  "math"
+  "hash/fnv"
+  "math/rand"
+  "sync/atomic"
+)
+
+const (
+  ParamBalancer = "lb"
+  ParamWeight   = "weight"
+  ParamPriority = "priority"
+)
+
+// Load balancing strategies. Every strategy honors backend weights.
+const (
+  RoundRobin          = "round_robin"
+  LeastConn           = "least_conn"
+  WeightedRoundRobin  = "weighted" // equivalent to round-robin, which is weighted
+  PowerOfTwo          = "p2c"
+  Hash                = "hash"
+)
+
+// A balancer decides the order in which the candidate backends for a
+// connection are attempted. Candidates are static backends or, for service
+// routes, discovered providers; their addresses identify them. Traffic is
+// split between candidates in proportion to their weight.
+type Balancer interface {
+  // Order the candidates for a connection from the client identified by key,
+  // producing a permutation of their indexes. The first candidate is the one
+  // selected and the rest are attempted in order if it cannot be connected to.
+  Order(c []Backend, key string) []int
+  // Record that a connection to a backend address has been opened
+  Acquire(addr string)
+  // Record that a connection to a backend address has been closed
+  Release(addr string)
+}
+
+// Create a balancer for a strategy. The empty strategy is round-robin.
+func NewBalancer(s string) (Balancer, error) {
+  switch s {
+    case "", RoundRobin, WeightedRoundRobin:
+      return &roundRobin{counter:newCounter(), current:make(map[string]int64)}, nil
+    case LeastConn:
+      return &leastConn{counter:newCounter()}, nil
+    case PowerOfTwo:
+      return &powerOfTwo{counter:newCounter()}, nil
+    case Hash:
+      return &hashed{counter:newCounter()}, nil
+    default:
+      return nil, fmt.Errorf("Unsupported load balancing strategy: %v", s)
+  }
+}
+
+// Obtain the weight of a backend. Backends have a weight of 1 by default.
+func (b Backend) Weight() int64 {
+  if v, ok := b.Params[ParamWeight]; ok {
+    if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+      return n
+    }
+  }
+  return 1
+}
+
+// Obtain the priority of a backend. Lower values are higher priorities and
+// backends have the highest priority, 0, by default. Lower priority backends
+// only receive traffic when no higher priority backend is available.
+func (b Backend) Priority() int {
+  if v, ok := b.Params[ParamPriority]; ok {
+    if n, err := strconv.Atoi(v); err == nil && n > 0 {
+      return n
+    }
+  }
+  return 0
+}
+
+// Validate the balancing params for a backend
+func validateBalancing(b Backend) error {
+  if v, ok := b.Params[ParamWeight]; ok {
+    if n, err := strconv.ParseInt(v, 10, 64); err != nil || n < 1 {
+      return fmt.Errorf("Invalid weight: %v", v)
+    }
+  }
+  if v, ok := b.Params[ParamPriority]; ok {
+    if n, err := strconv.Atoi(v); err != nil || n < 0 {
+      return fmt.Errorf("Invalid priority: %v", v)
+    }
+  }
+  return nil
+}
+
+// Group candidates into priority tiers, highest priority first. Each tier
+// contains the indexes of its candidates in their original order.
+func Tiers(c []Backend) [][]int {
+  p := make(map[int][]int)
+  var levels []int
+  for i, e := range c {
+    v := e.Priority()
+    if _, ok := p[v]; !ok {
+      levels = append(levels, v)
+    }
+    p[v] = append(p[v], i)
+  }
+  sort.Ints(levels)
+  t := make([][]int, len(levels))
+  for i, e := range levels {
+    t[i] = p[e]
+  }
+  return t
+}
+
+// Determine whether every candidate has the same weight
+func uniform(c []Backend) bool {
+  for i := 1; i < len(c); i++ {
+    if c[i].Weight() != c[0].Weight() {
+      return false
+    }
+  }
+  return true
+}
+
+// Counts open connections by backend address
+type counter struct {
+  sync.Mutex
+  open map[string]int64
+}
+
+// Create a counter
+func newCounter() counter {
+  return counter{sync.Mutex{}, make(map[string]int64)}
+}
+
+// Record an opened connection
+func (c *counter) Acquire(addr string) {
+  c.Lock()
+  defer c.Unlock()
+  c.open[addr]++
+}
+
+// Record a closed connection
+func (c *counter) Release(addr string) {
+  c.Lock()
+  defer c.Unlock()
+  if n := c.open[addr] - 1; n > 0 {
+    c.open[addr] = n
+  }else{
+    delete(c.open, addr)
+  }
+}
+
+// Obtain the number of open connections for each candidate
+func (c *counter) loads(b []Backend) []int64 {
+  c.Lock()
+  defer c.Unlock()
+  l := make([]int64, len(b))
+  for i, e := range b {
+    l[i] = c.open[e.Addr]
+  }
+  return l
+}
+
+// Produce the identity permutation rotated to begin at an offset
+func rotation(n int, offset int64) []int {
+  if n < 1 {
+    return nil
+  }
+  x := int(offset % int64(n))
+  if x < 0 {
+    x = -x
+  }
+  p := make([]int, n)
+  for i := range p {
+    p[i] = (x + i) % n
+  }
+  return p
+}
+
+// Round-robin balancing rotates through candidates in order. When candidates
+// have different weights they are selected in proportion to their weight,
+// interleaved smoothly rather than in bursts.
+type roundRobin struct {
+  counter
+  index   int64
+  current map[string]int64
+}
+
+func (r *roundRobin) Order(c []Backend, key string) []int {
+  if uniform(c) {
+    return rotation(len(c), atomic.AddInt64(&r.index, 1))
+  }
+  
+  r.Lock()
+  defer r.Unlock()
+  
+  var total int64
+  cur := make([]int64, len(c))
+  for i, e := range c {
+    w := e.Weight()
+    total += w
+    cur[i] = r.current[e.Addr] + w
+  }
+  
+  p := make([]int, len(c))
+  for i := range p {
+    p[i] = i
+  }
+  sort.SliceStable(p, func(i, j int) bool {
+    return cur[p[i]] > cur[p[j]]
+  })
+  
+  cur[p[0]] -= total
+  current := make(map[string]int64, len(c))
+  for i, e := range c {
+    current[e.Addr] = cur[i]
+  }
+  r.current = current // forget candidates which are no longer present
+  
+  return p
+}
+
+// Least-connections balancing prefers the candidates with the fewest open
+// connections relative to their weight. Ties are broken in round-robin order.
+type leastConn struct {
+  counter
+  index int64
+}
+
+func (r *leastConn) Order(c []Backend, key string) []int {
+  l := r.loads(c)
+  p := rotation(len(c), atomic.AddInt64(&r.index, 1))
+  sort.SliceStable(p, func(i, j int) bool {
+    return l[p[i]] * c[p[j]].Weight() < l[p[j]] * c[p[i]].Weight()
+  })
+  return p
+}
+
+// Power-of-two-choices balancing selects the less loaded, relative to its
+// weight, of two random candidates. The remaining candidates are attempted in
+// random order.
+type powerOfTwo struct {
+  counter
+}
+
+func (r *powerOfTwo) Order(c []Backend, key string) []int {
+  p := rand.Perm(len(c))
+  if len(p) > 1 {
+    l := r.loads([]Backend{c[p[0]], c[p[1]]})
+    if l[1] * c[p[0]].Weight() < l[0] * c[p[1]].Weight() {
+      p[0], p[1] = p[1], p[0]
+    }
+  }
+  return p
+}
+
+// Hash balancing consistently maps a client to the same candidate using
+// weighted rendezvous hashing, so when a candidate is added or removed only
+// the clients mapped to it move. Subsequent candidates are also consistent.
+type hashed struct {
+  counter
+}
+
+func (r *hashed) Order(c []Backend, key string) []int {
+  s := make([]float64, len(c))
+  for i, e := range c {
+    h := fnv.New64a()
+    h.Write([]byte(key))
+    h.Write([]byte{0})
+    h.Write([]byte(e.Addr))
+    u := (float64(mix(h.Sum64()) >> 11) + 0.5) / (1 << 53) // uniform in (0, 1)
+    s[i] = -float64(e.Weight()) / math.Log(u)
+  }
+  p := make([]int, len(c))
+  for i := range p {
+    p[i] = i
+  }
+  sort.SliceStable(p, func(i, j int) bool {
+    return s[p[i]] > s[p[j]]
+  })
+  return p
+}
+
+// Mix the bits of a hash so its high bits are as well distributed as its low
+// bits, which is not the case for FNV
+func mix(h uint64) uint64 {
+  h ^= h >> 30
+  h *= 0xbf58476d1ce4e5b9
+  h ^= h >> 27
+  h *= 0x94d049bb133111eb
+  h ^= h >> 31
+  return h
+}
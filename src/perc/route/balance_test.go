@@ -0,0 +1,152 @@
+package route
+
+import (
+  "fmt"
+  "time"
+  "testing"
+  "github.com/stretchr/testify/assert"
+)
+
+func backends(addrs ...string) []Backend {
+  b := make([]Backend, len(addrs))
+  for i, e := range addrs {
+    b[i] = Backend{Addr:e}
+  }
+  return b
+}
+
+func TestRoundRobin(t *testing.T) {
+  b, _ := NewBalancer(RoundRobin)
+  c := backends("a:1", "b:1", "c:1")
+  assert.Equal(t, []int{1, 2, 0}, b.Order(c, ""))
+  assert.Equal(t, []int{2, 0, 1}, b.Order(c, ""))
+  assert.Equal(t, []int{0, 1, 2}, b.Order(c, ""))
+}
+
+func TestLeastConn(t *testing.T) {
+  b, _ := NewBalancer(LeastConn)
+  c := backends("a:1", "b:1", "c:1")
+  b.Acquire("a:1")
+  b.Acquire("a:1")
+  b.Acquire("c:1")
+  assert.Equal(t, 1, b.Order(c, "")[0])
+  b.Acquire("b:1")
+  b.Acquire("b:1")
+  assert.Equal(t, 2, b.Order(c, "")[0])
+  b.Release("a:1")
+  b.Release("a:1")
+  assert.Equal(t, 0, b.Order(c, "")[0])
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+  b, _ := NewBalancer(WeightedRoundRobin)
+  c := []Backend{{Addr:"a:1", Params:map[string]string{"weight": "3"}}, {Addr:"b:1"}}
+  n := make(map[int]int)
+  for i := 0; i < 8; i++ {
+    n[b.Order(c, "")[0]]++
+  }
+  assert.Equal(t, map[int]int{0: 6, 1: 2}, n)
+}
+
+func TestWeightedLeastConn(t *testing.T) {
+  b, _ := NewBalancer(LeastConn)
+  c := []Backend{{Addr:"a:1", Params:map[string]string{"weight": "3"}}, {Addr:"b:1"}}
+  b.Acquire("a:1")
+  b.Acquire("a:1")
+  b.Acquire("b:1")
+  assert.Equal(t, 0, b.Order(c, "")[0]) // 2/3 < 1/1
+  b.Acquire("a:1")
+  b.Acquire("a:1")
+  assert.Equal(t, 1, b.Order(c, "")[0]) // 4/3 > 1/1
+}
+
+func TestWeightedHash(t *testing.T) {
+  b, _ := NewBalancer(Hash)
+  c := []Backend{{Addr:"a:1", Params:map[string]string{"weight": "4"}}, {Addr:"b:1"}}
+  n := make(map[int]int)
+  for i := 0; i < 1000; i++ {
+    n[b.Order(c, fmt.Sprintf("10.0.%d.%d", i / 256, i % 256))[0]]++
+  }
+  assert.InDelta(t, 800, n[0], 60)
+  assert.InDelta(t, 200, n[1], 60)
+}
+
+func TestTiers(t *testing.T) {
+  c := []Backend{
+    {Addr:"a:1", Params:map[string]string{"priority": "1"}},
+    {Addr:"b:1"},
+    {Addr:"c:1", Params:map[string]string{"priority": "2"}},
+    {Addr:"d:1", Params:map[string]string{"priority": "1"}},
+    {Addr:"e:1", Params:map[string]string{"priority": "0"}},
+  }
+  assert.Equal(t, [][]int{{1, 4}, {0, 3}, {2}}, Tiers(c))
+  assert.Equal(t, 0, len(Tiers(nil)))
+}
+
+func TestPowerOfTwo(t *testing.T) {
+  b, _ := NewBalancer(PowerOfTwo)
+  c := backends("a:1", "b:1")
+  b.Acquire("a:1")
+  for i := 0; i < 10; i++ {
+    o := b.Order(c, "")
+    assert.Equal(t, 1, o[0])
+    assert.Equal(t, 2, len(o))
+  }
+}
+
+func TestHash(t *testing.T) {
+  b, _ := NewBalancer(Hash)
+  c := backends("a:1", "b:1", "c:1", "d:1")
+  for _, k := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"} {
+    o := b.Order(c, k)
+    assert.Equal(t, o, b.Order(c, k))
+    // removing a backend the client is not mapped to does not move it
+    var r []Backend
+    for i, e := range c {
+      if i != o[3] {
+        r = append(r, e)
+      }
+    }
+    assert.Equal(t, c[o[0]].Addr, r[b.Order(r, k)[0]].Addr)
+  }
+}
+
+func TestRouteBalancer(t *testing.T) {
+  r, err := Parse(`:9000=a:1(lb='least_conn'),b:1`)
+  if assert.Nil(t, err) {
+    assert.Equal(t, LeastConn, r.Strategy())
+    _, ok := r.Balancer().(*leastConn)
+    assert.True(t, ok)
+  }
+  _, err = Parse(`:9000=a:1(lb='least_conn'),b:1(lb='hash')`)
+  assert.NotNil(t, err)
+  _, err = Parse(`:9000=a:1(lb='fastest')`)
+  assert.NotNil(t, err)
+  _, err = Parse(`:9000=a:1(weight='none')`)
+  assert.NotNil(t, err)
+}
+
+func TestRouteAffinity(t *testing.T) {
+  r, err := Parse(`:9000=a:1(affinity='client_ip', affinity_ttl='5m'),b:1`)
+  if assert.Nil(t, err) {
+    m, ttl := r.Affinity()
+    assert.Equal(t, AffinityClientIP, m)
+    assert.Equal(t, time.Minute * 5, ttl)
+  }
+  r, err = Parse(`:9000=a:1,b:1(affinity='client_ip')`)
+  if assert.Nil(t, err) {
+    _, ttl := r.Affinity()
+    assert.Equal(t, DefaultAffinityTTL, ttl)
+  }
+  r, err = Parse(`:9000=a:1,b:1`)
+  if assert.Nil(t, err) {
+    m, _ := r.Affinity()
+    assert.Equal(t, "", m)
+  }
+  _, err = Parse(`:9000=a:1(affinity='cookie')`)
+  assert.NotNil(t, err)
+  _, err = Parse(`:9000=a:1(affinity='client_ip', affinity_ttl='forever')`)
+  assert.NotNil(t, err)
+  _, err = Parse(`:9000=a:1(affinity_ttl='1m'),b:1(affinity_ttl='2m')`)
+  assert.NotNil(t, err)
+}
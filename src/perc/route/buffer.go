@@ -0,0 +1,36 @@
+package route
+
+import (
+  "fmt"
+  "strconv"
+)
+
+// The listener param which sizes the buffers a route's connections are copied
+// through, in bytes. Routes which carry small messages can use less memory per
+// connection and routes which carry bulk data can make fewer reads.
+const ParamBufferSize = "buffer_size"
+
+// Buffer sizes
+const (
+  DefaultBufferSize = 32 * 1024
+  MinBufferSize     = 1024
+  MaxBufferSize     = 1024 * 1024
+)
+
+// Obtain the size of the buffers this route's connections are copied through
+func (r *Route) BufferSize() int {
+  if n, err := strconv.Atoi(r.Params[ParamBufferSize]); err == nil && n > 0 {
+    return n
+  }
+  return DefaultBufferSize
+}
+
+// Validate the buffer size param for a listener
+func validateBufferSize(p map[string]string) error {
+  if v, ok := p[ParamBufferSize]; ok {
+    if n, err := strconv.Atoi(v); err != nil || n < MinBufferSize || n > MaxBufferSize {
+      return fmt.Errorf("Invalid buffer size: %v (must be %d to %d bytes)", v, MinBufferSize, MaxBufferSize)
+    }
+  }
+  return nil
+}
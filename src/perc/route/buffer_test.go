@@ -0,0 +1,27 @@
+package route
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+)
+
+func TestBufferSize(t *testing.T) {
+  r, err := Parse(`:8080(buffer_size='4096')=a:1`)
+  if assert.Nil(t, err) {
+    assert.Equal(t, 4096, r.BufferSize())
+  }
+  
+  r, err = Parse(`:8080=a:1`)
+  if assert.Nil(t, err) {
+    assert.Equal(t, DefaultBufferSize, r.BufferSize())
+  }
+  
+  for _, e := range []string{
+    `:8080(buffer_size='512')=a:1`,
+    `:8080(buffer_size='4m')=a:1`,
+    `:8080(buffer_size='2097152')=a:1`,
+  }{
+    _, err := Parse(e)
+    assert.NotNil(t, err, e)
+  }
+}
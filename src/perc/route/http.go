@@ -0,0 +1,103 @@
+package route
+
+import (
+  "fmt"
+  "strings"
+)
+
+// Listener params which configure how connections are routed
+const (
+  ParamMode = "mode" // how connections are proxied: tcp, the default, http, or grpc
+  ParamHost = "host" // for http and grpc routes, the host name pattern requests must match
+  ParamPath = "path" // for http and grpc routes, the path prefix requests must match
+)
+
+// Route modes. TCP routes proxy connections as streams of bytes; HTTP routes
+// proxy HTTP/1.x requests; gRPC routes terminate HTTP/2, with or without TLS,
+// and proxy each stream independently so the calls a client makes over one
+// connection are balanced across backends.
+const (
+  ModeTCP   = "tcp"
+  ModeHTTP  = "http"
+  ModeGRPC  = "grpc"
+)
+
+// Obtain the mode of this route
+func (r *Route) Mode() string {
+  if v, ok := r.Params[ParamMode]; ok {
+    return v
+  }
+  return ModeTCP
+}
+
+// Determine whether this route is selected and proxied per request rather
+// than per connection
+func (r *Route) PerRequest() bool {
+  m := r.Mode()
+  return m == ModeHTTP || m == ModeGRPC
+}
+
+// Obtain the host name pattern requests to this HTTP route must match. Host
+// patterns are the same as server name patterns. If the route matches any
+// host, the pattern is empty.
+func (r *Route) Host() string {
+  return strings.ToLower(r.Params[ParamHost])
+}
+
+// Obtain the path prefix requests to this HTTP route must match
+func (r *Route) Path() string {
+  if v, ok := r.Params[ParamPath]; ok {
+    return v
+  }
+  return "/"
+}
+
+// Determine how well a request matches this HTTP route. Zero is no match;
+// higher values are more specific matches. Requests are matched by host first
+// and by the longest path prefix second. A path prefix matches whole path
+// segments, so '/api' matches '/api' and '/api/v1' but not '/apis'.
+func (r *Route) MatchRequest(host, path string) int {
+  var h int
+  if p := r.Host(); p == "" {
+    h = 1
+  }else if h = matchName(p, host); h == 0 {
+    return 0
+  }
+  
+  p := r.Path()
+  if !strings.HasPrefix(path, p) {
+    return 0
+  }
+  if !strings.HasSuffix(p, "/") && len(path) > len(p) && path[len(p)] != '/' {
+    return 0
+  }
+  return h << 16 + len(p) + 1
+}
+
+// Validate the routing mode params
+func validateMode(p map[string]string) error {
+  switch v := p[ParamMode]; v {
+    case "", ModeTCP:
+      for _, e := range []string{ParamHost, ParamPath} {
+        if _, ok := p[e]; ok {
+          return fmt.Errorf("The %v param requires the http or grpc mode", e)
+        }
+      }
+      return nil
+    case ModeHTTP, ModeGRPC:
+      if _, ok := p[ParamSNI]; ok {
+        return fmt.Errorf("Routes cannot be selected by both server name and HTTP request")
+      }
+      if v, ok := p[ParamHost]; ok {
+        if err := validateName(v); err != nil {
+          return err
+        }
+      }
+      if v, ok := p[ParamPath]; ok && (v == "" || v[0] != '/') {
+        return fmt.Errorf("Invalid path prefix: %v", v)
+      }
+      return nil
+    default:
+      return fmt.Errorf("Unsupported route mode: %v", v)
+  }
+}
@@ -0,0 +1,50 @@
+package route
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+)
+
+func TestMatchRequest(t *testing.T) {
+  api, _ := Parse(`:80(mode='http', host='API.example.com')=a:1`)
+  v1, _ := Parse(`:80(mode='http', host='api.example.com', path='/v1')=b:1`)
+  wild, _ := Parse(`:80(mode='http', host='*.example.com')=c:1`)
+  static, _ := Parse(`:80(mode='http', path='/static/')=d:1`)
+  any, _ := Parse(`:80(mode='http')=e:1`)
+  
+  assert.Equal(t, ModeHTTP, api.Mode())
+  assert.Equal(t, ":80(api.example.com/)", api.Key())
+  assert.Equal(t, ":80(api.example.com/v1)", v1.Key())
+  assert.Equal(t, ":80(*/static/)", static.Key())
+  assert.Equal(t, ":80", any.Key())
+  
+  assert.True(t, v1.MatchRequest("api.example.com", "/v1/users") > api.MatchRequest("api.example.com", "/v1/users"))
+  assert.True(t, v1.MatchRequest("api.example.com", "/v1") > 0)
+  assert.Equal(t, 0, v1.MatchRequest("api.example.com", "/v10"))
+  assert.True(t, api.MatchRequest("api.example.com", "/v10") > wild.MatchRequest("api.example.com", "/v10"))
+  assert.True(t, wild.MatchRequest("web.example.com", "/") > static.MatchRequest("web.example.com", "/static/app.js"))
+  assert.True(t, static.MatchRequest("other.com", "/static/app.js") > any.MatchRequest("other.com", "/static/app.js"))
+  assert.Equal(t, 0, static.MatchRequest("other.com", "/static"))
+  assert.Equal(t, 0, api.MatchRequest("web.example.com", "/"))
+  assert.True(t, any.MatchRequest("", "/") > 0)
+  
+  grpc, err := Parse(`:80(mode='grpc', path='/pkg.Service/')=f:1,g:1`)
+  if assert.Nil(t, err) {
+    assert.True(t, grpc.PerRequest())
+    assert.Equal(t, ":80(*/pkg.Service/)", grpc.Key())
+    assert.True(t, grpc.MatchRequest("any", "/pkg.Service/Method") > 0)
+    assert.Equal(t, 0, grpc.MatchRequest("any", "/pkg.Other/Method"))
+  }
+  
+  for _, e := range []string{
+    `:80(mode='udp')=a:1`,
+    `:80(mode='grpc', sni='example.com')=a:1`,
+    `:80(host='example.com')=a:1`,
+    `:80(mode='http', path='v1')=a:1`,
+    `:80(mode='http', host='*.*.example.com')=a:1`,
+    `:80(mode='http', sni='example.com')=a:1`,
+  }{
+    _, err := Parse(e)
+    assert.NotNil(t, err, e)
+  }
+}
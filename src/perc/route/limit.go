@@ -0,0 +1,71 @@
+package route
+
+import (
+  "fmt"
+  "time"
+  "strconv"
+)
+
+// The param which limits concurrent connections. On a listener it is the most
+// connections a route handles at once, or for routes proxied per request or
+// per datagram flow, the most requests, streams, or flows. On a backend it is
+// the most connections to each of its addresses at once; addresses at their
+// limit are passed over.
+const ParamMaxConns = "max_conns"
+
+// The listener param which configures how long a connection waits for the
+// route to fall below its limit before it is rejected. Zero rejects
+// connections immediately. If it is not set the service's queue timeout is
+// used.
+const ParamQueueTimeout = "queue_timeout"
+
+// Obtain the most connections this route handles at once, or zero if there
+// is no limit
+func (r *Route) MaxConns() int {
+  return maxConns(r.Params)
+}
+
+// Obtain how long a connection waits for this route to fall below its limit,
+// if it is configured
+func (r *Route) QueueTimeout() (time.Duration, bool) {
+  v, ok := r.Params[ParamQueueTimeout]
+  if !ok {
+    return 0, false
+  }
+  d, _ := time.ParseDuration(v)
+  return d, true
+}
+
+// Obtain the most connections to each address of this backend at once, or
+// zero if there is no limit
+func (b Backend) MaxConns() int {
+  return maxConns(b.Params)
+}
+
+// Parse the connection limit from params
+func maxConns(p map[string]string) int {
+  n, _ := strconv.Atoi(p[ParamMaxConns])
+  return n
+}
+
+// Validate the connection limit params for a listener and its backends
+func validateLimits(p map[string]string, backends []Backend) error {
+  if v, ok := p[ParamMaxConns]; ok {
+    if n, err := strconv.Atoi(v); err != nil || n < 1 {
+      return fmt.Errorf("Invalid connection limit: %v", v)
+    }
+  }
+  if v, ok := p[ParamQueueTimeout]; ok {
+    if d, err := time.ParseDuration(v); err != nil || d < 0 {
+      return fmt.Errorf("Invalid queue timeout: %v", v)
+    }
+  }
+  for _, b := range backends {
+    if v, ok := b.Params[ParamMaxConns]; ok {
+      if n, err := strconv.Atoi(v); err != nil || n < 1 {
+        return fmt.Errorf("Invalid connection limit for backend: %v: %v", b.Addr, v)
+      }
+    }
+  }
+  return nil
+}
@@ -0,0 +1,70 @@
+package route
+
+import (
+  "time"
+  "testing"
+  "github.com/stretchr/testify/assert"
+)
+
+func TestLimits(t *testing.T) {
+  r, err := Parse(`:8080(max_conns='100', queue_timeout='2s')=a:1(max_conns='10'),b:1`)
+  if assert.Nil(t, err) {
+    assert.Equal(t, 100, r.MaxConns())
+    d, ok := r.QueueTimeout()
+    assert.True(t, ok)
+    assert.Equal(t, time.Second * 2, d)
+    assert.Equal(t, 10, r.Backends[0].MaxConns())
+    assert.Equal(t, 0, r.Backends[1].MaxConns())
+  }
+  
+  r, err = Parse(`:8080=a:1`)
+  if assert.Nil(t, err) {
+    assert.Equal(t, 0, r.MaxConns())
+    _, ok := r.QueueTimeout()
+    assert.False(t, ok)
+  }
+  
+  for _, e := range []string{
+    `:8080(max_conns='0')=a:1`,
+    `:8080(max_conns='lots')=a:1`,
+    `:8080(queue_timeout='-1s')=a:1`,
+    `:8080=a:1(max_conns='-1')`,
+  }{
+    _, err := Parse(e)
+    assert.NotNil(t, err, e)
+  }
+}
+
+func TestRateLimit(t *testing.T) {
+  r, err := Parse(`:8080(rate='0.5', rate_burst='2', rate_delay='1s')=a:1`)
+  if assert.Nil(t, err) {
+    l, ok := r.RateLimit()
+    assert.True(t, ok)
+    assert.Equal(t, RateLimit{0.5, 2, time.Second}, l)
+  }
+  
+  r, err = Parse(`:8080(rate='2.5')=a:1`)
+  if assert.Nil(t, err) {
+    l, ok := r.RateLimit()
+    assert.True(t, ok)
+    assert.Equal(t, RateLimit{2.5, 3, 0}, l)
+  }
+  
+  r, err = Parse(`:8080=a:1`)
+  if assert.Nil(t, err) {
+    _, ok := r.RateLimit()
+    assert.False(t, ok)
+  }
+  
+  for _, e := range []string{
+    `:8080(rate='0')=a:1`,
+    `:8080(rate='fast')=a:1`,
+    `:8080(rate_burst='2')=a:1`,
+    `:8080(rate='1', rate_burst='0')=a:1`,
+    `:8080(rate='1', rate_delay='-1s')=a:1`,
+    `udp::8125(rate='1', rate_delay='1s')=a:1`,
+  }{
+    _, err := Parse(e)
+    assert.NotNil(t, err, e)
+  }
+}
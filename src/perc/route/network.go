@@ -0,0 +1,132 @@
+package route
+
+import (
+  "fmt"
+  "net"
+  "time"
+  "strconv"
+  "strings"
+)
+
+// Networks a route may listen on. A listen address may be prefixed by its
+// network, like 'udp::8125' or 'unix:/var/run/app.sock'; routes listen on TCP
+// by default. Backends are connected to over the network their route listens
+// on, except that backends of stream routes may be Unix sockets, like
+// 'unix:/var/run/backend.sock'.
+const (
+  NetworkTCP  = "tcp"
+  NetworkUDP  = "udp"
+  NetworkUnix = "unix"
+)
+
+// Listener params which configure the socket file created for a Unix route
+const (
+  ParamSocketMode   = "socket_mode"   // the permissions of the socket file, in octal, like '0660'
+  ParamSocketOwner  = "socket_owner"  // the user which owns the socket file, by name or id
+  ParamSocketGroup  = "socket_group"  // the group which owns the socket file, by name or id
+)
+
+// The listener param which configures how long a UDP flow, the datagrams
+// exchanged between one client and the backend it was assigned, may be idle
+// before it is expired
+const ParamFlowTimeout = "flow_timeout"
+
+// How long a UDP flow may be idle by default
+const DefaultFlowTimeout = time.Minute
+
+// Obtain the network this route listens on
+func (r *Route) Network() string {
+  n, _ := SplitNetwork(r.Listen)
+  return n
+}
+
+// Obtain the address this route listens on, without its network
+func (r *Route) Addr() string {
+  _, a := SplitNetwork(r.Listen)
+  return a
+}
+
+// Obtain how long a UDP flow for this route may be idle
+func (r *Route) FlowTimeout() time.Duration {
+  if v, ok := r.Params[ParamFlowTimeout]; ok {
+    if d, err := time.ParseDuration(v); err == nil {
+      return d
+    }
+  }
+  return DefaultFlowTimeout
+}
+
+// Split a listen or backend address into its network and address. A prefix is
+// only a network if what follows it is an address, so a host named 'udp' is
+// not mistaken for one.
+func SplitNetwork(a string) (string, string) {
+  if v := strings.TrimPrefix(a, NetworkUDP +":"); v != a {
+    if _, _, err := net.SplitHostPort(v); err == nil {
+      return NetworkUDP, v
+    }
+  }
+  if v := strings.TrimPrefix(a, NetworkUnix +":"); v != a && v != "" && (v[0] == '/' || v[0] == '.' || v[0] == '@') {
+    return NetworkUnix, v
+  }
+  return NetworkTCP, a
+}
+
+// Validate the params for the network a route listens on and the addresses of
+// its backends
+func validateNetwork(n string, p map[string]string, backends []Backend) error {
+  for _, b := range backends {
+    switch x, _ := SplitNetwork(b.Addr); x {
+      case NetworkUDP:
+        return fmt.Errorf("Backends are connected to over the network their route listens on: %v", b.Addr)
+      case NetworkUnix:
+        if n == NetworkUDP {
+          return fmt.Errorf("Backends of %v routes cannot be %v sockets: %v", NetworkUDP, NetworkUnix, b.Addr)
+        }
+    }
+  }
+  
+  if n != NetworkUnix {
+    for _, e := range []string{ParamSocketMode, ParamSocketOwner, ParamSocketGroup} {
+      if _, ok := p[e]; ok {
+        return fmt.Errorf("The %v param requires a %v route", e, NetworkUnix)
+      }
+    }
+  }else{
+    if v, ok := p[ParamSocketMode]; ok {
+      if m, err := strconv.ParseUint(v, 8, 32); err != nil || m > 0777 {
+        return fmt.Errorf("Invalid socket mode: %v", v)
+      }
+    }
+    // socket clients have no address; access is controlled by the socket's
+    // mode, and a per-client rate limit would be shared by every client
+    for _, e := range []string{ParamAllow, ParamDeny, ParamRate, ParamRateBurst, ParamRateDelay} {
+      if _, ok := p[e]; ok {
+        return fmt.Errorf("The %v param is not supported for %v routes", e, NetworkUnix)
+      }
+    }
+  }
+  
+  v, ok := p[ParamFlowTimeout]
+  if n != NetworkUDP {
+    if ok {
+      return fmt.Errorf("The %v param requires a %v route", ParamFlowTimeout, NetworkUDP)
+    }
+    return nil
+  }
+  if ok {
+    if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+      return fmt.Errorf("Invalid flow timeout: %v", v)
+    }
+  }
+  if m, ok := p[ParamMode]; ok && m != ModeTCP {
+    return fmt.Errorf("The %v mode is not supported for %v routes", m, NetworkUDP)
+  }
+  // datagrams have no server name, and flows can't be queued or delayed
+  // without holding up every other client of the route
+  for _, e := range []string{ParamSNI, ParamQueueTimeout, ParamRateDelay} {
+    if _, ok := p[e]; ok {
+      return fmt.Errorf("The %v param is not supported for %v routes", e, NetworkUDP)
+    }
+  }
+  return nil
+}
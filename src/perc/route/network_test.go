@@ -0,0 +1,56 @@
+package route
+
+import (
+  "time"
+  "testing"
+  "github.com/stretchr/testify/assert"
+)
+
+func TestNetwork(t *testing.T) {
+  r, err := Parse(`udp::8125(flow_timeout='10s')=statsd`)
+  if assert.Nil(t, err) {
+    assert.Equal(t, NetworkUDP, r.Network())
+    assert.Equal(t, ":8125", r.Addr())
+    assert.Equal(t, "udp::8125", r.Key())
+    assert.Equal(t, time.Second * 10, r.FlowTimeout())
+    assert.True(t, r.Service)
+  }
+  
+  r, err = Parse(`udp:8080=a:1`) // a host named udp
+  if assert.Nil(t, err) {
+    assert.Equal(t, NetworkTCP, r.Network())
+    assert.Equal(t, "udp:8080", r.Addr())
+  }
+  
+  r, err = Parse(`udp:[::1]:53=a:53`)
+  if assert.Nil(t, err) {
+    assert.Equal(t, NetworkUDP, r.Network())
+    assert.Equal(t, "[::1]:53", r.Addr())
+    assert.Equal(t, DefaultFlowTimeout, r.FlowTimeout())
+  }
+  
+  r, err = Parse(`unix:/var/run/perc.sock(socket_mode='0660')=unix:/var/run/app.sock,b:80`)
+  if assert.Nil(t, err) {
+    assert.Equal(t, NetworkUnix, r.Network())
+    assert.Equal(t, "/var/run/perc.sock", r.Addr())
+    assert.False(t, r.Service)
+    n, a := SplitNetwork(r.Backends[0].Addr)
+    assert.Equal(t, NetworkUnix, n)
+    assert.Equal(t, "/var/run/app.sock", a)
+  }
+  
+  for _, e := range []string{
+    `:8125(flow_timeout='10s')=a:1`,
+    `:80(socket_mode='0660')=a:1`,
+    `unix:/var/run/perc.sock(socket_mode='0999')=a:1`,
+    `unix:/var/run/perc.sock(rate='10')=a:1`,
+    `udp::53=unix:/var/run/dns.sock`,
+    `:53=udp:a:53`,
+    `udp::8125(flow_timeout='soon')=a:1`,
+    `udp::8125(mode='http')=a:1`,
+    `udp::8125(sni='example.com')=a:1`,
+  }{
+    _, err := Parse(e)
+    assert.NotNil(t, err, e)
+  }
+}
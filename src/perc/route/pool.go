@@ -0,0 +1,85 @@
+package route
+
+import (
+  "fmt"
+  "time"
+  "strconv"
+)
+
+// Backend params which configure a pool of idle connections that are
+// established ahead of time, so clients don't wait for a backend to be dialed
+const (
+  ParamPoolMin  = "pool_min"  // the fewest idle connections kept
+  ParamPoolMax  = "pool_max"  // the most idle connections kept
+  ParamPoolIdle = "pool_idle" // how long a connection may be idle before it is replaced
+)
+
+// How long a pooled connection may be idle by default, and at least
+const (
+  DefaultPoolIdle = time.Minute
+  MinPoolIdle     = time.Second
+)
+
+// A backend connection pool configuration
+type Pool struct {
+  Min, Max  int
+  Idle      time.Duration
+}
+
+// Obtain the connection pool configuration for this backend, if it pools
+// connections. If only a minimum is provided the pool is kept at that size;
+// if only a maximum is provided the pool starts empty and grows as clients
+// need connections.
+func (b Backend) Pool() (Pool, bool) {
+  vmin, omin := b.Params[ParamPoolMin]
+  vmax, omax := b.Params[ParamPoolMax]
+  if !omin && !omax {
+    return Pool{}, false
+  }
+  p := Pool{Idle:DefaultPoolIdle}
+  p.Min, _ = strconv.Atoi(vmin)
+  if omax {
+    p.Max, _ = strconv.Atoi(vmax)
+  }else{
+    p.Max = p.Min
+  }
+  if v, ok := b.Params[ParamPoolIdle]; ok {
+    if d, err := time.ParseDuration(v); err == nil && d > 0 {
+      p.Idle = d
+    }
+  }
+  return p, true
+}
+
+// Validate the connection pool params for a backend
+func validatePool(b Backend) error {
+  vmin, omin := b.Params[ParamPoolMin]
+  vmax, omax := b.Params[ParamPoolMax]
+  if omin {
+    if n, err := strconv.Atoi(vmin); err != nil || n < 0 {
+      return fmt.Errorf("Invalid minimum pool size: %v", vmin)
+    }
+  }
+  if omax {
+    if n, err := strconv.Atoi(vmax); err != nil || n < 1 {
+      return fmt.Errorf("Invalid maximum pool size: %v", vmax)
+    }
+  }
+  if v, ok := b.Params[ParamPoolIdle]; ok {
+    if !omin && !omax {
+      return fmt.Errorf("The %v param requires a pool size: %v", ParamPoolIdle, b)
+    }
+    if d, err := time.ParseDuration(v); err != nil || d < MinPoolIdle {
+      return fmt.Errorf("Invalid pool idle timeout: %v; must be at least %v", v, MinPoolIdle)
+    }
+  }
+  if p, ok := b.Pool(); ok {
+    if p.Max < 1 {
+      return fmt.Errorf("Pool must allow at least one connection: %v", b)
+    }
+    if p.Max < p.Min {
+      return fmt.Errorf("Maximum pool size is less than the minimum: %v", b)
+    }
+  }
+  return nil
+}
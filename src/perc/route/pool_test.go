@@ -0,0 +1,39 @@
+package route
+
+import (
+  "time"
+  "testing"
+  "github.com/stretchr/testify/assert"
+)
+
+func TestPool(t *testing.T) {
+  r, err := Parse(`:8080=a:1(pool_min='2', pool_max='8', pool_idle='30s'),b:1(pool_min='4'),c:1(pool_max='3'),d:1`)
+  if assert.Nil(t, err) {
+    p, ok := r.Backends[0].Pool()
+    assert.True(t, ok)
+    assert.Equal(t, Pool{2, 8, time.Second * 30}, p)
+    p, ok = r.Backends[1].Pool()
+    assert.True(t, ok)
+    assert.Equal(t, Pool{4, 4, DefaultPoolIdle}, p)
+    p, ok = r.Backends[2].Pool()
+    assert.True(t, ok)
+    assert.Equal(t, Pool{0, 3, DefaultPoolIdle}, p)
+    _, ok = r.Backends[3].Pool()
+    assert.False(t, ok)
+  }
+  
+  for _, e := range []string{
+    `:8080=a:1(pool_min='-1')`,
+    `:8080=a:1(pool_min='0')`,
+    `:8080=a:1(pool_max='0')`,
+    `:8080=a:1(pool_min='many')`,
+    `:8080=a:1(pool_min='4', pool_max='2')`,
+    `:8080=a:1(pool_min='1', pool_idle='0s')`,
+    `:8080=a:1(pool_min='1', pool_idle='3ns')`,
+    `:8080=a:1(pool_min='1', pool_idle='500ms')`,
+    `:8080=a:1(pool_idle='1m')`,
+  }{
+    _, err := Parse(e)
+    assert.NotNil(t, err, e)
+  }
+}
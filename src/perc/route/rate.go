@@ -0,0 +1,75 @@
+package route
+
+import (
+  "fmt"
+  "math"
+  "time"
+  "strconv"
+)
+
+// Listener params which limit the rate each client may connect to a route,
+// or for routes proxied per request or per datagram flow, the rate it may
+// make requests or start flows
+const (
+  ParamRate       = "rate"        // connections per second
+  ParamRateBurst  = "rate_burst"  // connections which may be made at once
+  ParamRateDelay  = "rate_delay"  // how long an excess connection may be delayed
+)
+
+// A per-client rate limit. Each client has a bucket of Burst tokens which is
+// refilled at Rate tokens per second and a connection takes a token. When a
+// client's bucket is empty its connection is delayed until a token is
+// available if that is within Delay, otherwise it is closed.
+type RateLimit struct {
+  Rate  float64
+  Burst int
+  Delay time.Duration
+}
+
+// Create a rate limit. If the burst is less than one the rate, rounded up, is
+// used.
+func NewRateLimit(rate float64, burst int, delay time.Duration) RateLimit {
+  if burst < 1 {
+    burst = int(math.Max(1, math.Ceil(rate)))
+  }
+  return RateLimit{rate, burst, delay}
+}
+
+// Obtain the per-client rate limit for this route, if it has one
+func (r *Route) RateLimit() (RateLimit, bool) {
+  v, ok := r.Params[ParamRate]
+  if !ok {
+    return RateLimit{}, false
+  }
+  rate, _ := strconv.ParseFloat(v, 64)
+  burst, _ := strconv.Atoi(r.Params[ParamRateBurst])
+  delay, _ := time.ParseDuration(r.Params[ParamRateDelay])
+  return NewRateLimit(rate, burst, delay), true
+}
+
+// Validate the rate limit params for a listener
+func validateRate(p map[string]string) error {
+  v, ok := p[ParamRate]
+  if ok {
+    if n, err := strconv.ParseFloat(v, 64); err != nil || !(n > 0) || math.IsInf(n, 0) {
+      return fmt.Errorf("Invalid rate limit: %v", v)
+    }
+  }
+  if v, set := p[ParamRateBurst]; set {
+    if !ok {
+      return fmt.Errorf("Rate burst requires a rate limit: %v", v)
+    }
+    if n, err := strconv.Atoi(v); err != nil || n < 1 {
+      return fmt.Errorf("Invalid rate burst: %v", v)
+    }
+  }
+  if v, set := p[ParamRateDelay]; set {
+    if !ok {
+      return fmt.Errorf("Rate delay requires a rate limit: %v", v)
+    }
+    if d, err := time.ParseDuration(v); err != nil || d < 0 {
+      return fmt.Errorf("Invalid rate delay: %v", v)
+    }
+  }
+  return nil
+}
@@ -2,6 +2,7 @@ package route
 
 import (
   "fmt"
+  "sort"
   "sync"
   "sync/atomic"
   "strings"
@@ -21,6 +22,10 @@ const (
   paramDelimEsc     = '\\'
 )
 
+// Params which apply to a route as a whole rather than an individual backend.
+// Backends which specify them must agree on their values.
+var routeParams = []string{ParamBalancer, ParamAffinity, ParamAffinityTTL}
+
 // A syntax error
 type syntaxError error
 
@@ -34,9 +39,11 @@ func IsSyntaxError(e error) bool {
 type Route struct {
   sync.Mutex
   Listen    string
+  Params    map[string]string
   Backends  []Backend
   Service   bool
   index     int64
+  balancer  Balancer
 }
 
 // Parse a route
@@ -44,15 +51,29 @@ func Parse(s string) (*Route, error) {
   var err error
   p := s
   
-  n := strings.IndexRune(s, '=')
+  n := strings.IndexFunc(s, func(r rune) bool {
+    return r == '=' || r == paramDelimOpen
+  })
   if n < 0 {
-    return nil, syntaxError(fmt.Errorf("Invalid route; expected <listen>=<backend>[,...,<backendN>] in: %v", p))
+    return nil, syntaxError(fmt.Errorf("Invalid route; expected <listen>[(<params>)]=<backend>[,...,<backendN>] in: %v", p))
   }
   
   listen := strings.TrimSpace(s[:n])
-  _, s = scan.White(s[n+1:])
+  s = s[n:]
+  
+  var params map[string]string
+  if s[0] == paramDelimOpen {
+    params, s, err = parseParams(s)
+    if err != nil {
+      return nil, err
+    }
+    _, s = scan.White(s)
+    if len(s) < 1 || s[0] != '=' {
+      return nil, syntaxError(fmt.Errorf("Invalid route; expected <listen>[(<params>)]=<backend>[,...,<backendN>] in: %v", p))
+    }
+  }
+  _, s = scan.White(s[1:])
   
-  var service bool
   var backends []Backend
   for i := 0; len(s) > 0; i++ {
     var b Backend
@@ -74,25 +95,101 @@ func Parse(s string) (*Route, error) {
     }
     
     backends = append(backends, b)
-    
+    _, s = scan.White(s)
+  }
+  
+  if len(backends) < 1 {
+    return nil, syntaxError(fmt.Errorf("No backends defined in route: %v", p))
+  }
+  
+  return NewWithParams(listen, params, backends)
+}
+
+// Create a route from its listen address and backends. Backends must either
+// all be hosts, in the form 'host:port', or a single service name.
+func New(listen string, backends []Backend) (*Route, error) {
+  return NewWithParams(listen, nil, backends)
+}
+
+// Create a route from its listen address, the params which configure its
+// listener, and its backends.
+func NewWithParams(listen string, params map[string]string, backends []Backend) (*Route, error) {
+  if listen == "" {
+    return nil, syntaxError(fmt.Errorf("Listen address is empty"))
+  }
+  if len(backends) < 1 {
+    return nil, syntaxError(fmt.Errorf("No backends defined for: %v", listen))
+  }
+  
+  var service bool
+  for i, b := range backends {
+    if b.Addr == "" {
+      return nil, syntaxError(fmt.Errorf("Backend is empty"))
+    }
     v := strings.IndexRune(b.Addr, ':') < 0
     if i == 0 {
       service = v
     }else if service != v {
       return nil, syntaxError(fmt.Errorf("Cannot mix host and service backends in the same route"))
     }
-    
-    _, s = scan.White(s)
   }
   
-  if len(backends) < 1 {
-    return nil, syntaxError(fmt.Errorf("No backends defined in route: %v", p))
-  }
   if service && len(backends) > 1 {
-    return nil, fmt.Errorf("Only one service backend may be defined in a single route: %v", p)
+    return nil, fmt.Errorf("Only one service backend may be defined in a single route: %v", listen)
   }
   
-  return &Route{sync.Mutex{}, listen, backends, service, 0}, nil
+  for _, e := range routeParams {
+    var v string
+    for _, b := range backends {
+      if x, ok := b.Params[e]; ok {
+        if v != "" && x != v {
+          return nil, fmt.Errorf("Backends specify conflicting values for %v: %v, %v", e, v, x)
+        }
+        v = x
+      }
+    }
+  }
+  for _, b := range backends {
+    if err := validateBalancing(b); err != nil {
+      return nil, err
+    }
+    if err := validateAffinity(b); err != nil {
+      return nil, err
+    }
+    if err := validatePool(b); err != nil {
+      return nil, err
+    }
+  }
+  
+  if err := validateServerName(params); err != nil {
+    return nil, err
+  }
+  if err := validateMode(params); err != nil {
+    return nil, err
+  }
+  network, _ := SplitNetwork(listen)
+  if err := validateNetwork(network, params, backends); err != nil {
+    return nil, err
+  }
+  if err := validateLimits(params, backends); err != nil {
+    return nil, err
+  }
+  if err := validateRate(params); err != nil {
+    return nil, err
+  }
+  if err := validateACL(params); err != nil {
+    return nil, err
+  }
+  if err := validateBufferSize(params); err != nil {
+    return nil, err
+  }
+  
+  r := &Route{sync.Mutex{}, listen, params, backends, service, 0, nil}
+  if _, err := NewBalancer(r.Strategy()); err != nil {
+    return nil, err
+  }
+  
+  return r, nil
 }
 
 // Increment and obtain the next index in the backend rotation. We just let this overflow and account for it in Backend().
@@ -100,6 +197,38 @@ func (r *Route) Index() int64 {
   return atomic.AddInt64(&r.index, 1)
 }
 
+// Obtain a route-wide param, which is the value of the param for the backends
+// that specify it
+func (r *Route) Param(name string) (string, bool) {
+  for _, e := range r.Backends {
+    if v, ok := e.Params[name]; ok {
+      return v, true
+    }
+  }
+  return "", false
+}
+
+// Obtain the load balancing strategy for this route, which is the lb param
+// of the backends that specify it
+func (r *Route) Strategy() string {
+  v, _ := r.Param(ParamBalancer)
+  return v
+}
+
+// Obtain the balancer for this route
+func (r *Route) Balancer() Balancer {
+  r.Lock()
+  defer r.Unlock()
+  if r.balancer == nil {
+    b, err := NewBalancer(r.Strategy())
+    if err != nil {
+      b, _ = NewBalancer(RoundRobin)
+    }
+    r.balancer = b
+  }
+  return r.balancer
+}
+
 // Obtain any backend. Panics if there are none.
 func (r *Route) Any() Backend {
   return r.Backends[0]
@@ -121,8 +250,21 @@ func (r *Route) Backend(n int64) Backend {
   }
 }
 
+// Determine if this route is equivalent to another route
+func (r *Route) Equal(o *Route) bool {
+  if r.Listen != o.Listen || r.Service != o.Service || len(r.Backends) != len(o.Backends) || !paramsEqual(r.Params, o.Params) {
+    return false
+  }
+  for i, e := range r.Backends {
+    if !e.Equal(o.Backends[i]) {
+      return false
+    }
+  }
+  return true
+}
+
 // Stringer
-func (r Route) String() string {
+func (r *Route) String() string {
   var b string
   for i, e := range r.Backends {
     if i > 0 { b += ", " }
@@ -132,13 +274,13 @@ func (r Route) String() string {
 }
 
 // Detail stringer
-func (r Route) Detail() string {
+func (r *Route) Detail() string {
   var b string
   for i, e := range r.Backends {
     if i > 0 { b += ", " }
     b += e.Detail()
   }
-  return r.Listen +" -> "+ b
+  return Backend{r.Listen, r.Params}.Detail() +" -> "+ b
 }
 
 // A backend configuration
@@ -147,6 +289,24 @@ type Backend struct {
   Params  map[string]string
 }
 
+// Determine if this backend is equivalent to another backend
+func (b Backend) Equal(o Backend) bool {
+  return b.Addr == o.Addr && paramsEqual(b.Params, o.Params)
+}
+
+// Determine if two sets of params are equivalent
+func paramsEqual(a, b map[string]string) bool {
+  if len(a) != len(b) {
+    return false
+  }
+  for k, v := range a {
+    if x, ok := b[k]; !ok || x != v {
+      return false
+    }
+  }
+  return true
+}
+
 // Stringer
 func (b Backend) String() string {
   return b.Addr
@@ -156,9 +316,16 @@ func (b Backend) String() string {
 func (b Backend) Detail() string {
   s := b.Addr
   if len(b.Params) > 0 {
+    k := make([]string, 0, len(b.Params))
+    for e := range b.Params {
+      k = append(k, e)
+    }
+    sort.Strings(k)
     s += "("
-    for k, v := range b.Params {
-      s += k
+    for i, e := range k {
+      if i > 0 { s += string(paramDelimList) }
+      s += e
+      v := b.Params[e]
       if v != "" {
         s += "='"+ scan.Escape(v, paramDelimQuote, paramDelimEsc) +"'"
       }
@@ -42,6 +42,9 @@ func TestParseRoute(t *testing.T) {
   testParseRoute(t, `:9000=host:1234(tls='true'),other:1234(tls='false')`, &Route{Listen:":9000", Backends:[]Backend{{Addr:"host:1234", Params:map[string]string{"tls": "true"}}, {Addr:"other:1234", Params:map[string]string{"tls": "false"}}}, Service:false}, nil)
   testParseRoute(t, `:9000=host:1234(tls='true') other:1234(tls='false')`, nil, syntaxError(fmt.Errorf("Missing ',' in backend list")))
   testParseRoute(t, `:9000=host:1234(tls='true'),`, nil, syntaxError(fmt.Errorf("Backend is empty")))
+  testParseRoute(t, `:9000(proxy_protocol='v2')=host:1234`, &Route{Listen:":9000", Params:map[string]string{"proxy_protocol": "v2"}, Backends:[]Backend{{Addr:"host:1234"}}, Service:false}, nil)
+  testParseRoute(t, `:9000 ( proxy_protocol='v2' ) = host:1234`, &Route{Listen:":9000", Params:map[string]string{"proxy_protocol": "v2"}, Backends:[]Backend{{Addr:"host:1234"}}, Service:false}, nil)
+  testParseRoute(t, `:9000(proxy_protocol='v2') host:1234`, nil, syntaxError(fmt.Errorf("Invalid route; expected <listen>[(<params>)]=<backend>[,...,<backendN>] in: :9000(proxy_protocol='v2') host:1234")))
 }
 
 func testParseRoute(t *testing.T, in string, er *Route, eerr error) bool {
@@ -53,3 +56,28 @@ func testParseRoute(t *testing.T, in string, er *Route, eerr error) bool {
   fmt.Printf("%v -> %v\n", in, ar)
   return assert.Equal(t, er, ar, "Routes do not match")
 }
+
+func TestRouteEqual(t *testing.T) {
+  testRouteEqual(t, `:9000=upstream`, `:9000=upstream`, true)
+  testRouteEqual(t, `:9000=upstream(tls='a')`, `:9000 = upstream ( tls = 'a' )`, true)
+  testRouteEqual(t, `:9000=host:1234(a='1', b='2')`, `:9000=host:1234(b='2', a='1')`, true)
+  testRouteEqual(t, `:9000(a='1')=host:1234`, `:9000(a='1')=host:1234`, true)
+  testRouteEqual(t, `:9000(a='1')=host:1234`, `:9000=host:1234`, false)
+  testRouteEqual(t, `:9000=upstream`, `:9001=upstream`, false)
+  testRouteEqual(t, `:9000=upstream(tls='a')`, `:9000=upstream(tls='b')`, false)
+  testRouteEqual(t, `:9000=upstream(tls='a')`, `:9000=upstream`, false)
+  testRouteEqual(t, `:9000=host:1234,other:5678`, `:9000=other:5678,host:1234`, false)
+  testRouteEqual(t, `:9000=host:1234`, `:9000=host:1234,other:5678`, false)
+}
+
+func testRouteEqual(t *testing.T, a, b string, expect bool) bool {
+  ra, err := Parse(a)
+  if !assert.Nil(t, err) {
+    return false
+  }
+  rb, err := Parse(b)
+  if !assert.Nil(t, err) {
+    return false
+  }
+  return assert.Equal(t, expect, ra.Equal(rb), fmt.Sprintf("%v == %v", a, b))
+}
@@ -0,0 +1,91 @@
+package route
+
+import (
+  "fmt"
+  "strings"
+)
+
+// The listener param which selects a route by the server name a TLS client
+// requests. Routes with this param may share a listen address; the route
+// whose pattern best matches the name in a client's ClientHello handles the
+// connection and its TLS stream is passed through to the backend untouched.
+// Patterns are a host name, like 'api.example.com', a wildcard matching any
+// subdomain, like '*.example.com', or '*', which matches any name including
+// none.
+const ParamSNI = "sni"
+
+// Obtain the server name pattern for this route. If the route is not
+// selected by server name, the pattern is empty.
+func (r *Route) ServerName() string {
+  return strings.ToLower(r.Params[ParamSNI])
+}
+
+// Obtain a key which identifies this route among the routes being served.
+// Only routes selected by server name or by HTTP request may share a listen
+// address, so the key is the listen address and how the route is selected.
+func (r *Route) Key() string {
+  if v := r.ServerName(); v != "" {
+    return r.Listen +"("+ v +")"
+  }
+  if r.PerRequest() {
+    _, h := r.Params[ParamHost]
+    _, p := r.Params[ParamPath]
+    if h || p {
+      return r.Listen +"("+ coalesce(r.Host(), "*") + r.Path() +")"
+    }
+  }
+  return r.Listen
+}
+
+// Determine how well a server name matches this route's pattern. Zero is no
+// match; higher values are more specific matches.
+func (r *Route) MatchServerName(name string) int {
+  return matchName(r.ServerName(), name)
+}
+
+// Determine how well a name matches a pattern. Zero is no match; higher
+// values are more specific matches.
+func matchName(p, name string) int {
+  name = strings.ToLower(strings.TrimSuffix(name, "."))
+  switch {
+    case p == "*":
+      return 1
+    case strings.HasPrefix(p, "*."):
+      if strings.HasSuffix(name, p[1:]) && len(name) > len(p) - 1 {
+        return 1 + len(p)
+      }
+    case p != "" && p == name:
+      return 1 << 12 // exact names beat any wildcard
+  }
+  return 0
+}
+
+// Validate a server name pattern
+func validateServerName(p map[string]string) error {
+  if v, ok := p[ParamSNI]; ok {
+    return validateName(v)
+  }
+  return nil
+}
+
+// Validate a name pattern
+func validateName(v string) error {
+  if v == "*" {
+    return nil
+  }
+  n := strings.TrimPrefix(v, "*.")
+  if n == "" || strings.ContainsAny(n, "*:/ ") || strings.HasPrefix(n, ".") || strings.HasSuffix(n, ".") {
+    return fmt.Errorf("Invalid name pattern: %v", v)
+  }
+  return nil
+}
+
+// Return the first non-empty string
+func coalesce(v ...string) string {
+  for _, e := range v {
+    if e != "" {
+      return e
+    }
+  }
+  return ""
+}
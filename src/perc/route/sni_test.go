@@ -0,0 +1,31 @@
+package route
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+)
+
+func TestMatchServerName(t *testing.T) {
+  exact, _ := Parse(`:443(sni='API.example.com')=a:1`)
+  wild, _ := Parse(`:443(sni='*.example.com')=b:1`)
+  deep, _ := Parse(`:443(sni='*.internal.example.com')=c:1`)
+  any, _ := Parse(`:443(sni='*')=d:1`)
+  none, _ := Parse(`:443=e:1`)
+  
+  assert.Equal(t, ":443(api.example.com)", exact.Key())
+  assert.Equal(t, ":443", none.Key())
+  
+  assert.True(t, exact.MatchServerName("api.example.com") > wild.MatchServerName("api.example.com"))
+  assert.True(t, deep.MatchServerName("db.internal.example.com") > wild.MatchServerName("db.internal.example.com"))
+  assert.True(t, wild.MatchServerName("db.internal.example.com") > any.MatchServerName("db.internal.example.com"))
+  assert.Equal(t, 0, wild.MatchServerName("example.com"))
+  assert.Equal(t, 0, wild.MatchServerName("badexample.com"))
+  assert.Equal(t, 0, exact.MatchServerName(""))
+  assert.Equal(t, 1, any.MatchServerName(""))
+  assert.Equal(t, 0, none.MatchServerName("api.example.com"))
+  
+  for _, e := range []string{`*.*.example.com`, `example.com:443`, `*.`, `.example.com`, ``} {
+    _, err := Parse(`:443(sni='`+ e +`')=a:1`)
+    assert.NotNil(t, err, e)
+  }
+}
@@ -0,0 +1,47 @@
+package service
+
+import (
+  "github.com/bww/go-alert"
+  "github.com/bww/go-util/debug"
+  "github.com/rcrowley/go-metrics"
+)
+
+var (
+  proxyACLDeny metrics.Meter
+)
+
+func init() {
+  proxyACLDeny = metrics.NewMeter()
+  metrics.Register("percolator.proxy.acl.deny", proxyACLDeny)
+}
+
+// Determine whether a client may connect to a frontend's route. Denied
+// clients are counted and, if the route asks for it, logged.
+func (s *Service) permit(f *frontend, caddr string) bool {
+  if f.acl.Permit(caddr) {
+    return true
+  }
+  proxyACLDeny.Mark(1)
+  if f.acl.Log || debug.VERBOSE {
+    alt.Debugf("service: %v: Denied client by access control: %v", caddr, f.route.Key())
+  }
+  return false
+}
+
+// Determine whether a client may connect to any of the routes of frontends
+// which share a listener. If none permit it the client is counted and, if any
+// route asks for it, logged as it is by permit.
+func (s *Service) permitAny(fs []*frontend, caddr string) bool {
+  var log bool
+  for _, e := range fs {
+    if e.acl.Permit(caddr) {
+      return true
+    }
+    log = log || e.acl.Log
+  }
+  proxyACLDeny.Mark(1)
+  if log || debug.VERBOSE {
+    alt.Debugf("service: %v: Denied client by access control: %v", caddr, fs[0].route.Listen)
+  }
+  return false
+}
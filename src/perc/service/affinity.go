@@ -0,0 +1,124 @@
+package service
+
+import (
+  "sync"
+  "time"
+  "container/list"
+)
+
+// Expired affinity bindings are swept at most this often
+const affinitySweep = time.Minute
+
+// The most bindings an affinity table holds by default
+const maxAffinity = 100000
+
+// Affinity stats
+type AffinityStats struct {
+  Size      int     `json:"size"`
+  Hits      int64   `json:"hits"`
+  Misses    int64   `json:"misses"`
+  HitRatio  float64 `json:"hit_ratio"`
+  Evicted   int64   `json:"evicted"`
+}
+
+// A client bound to a backend
+type binding struct {
+  key     string
+  addr    string
+  expires time.Time
+}
+
+// An affinity table binds clients of a route to the backend address they
+// were last proxied to. Bindings expire once a client has not connected for
+// the route's affinity TTL. When the table is full the binding which was
+// least recently made is evicted to make room for a new one.
+type affinity struct {
+  sync.Mutex
+  bindings  map[string]*list.Element
+  order     *list.List // most recently made first
+  max       int
+  hits      int64
+  misses    int64
+  evicted   int64
+  swept     time.Time
+}
+
+// Create an affinity table which holds at most max bindings
+func newAffinity(max int) *affinity {
+  return &affinity{sync.Mutex{}, make(map[string]*list.Element), list.New(), max, 0, 0, 0, time.Now()}
+}
+
+// Obtain the backend address a client of a route is bound to, if any
+func (a *affinity) Get(route, client string) (string, bool) {
+  a.Lock()
+  defer a.Unlock()
+  now := time.Now()
+  a.sweep(now)
+  if e, ok := a.bindings[route +"/"+ client]; ok {
+    if b := e.Value.(*binding); now.Before(b.expires) {
+      return b.addr, true
+    }
+  }
+  return "", false
+}
+
+// Bind a client of a route to a backend address for the provided TTL,
+// replacing any existing binding
+func (a *affinity) Put(route, client, addr string, ttl time.Duration) {
+  a.Lock()
+  defer a.Unlock()
+  k := route +"/"+ client
+  if e, ok := a.bindings[k]; ok {
+    b := e.Value.(*binding)
+    b.addr, b.expires = addr, time.Now().Add(ttl)
+    a.order.MoveToFront(e)
+    return
+  }
+  for a.max > 0 && len(a.bindings) >= a.max {
+    a.remove(a.order.Back())
+    a.evicted++
+  }
+  a.bindings[k] = a.order.PushFront(&binding{k, addr, time.Now().Add(ttl)})
+}
+
+// Record whether a client was proxied to the backend it is bound to
+func (a *affinity) Record(hit bool) {
+  a.Lock()
+  defer a.Unlock()
+  if hit {
+    a.hits++
+  }else{
+    a.misses++
+  }
+}
+
+// Obtain table stats
+func (a *affinity) Stats() AffinityStats {
+  a.Lock()
+  defer a.Unlock()
+  a.sweep(time.Now())
+  s := AffinityStats{Size:len(a.bindings), Hits:a.hits, Misses:a.misses, Evicted:a.evicted}
+  if n := a.hits + a.misses; n > 0 {
+    s.HitRatio = float64(a.hits) / float64(n)
+  }
+  return s
+}
+
+// Remove expired bindings. The table must be locked.
+func (a *affinity) sweep(now time.Time) {
+  if now.Sub(a.swept) < affinitySweep {
+    return
+  }
+  for _, e := range a.bindings {
+    if !now.Before(e.Value.(*binding).expires) {
+      a.remove(e)
+    }
+  }
+  a.swept = now
+}
+
+// Remove a binding. The table must be locked.
+func (a *affinity) remove(e *list.Element) {
+  delete(a.bindings, e.Value.(*binding).key)
+  a.order.Remove(e)
+}
@@ -0,0 +1,64 @@
+package service
+
+import (
+  "time"
+  "testing"
+)
+
+import (
+  "github.com/stretchr/testify/assert"
+)
+
+func TestAffinity(t *testing.T) {
+  a := newAffinity(maxAffinity)
+  
+  _, ok := a.Get(":9000", "10.0.0.1")
+  assert.False(t, ok)
+  a.Record(false)
+  
+  a.Put(":9000", "10.0.0.1", "a:1", time.Minute)
+  a.Put(":9001", "10.0.0.1", "b:1", time.Minute)
+  a.Put(":9000", "10.0.0.2", "c:1", time.Millisecond)
+  
+  v, ok := a.Get(":9000", "10.0.0.1")
+  assert.True(t, ok)
+  assert.Equal(t, "a:1", v)
+  a.Record(true)
+  v, ok = a.Get(":9001", "10.0.0.1")
+  assert.True(t, ok)
+  assert.Equal(t, "b:1", v)
+  a.Record(true)
+  
+  time.Sleep(time.Millisecond * 5)
+  _, ok = a.Get(":9000", "10.0.0.2")
+  assert.False(t, ok)
+  
+  a.swept = time.Time{} // force expired bindings to be swept
+  s := a.Stats()
+  assert.Equal(t, 2, s.Size)
+  assert.Equal(t, int64(2), s.Hits)
+  assert.Equal(t, int64(1), s.Misses)
+  assert.InDelta(t, 2.0 / 3.0, s.HitRatio, 0.001)
+}
+
+func TestAffinityEviction(t *testing.T) {
+  a := newAffinity(2)
+  
+  a.Put(":9000", "10.0.0.1", "a:1", time.Minute)
+  a.Put(":9000", "10.0.0.2", "b:1", time.Minute)
+  a.Put(":9000", "10.0.0.1", "c:1", time.Minute) // rebinding makes it the most recent
+  a.Put(":9000", "10.0.0.3", "d:1", time.Minute)
+  
+  _, ok := a.Get(":9000", "10.0.0.2")
+  assert.False(t, ok)
+  v, ok := a.Get(":9000", "10.0.0.1")
+  assert.True(t, ok)
+  assert.Equal(t, "c:1", v)
+  v, ok = a.Get(":9000", "10.0.0.3")
+  assert.True(t, ok)
+  assert.Equal(t, "d:1", v)
+  
+  s := a.Stats()
+  assert.Equal(t, 2, s.Size)
+  assert.Equal(t, int64(1), s.Evicted)
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+  "io"
+  "net"
+  "sync"
+  "time"
+  "bufio"
+)
+
+// Deadlines are extended at most this many times per timeout
+const deadlineSteps = 16
+
+// Copy buffers, pooled by size so that connections reuse them rather than
+// allocating their own
+var buffers = &bufferPool{pools:make(map[int]*sync.Pool)}
+
+// Readers used to parse HTTP messages
+var readers = sync.Pool{New:func() interface{} { return bufio.NewReader(nil) }}
+
+// A pool of buffers of various sizes
+type bufferPool struct {
+  sync.RWMutex
+  pools map[int]*sync.Pool
+}
+
+// Obtain a buffer of the provided size. It should be returned with Put when
+// it is no longer used.
+func (p *bufferPool) Get(size int) *[]byte {
+  return p.pool(size).Get().(*[]byte)
+}
+
+// Return a buffer to the pool
+func (p *bufferPool) Put(b *[]byte) {
+  p.pool(len(*b)).Put(b)
+}
+
+// Obtain the pool for a size, creating it if necessary
+func (p *bufferPool) pool(size int) *sync.Pool {
+  p.RLock()
+  x, ok := p.pools[size]
+  p.RUnlock()
+  if ok {
+    return x
+  }
+  p.Lock()
+  defer p.Unlock()
+  if x, ok = p.pools[size]; !ok {
+    x = &sync.Pool{New:func() interface{} {
+      b := make([]byte, size)
+      return &b
+    }}
+    p.pools[size] = x
+  }
+  return x
+}
+
+// Obtain a pooled reader which reads from the provided reader. It should be
+// returned with putReader when it is no longer used.
+func getReader(r io.Reader) *bufio.Reader {
+  b := readers.Get().(*bufio.Reader)
+  b.Reset(r)
+  return b
+}
+
+// Return a reader to the pool
+func putReader(b *bufio.Reader) {
+  b.Reset(nil)
+  readers.Put(b)
+}
+
+// The deadlines of a connection that data is being transferred from. They are
+// extended as the connection is used, but since that is comparatively costly
+// they are only extended once a fraction of the shortest timeout has passed
+// since they last were, so a connection may time out up to that fraction
+// early.
+type deadlines struct {
+  conn      net.Conn
+  rto, wto  time.Duration
+  interval  time.Duration
+  extended  time.Time
+}
+
+// Create deadlines for a connection with the provided timeouts, either of
+// which may be zero
+func newDeadlines(c net.Conn, rto, wto time.Duration) deadlines {
+  d := deadlines{conn:c, rto:rto, wto:wto}
+  if rto > 0 && (wto <= 0 || rto < wto) {
+    d.interval = rto / deadlineSteps
+  }else if wto > 0 {
+    d.interval = wto / deadlineSteps
+  }
+  return d
+}
+
+// Extend the deadlines if enough time has passed since they last were
+func (d *deadlines) Extend() {
+  if d.rto <= 0 && d.wto <= 0 {
+    return
+  }
+  now := time.Now()
+  if now.Sub(d.extended) < d.interval {
+    return
+  }
+  d.extended = now
+  if d.rto > 0 { // read deadline on src only
+    d.conn.SetReadDeadline(now.Add(d.rto))
+  }
+  if d.wto > 0 { // write deadline on src only
+    d.conn.SetWriteDeadline(now.Add(d.wto))
+  }
+}
@@ -0,0 +1,147 @@
+package service
+
+import (
+  "io"
+  "fmt"
+  "net"
+  "time"
+  "testing"
+  "sync/atomic"
+  
+  "perc/route"
+)
+
+import (
+  "github.com/stretchr/testify/assert"
+  "github.com/rcrowley/go-metrics"
+)
+
+// An in-memory connection which reads a fixed number of bytes in chunks and
+// discards what is written to it
+type memConn struct {
+  remain, chunk int
+}
+
+func (c *memConn) Read(b []byte) (int, error) {
+  if c.remain < 1 {
+    return 0, io.EOF
+  }
+  n := c.chunk
+  if n > len(b) {
+    n = len(b)
+  }
+  if n > c.remain {
+    n = c.remain
+  }
+  c.remain -= n
+  return n, nil
+}
+
+func (c *memConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (c *memConn) CloseWrite() error                  { return nil }
+func (c *memConn) Close() error                       { return nil }
+func (c *memConn) LocalAddr() net.Addr                { return nil }
+func (c *memConn) RemoteAddr() net.Addr               { return nil }
+func (c *memConn) SetDeadline(t time.Time) error      { return nil }
+func (c *memConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *memConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// A connection which counts how often its deadlines are set
+type deadlineConn struct {
+  memConn
+  set int
+}
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+  c.set++
+  return nil
+}
+
+func TestBufferPool(t *testing.T) {
+  for _, e := range []int{route.MinBufferSize, route.DefaultBufferSize} {
+    b := buffers.Get(e)
+    assert.Equal(t, e, len(*b))
+    buffers.Put(b)
+  }
+}
+
+func TestDeadlines(t *testing.T) {
+  c := &deadlineConn{}
+  d := newDeadlines(c, time.Minute, 0)
+  for i := 0; i < 100; i++ {
+    d.Extend()
+  }
+  assert.Equal(t, 1, c.set) // not again until a sixteenth of the timeout has passed
+  
+  d = newDeadlines(c, time.Millisecond * 16, 0)
+  d.Extend()
+  <- time.After(time.Millisecond * 2)
+  d.Extend()
+  assert.Equal(t, 3, c.set)
+}
+
+// Copy as connections were before buffers were pooled, for comparison: each
+// direction allocates its own buffer and deadlines are set after every read
+func copyUnpooled(s *Service, dst, src net.Conn, xfer metrics.Meter, errs chan<- error) {
+  defer close(errs)
+  buf := make([]byte, 32 * 1024)
+  for {
+    nr, er := src.Read(buf)
+    xfer.Mark(int64(nr))
+    atomic.AddInt64(&s.handlerXfer, int64(nr))
+    if s.rto > 0 {
+      src.SetReadDeadline(time.Now().Add(s.rto))
+    }
+    if s.wto > 0 {
+      src.SetWriteDeadline(time.Now().Add(s.wto))
+    }
+    if nr > 0 {
+      nw, ew := dst.Write(buf[0:nr])
+      if ew != nil {
+        errs <- ew
+        return
+      }
+      if nr != nw {
+        errs <- io.ErrShortWrite
+        return
+      }
+    }
+    if er != nil {
+      if er != io.EOF {
+        errs <- er
+      }
+      return
+    }
+  }
+}
+
+// Proxy a connection in both directions with copyUnpooled
+func proxyUnpooled(s *Service, c, p net.Conn) {
+  rerrs := make(chan error, 1)
+  werrs := make(chan error, 1)
+  go copyUnpooled(s, c, p, proxyBytesReadRate, rerrs)
+  go copyUnpooled(s, p, c, proxyBytesWriteRate, werrs)
+  for range rerrs {}
+  for range werrs {}
+}
+
+// Measure the allocations made proxying a connection which transfers 64 KiB
+// in each direction in small reads. The baseline copies without pooling, as
+// connections were before, to compare against.
+func BenchmarkProxyAllocs(b *testing.B) {
+  s := New(Config{ReadTimeout:time.Minute, WriteTimeout:time.Minute})
+  b.Run("baseline", func(b *testing.B) {
+    b.ReportAllocs()
+    for i := 0; i < b.N; i++ {
+      proxyUnpooled(s, &memConn{64 * 1024, 1024}, &memConn{64 * 1024, 1024})
+    }
+  })
+  for _, e := range []int{4 * 1024, route.DefaultBufferSize} {
+    b.Run(fmt.Sprintf("buffer=%d", e), func(b *testing.B) {
+      b.ReportAllocs()
+      for i := 0; i < b.N; i++ {
+        s.proxy(&memConn{64 * 1024, 1024}, &memConn{64 * 1024, 1024}, e, nil)
+      }
+    })
+  }
+}
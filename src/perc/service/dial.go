@@ -0,0 +1,232 @@
+package service
+
+import (
+  "fmt"
+  "net"
+  "time"
+  "crypto/tls"
+  
+  "perc/route"
+  "perc/proxyproto"
+  "perc/tlsconfig"
+  "perc/discovery/provider"
+)
+
+import (
+  "golang.org/x/net/trace"
+  "github.com/bww/go-alert"
+  "github.com/bww/go-util/debug"
+)
+
+// A backend address a connection may be proxied to
+type target struct {
+  backend route.Backend
+  addr    string
+}
+
+// Obtain the targets a connection from a client for a route may be proxied
+// to, in the order they should be attempted. Available static backends and
+// discovered service providers are grouped into priority tiers. The highest
+// priority tier with any available targets is ordered by the route's balancer
+// and lower priority tiers follow it in order, so they are only used when it
+// cannot be connected to. Targets which are failing health checks or have been
+// ejected are never used; if no target is available ErrUnavailable is returned.
+//
+// If the client is bound to a backend address by session affinity and that
+// address is available in the highest priority tier, it is attempted first.
+func (s *Service) targets(r *route.Route, key, bound string) ([]target, error) {
+  var t []target
+  if r.Service {
+    b := r.Any()
+    p, err := s.discovery.LookupProviders(maxProviders, b.Addr)
+    if err != nil {
+      return nil, err
+    }
+    for _, e := range p {
+      t = append(t, target{b, e})
+    }
+  }else{
+    for _, b := range r.Backends {
+      t = append(t, target{b, b.Addr})
+    }
+  }
+  if len(t) < 1 {
+    return nil, provider.ErrNoProviders
+  }
+  
+  var a []target
+  for _, e := range t {
+    if s.available(e.addr, e.backend) {
+      a = append(a, e)
+    }
+  }
+  if len(a) < 1 {
+    return nil, ErrUnavailable
+  }
+  
+  c := make([]route.Backend, len(a))
+  for i, e := range a {
+    c[i] = route.Backend{Addr:e.addr, Params:e.backend.Params}
+  }
+  o := make([]target, 0, len(a))
+  for i, e := range route.Tiers(c) {
+    if i == 0 {
+      x := make([]route.Backend, len(e))
+      for j, v := range e {
+        x[j] = c[v]
+      }
+      for _, j := range r.Balancer().Order(x, key) {
+        o = append(o, a[e[j]])
+      }
+      for j, v := range o {
+        if bound != "" && v.addr == bound {
+          copy(o[1:j+1], o[:j])
+          o[0] = v
+          break
+        }
+      }
+    }else{
+      for _, j := range e {
+        o = append(o, a[j])
+      }
+    }
+  }
+  
+  return o, nil
+}
+
+// Determine whether a backend address is passing health checks and has not
+// been ejected for failing too often
+func (s *Service) available(addr string, b route.Backend) bool {
+  return s.detector.Available(addr, b) && s.checker.Healthy(addr, b)
+}
+
+// Connect to the first target which accepts a connection. At most the
+// configured number of attempts are made, and if a connect budget is
+// configured every attempt must complete within it. Targets which are at
+// their backend's connection limit are skipped without being attempted; the
+// connection to the target returned is reserved and must be unreserved when
+// it is closed. If a target's backend pools connections an idle one is used
+// when available rather than dialing.
+func (s *Service) connect(c net.Conn, targets []target, tr trace.Trace) (net.Conn, target, error) {
+  var deadline time.Time
+  if s.budget > 0 {
+    deadline = time.Now().Add(s.budget)
+  }
+  
+  var t target
+  var err error
+  var i int
+  for _, e := range targets {
+    if i >= s.attempts {
+      break
+    }
+    if !deadline.IsZero() && !time.Now().Before(deadline) {
+      err = fmt.Errorf("Connect budget exhausted after %d attempts (%v)", i, err)
+      break
+    }
+    if !s.limits.Reserve(e.addr, e.backend) {
+      if debug.VERBOSE {
+        alt.Debugf("service: %v: Backend is at its connection limit: %v (%v)", c.RemoteAddr(), e.addr, e.backend)
+      }
+      continue
+    }
+    if i > 0 {
+      proxyDialRetry.Mark(1)
+    }
+    i++
+    
+    t = e
+    if debug.VERBOSE {
+      alt.Debugf("%v: Proxying to backend: %v (%v)", c.RemoteAddr(), t.addr, t.backend)
+    }
+    
+    p := s.pools.Get(t)
+    if p != nil {
+      if tr != nil {
+        tr.LazyPrintf("%v: Proxying to backend: %v (%v) via pooled connection", c.RemoteAddr(), t.addr, t.backend)
+      }
+      return p, t, nil
+    }
+    p, err = s.dial(c, t, deadline, tr)
+    if err == nil {
+      s.detector.Success(t.addr, t.backend)
+      return p, t, nil
+    }
+    
+    s.limits.Unreserve(t.addr)
+    s.detector.Failure(t.addr, t.backend)
+    if debug.VERBOSE {
+      alt.Debugf("service: %v: Could not connect to backend: %v (%v): %v", c.RemoteAddr(), t.addr, t.backend, err)
+    }
+    if tr != nil {
+      tr.LazyPrintf("%v: Could not connect to backend: %v (%v): %v", c.RemoteAddr(), t.addr, t.backend, err)
+    }
+  }
+  
+  if i == 0 && err == nil && len(targets) > 0 {
+    err = ErrBackendsFull // every target was skipped
+  }
+  return nil, t, err
+}
+
+// Dial a target. If the target's backend uses the PROXY protocol a header
+// describing the client connection is written first, before any TLS handshake.
+// The header and handshake must complete within the connect timeout. No
+// client is provided when a connection is dialed for a pool, which is never
+// done for backends that use the PROXY protocol.
+func (s *Service) dial(c net.Conn, t target, deadline time.Time, tr trace.Trace) (net.Conn, error) {
+  d := &net.Dialer{Timeout:s.cto, Deadline:deadline}
+  conf, err := tlsconfig.Client(t.backend.Params, t.addr)
+  if err != nil {
+    return nil, err
+  }
+  secure := conf != nil
+  version, proxied := t.backend.Params[proxyproto.ParamProxyProtocol]
+  if tr != nil {
+    if secure {
+      tr.LazyPrintf("%v: Proxying to backend: %v (%v) via TLS (SNI: %v)", c.RemoteAddr(), t.addr, t.backend, conf.ServerName)
+    }else{
+      tr.LazyPrintf("%v: Proxying to backend: %v (%v)", c.RemoteAddr(), t.addr, t.backend)
+    }
+  }
+  
+  network, addr := route.SplitNetwork(t.addr)
+  p, err := d.Dial(network, addr)
+  if err != nil {
+    return nil, err
+  }
+  if !secure && !proxied {
+    return p, nil
+  }
+  
+  limit := deadline
+  if s.cto > 0 {
+    if v := time.Now().Add(s.cto); limit.IsZero() || v.Before(limit) {
+      limit = v
+    }
+  }
+  p.SetDeadline(limit)
+  
+  if proxied {
+    h, err := proxyproto.Header(version, c.RemoteAddr(), c.LocalAddr())
+    if err == nil {
+      _, err = p.Write(h)
+    }
+    if err != nil {
+      p.Close()
+      return nil, fmt.Errorf("Could not write PROXY protocol header: %v", err)
+    }
+  }
+  if secure {
+    x := tls.Client(p, conf)
+    if err := x.Handshake(); err != nil {
+      p.Close()
+      return nil, err
+    }
+    p = x
+  }
+  
+  p.SetDeadline(time.Time{})
+  return p, nil
+}
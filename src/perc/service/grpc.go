@@ -0,0 +1,420 @@
+package service
+
+import (
+  "io"
+  "fmt"
+  "net"
+  "sync"
+  "time"
+  "errors"
+  "context"
+  "net/url"
+  "net/http"
+  "io/ioutil"
+  "crypto/tls"
+  "sync/atomic"
+  
+  "perc/route"
+  "perc/tlsconfig"
+)
+
+import (
+  "golang.org/x/net/trace"
+  "golang.org/x/net/http2"
+  "github.com/bww/go-alert"
+  "github.com/bww/go-util/debug"
+  "github.com/rcrowley/go-metrics"
+)
+
+// Serve HTTP/2 streams from a client until it closes the connection. Each
+// stream is routed to the frontend whose route best matches its authority and
+// path and is proxied to a backend chosen for it alone, so the calls a client
+// makes over one connection are balanced across backends. Once the done
+// channel is closed the client is asked to go away and the connection is
+// closed when its streams finish.
+func (s *Service) serveGRPC(fs []*frontend, done <-chan struct{}, c net.Conn, caddr string, secure bool) {
+  defer c.Close()
+  
+  if debug.VERBOSE {
+    alt.Debugf("%v: Accepted HTTP/2 connection", c.RemoteAddr())
+  }
+  
+  hs := &http.Server{}
+  h2 := &http2.Server{IdleTimeout:s.rto}
+  err := http2.ConfigureServer(hs, h2)
+  if err != nil {
+    alt.Errorf("service: %v: Could not configure HTTP/2: %v", c.RemoteAddr(), err)
+    return
+  }
+  
+  stop := make(chan struct{})
+  defer close(stop)
+  go func() {
+    select {
+      case <- done:
+        hs.Shutdown(context.Background()) // sends GOAWAY; returns immediately
+      case <- stop:
+    }
+  }()
+  
+  h2.ServeConn(c, &http2.ServeConnOpts{
+    BaseConfig: hs,
+    Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+      s.serveStream(fs, w, req, caddr, secure)
+    }),
+  })
+}
+
+// Proxy a single HTTP/2 stream and its response, including trailers
+func (s *Service) serveStream(fs []*frontend, w http.ResponseWriter, req *http.Request, caddr string, secure bool) {
+  start := time.Now()
+  httpRequestRate.Mark(1)
+  
+  host := req.Host
+  if h, _, err := net.SplitHostPort(host); err == nil {
+    host = h
+  }
+  f := selectRequestFrontend(fs, host, req.URL.Path)
+  
+  var tr trace.Trace
+  if s.debug {
+    var b string
+    if f == nil {
+      b = "<none>"
+    }else if f.route.Service {
+      b = f.route.Any().String()
+    }else{
+      b = "<next>"
+    }
+    tr = trace.New("perc.Service", fmt.Sprintf("%v -> %v", caddr, b))
+    defer tr.Finish()
+    tr.LazyPrintf("%v: %v %v%v", req.RemoteAddr, req.Method, req.Host, req.URL.RequestURI())
+  }
+  
+  atomic.AddInt64(&s.handlerOpen, 1)
+  atomic.AddInt64(&s.handlerTotal, 1)
+  defer atomic.AddInt64(&s.handlerOpen, -1)
+  
+  if f == nil {
+    httpRequestError.Mark(1)
+    if debug.VERBOSE {
+      alt.Debugf("service: %v: No route for stream: %v%v", req.RemoteAddr, req.Host, req.URL.Path)
+    }
+    if tr != nil {
+      tr.LazyPrintf("No route for stream")
+      tr.SetError()
+    }
+    w.WriteHeader(http.StatusNotFound)
+    return
+  }
+  r := f.route
+  
+  if !s.permit(f, caddr) {
+    httpRequestError.Mark(1)
+    if tr != nil {
+      tr.LazyPrintf("Client denied by access control")
+      tr.SetError()
+    }
+    w.WriteHeader(http.StatusForbidden)
+    return
+  }
+  if !s.throttle(r, caddr, req.Context().Done()) {
+    httpRequestError.Mark(1)
+    if debug.VERBOSE {
+      alt.Debugf("service: %v: Rejected stream; client exceeded the rate limit for route: %v", req.RemoteAddr, r.Key())
+    }
+    if tr != nil {
+      tr.LazyPrintf("Client exceeded the rate limit")
+      tr.SetError()
+    }
+    w.WriteHeader(http.StatusTooManyRequests)
+    return
+  }
+  
+  x, ok := s.limits.Admit(r, req.Context().Done(), true)
+  if !ok {
+    httpRequestError.Mark(1)
+    if debug.VERBOSE {
+      alt.Debugf("service: %v: Rejected stream; route is at its connection limit: %v", req.RemoteAddr, r.Key())
+    }
+    if tr != nil {
+      tr.LazyPrintf("Route is at its connection limit")
+      tr.SetError()
+    }
+    w.WriteHeader(http.StatusServiceUnavailable)
+    return
+  }
+  defer x.Release()
+  
+  targets, bound, err := s.resolve(r, caddr, tr)
+  if err != nil {
+    httpRequestError.Mark(1)
+    w.WriteHeader(http.StatusBadGateway)
+    return
+  }
+  proxyResolveTimer.Update(time.Since(start))
+  
+  forwarded(req, caddr, secure)
+  out := req.Clone(req.Context())
+  out.RequestURI = ""
+  out.URL = &url.URL{Scheme:"http", Opaque:req.URL.Opaque, Path:req.URL.Path, RawPath:req.URL.RawPath, RawQuery:req.URL.RawQuery}
+  if req.Body != nil && req.Body != http.NoBody {
+    // the body is closed by the server, not by a failed attempt
+    out.Body = ioutil.NopCloser(&meteredReader{req.Body, s, proxyBytesWriteRate})
+  }
+  
+  rsp, t, err := s.roundTrip(out, targets, req.RemoteAddr, tr)
+  if t.addr != "" {
+    s.count(r, t, caddr)
+  }
+  if err != nil {
+    httpRequestError.Mark(1)
+    proxyConnError.Mark(1)
+    if debug.VERBOSE {
+      alt.Debugf("service: %v: Could not proxy stream: %v", req.RemoteAddr, err)
+    }
+    if tr != nil {
+      tr.LazyPrintf("%v: Could not proxy stream: %v", req.RemoteAddr, err)
+      tr.SetError()
+    }
+    if err == ErrBackendsFull || err == ErrUnavailable {
+      w.WriteHeader(http.StatusServiceUnavailable)
+    }else{
+      w.WriteHeader(http.StatusBadGateway)
+    }
+    return
+  }
+  defer rsp.Body.Close()
+  defer s.limits.Unreserve(t.addr)
+  
+  proxyLatencyTimer.Update(time.Since(start))
+  s.bind(r, caddr, bound, t.addr)
+  
+  balancer := r.Balancer()
+  balancer.Acquire(t.addr)
+  defer balancer.Release(t.addr)
+  
+  h := w.Header()
+  for k, v := range rsp.Header {
+    if k != "Trailer" {
+      h[k] = v
+    }
+  }
+  w.WriteHeader(rsp.StatusCode) // not flushed, so a response with no body is sent as a single frame
+  flusher, _ := w.(http.Flusher)
+  
+  b := buffers.Get(r.BufferSize())
+  defer buffers.Put(b)
+  buf := *b
+  for {
+    n, err := rsp.Body.Read(buf)
+    if n > 0 {
+      proxyBytesReadRate.Mark(int64(n))
+      atomic.AddInt64(&s.handlerXfer, int64(n))
+      if _, ew := w.Write(buf[:n]); ew != nil {
+        err = ew
+      }else if flusher != nil {
+        flusher.Flush()
+      }
+    }
+    if err == io.EOF {
+      break
+    }else if err != nil {
+      proxyXferError.Mark(1)
+      if debug.VERBOSE {
+        alt.Debugf("service: %v -> %v (%v): Could not proxy stream: %v", req.RemoteAddr, t.addr, t.backend, err)
+      }
+      if tr != nil {
+        tr.LazyPrintf("%v -> %v (%v): Could not proxy stream: %v", req.RemoteAddr, t.addr, t.backend, err)
+        tr.SetError()
+      }
+      panic(http.ErrAbortHandler) // reset the stream rather than end it cleanly
+    }
+  }
+  
+  // trailers are only known once the body has been read; the prefix declares
+  // them after the header has been written
+  for k, v := range rsp.Trailer {
+    h[http.TrailerPrefix + k] = v
+  }
+  
+  httpRequestTimer.Update(time.Since(start))
+  if debug.VERBOSE {
+    alt.Debugf("%v: Stream complete: %v (%v): %v", req.RemoteAddr, t.addr, t.backend, rsp.Status)
+  }
+  if tr != nil {
+    tr.LazyPrintf("%v: Stream complete: %v (%v): %v", req.RemoteAddr, t.addr, t.backend, rsp.Status)
+  }
+}
+
+// Send a request to the first target which accepts it. Another target is only
+// attempted when a connection to the previous one could not be established,
+// since the request has not been sent. At most the configured number of
+// attempts are made. As with connections, targets at their backend's limit
+// are skipped and the target a response is returned from is reserved.
+func (s *Service) roundTrip(req *http.Request, targets []target, client string, tr trace.Trace) (*http.Response, target, error) {
+  var t target
+  var err error
+  var i int
+  for _, e := range targets {
+    if i >= s.attempts {
+      break
+    }
+    if !s.limits.Reserve(e.addr, e.backend) {
+      continue
+    }
+    if i > 0 {
+      proxyDialRetry.Mark(1)
+    }
+    i++
+  
+    t = e
+    if tr != nil {
+      tr.LazyPrintf("%v: Proxying stream to backend: %v (%v)", client, t.addr, t.backend)
+    }
+  
+    req.URL.Host = t.addr
+    if n, _ := route.SplitNetwork(t.addr); n == route.NetworkUnix {
+      req.URL.Host = "localhost" // the transport dials the socket
+    }
+    var rsp *http.Response
+    rsp, err = s.transports.Get(t.backend).RoundTrip(req)
+    if err == nil {
+      return rsp, t, nil
+    }
+    s.limits.Unreserve(t.addr)
+  
+    var d *dialError
+    if !errors.As(err, &d) {
+      return nil, t, err
+    }
+    if debug.VERBOSE {
+      alt.Debugf("service: %v: Could not connect to backend: %v (%v): %v", client, t.addr, t.backend, err)
+    }
+    if tr != nil {
+      tr.LazyPrintf("%v: Could not connect to backend: %v (%v): %v", client, t.addr, t.backend, err)
+    }
+  }
+  if i == 0 && len(targets) > 0 {
+    err = ErrBackendsFull
+  }
+  return nil, t, err
+}
+
+// A failure to establish a connection to a backend
+type dialError struct {
+  err error
+}
+
+func (e *dialError) Error() string {
+  return e.err.Error()
+}
+
+// HTTP/2 transports which proxy streams to backends. Connections to a backend
+// are shared by every client of it, so each backend has a transport which
+// maintains them. Backends are identified by their address and params, so a
+// backend whose params change, like its TLS configuration, gets a new one.
+type transports struct {
+  sync.Mutex
+  s *Service
+  t map[string]*http2.Transport
+}
+
+// Create transports for a service
+func newTransports(s *Service) *transports {
+  return &transports{s:s, t:make(map[string]*http2.Transport)}
+}
+
+// Obtain the transport for a backend, creating it if necessary
+func (t *transports) Get(b route.Backend) *http2.Transport {
+  k := b.Detail()
+  t.Lock()
+  defer t.Unlock()
+  if x, ok := t.t[k]; ok {
+    return x
+  }
+  x := &http2.Transport{
+    AllowHTTP: true,
+    DialTLSContext: func(cxt context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+      if n, _ := route.SplitNetwork(b.Addr); n == route.NetworkUnix {
+        addr = b.Addr // a socket can't be a request's host; see roundTrip
+      }
+      c, err := t.s.dialStream(cxt, b, addr)
+      if err != nil {
+        t.s.detector.Failure(addr, b)
+        return nil, &dialError{err}
+      }
+      t.s.detector.Success(addr, b)
+      return c, nil
+    },
+  }
+  t.t[k] = x
+  return x
+}
+
+// Discard the transports for backends which are not used by any route,
+// closing their idle connections
+func (t *transports) Retain(routes []*route.Route) {
+  keep := make(map[string]struct{})
+  for _, r := range routes {
+    for _, b := range r.Backends {
+      keep[b.Detail()] = struct{}{}
+    }
+  }
+  t.Lock()
+  defer t.Unlock()
+  for k, x := range t.t {
+    if _, ok := keep[k]; !ok {
+      x.CloseIdleConnections()
+      delete(t.t, k)
+    }
+  }
+}
+
+// Dial a backend address for HTTP/2. TLS is used when the backend enables it,
+// in which case HTTP/2 is negotiated unless the backend's params offer other
+// protocols; otherwise HTTP/2 is used with prior knowledge.
+func (s *Service) dialStream(cxt context.Context, b route.Backend, addr string) (net.Conn, error) {
+  conf, err := tlsconfig.Client(b.Params, addr)
+  if err != nil {
+    return nil, err
+  }
+  d := &net.Dialer{Timeout:s.cto}
+  n, a := route.SplitNetwork(addr)
+  p, err := d.DialContext(cxt, n, a)
+  if err != nil {
+    return nil, err
+  }
+  if conf == nil {
+    return p, nil
+  }
+  
+  if len(conf.NextProtos) == 0 {
+    conf = conf.Clone()
+    conf.NextProtos = []string{http2.NextProtoTLS}
+  }
+  if s.cto > 0 {
+    p.SetDeadline(time.Now().Add(s.cto))
+  }
+  x := tls.Client(p, conf)
+  if err := x.Handshake(); err != nil {
+    p.Close()
+    return nil, err
+  }
+  p.SetDeadline(time.Time{})
+  return x, nil
+}
+
+// A reader which records the bytes read through it as transferred
+type meteredReader struct {
+  r     io.Reader
+  s     *Service
+  xfer  metrics.Meter
+}
+
+func (r *meteredReader) Read(b []byte) (int, error) {
+  n, err := r.r.Read(b)
+  r.xfer.Mark(int64(n))
+  atomic.AddInt64(&r.s.handlerXfer, int64(n))
+  return n, err
+}
@@ -0,0 +1,426 @@
+package service
+
+import (
+  "io"
+  "fmt"
+  "net"
+  "time"
+  "bufio"
+  "strings"
+  "net/http"
+  "sync/atomic"
+)
+
+import (
+  "golang.org/x/net/trace"
+  "github.com/bww/go-alert"
+  "github.com/bww/go-util/debug"
+  "github.com/rcrowley/go-metrics"
+)
+
+// Headers which apply to a single connection and are not forwarded
+var hopHeaders = []string{
+  "Connection",
+  "Proxy-Connection",
+  "Keep-Alive",
+  "Proxy-Authenticate",
+  "Proxy-Authorization",
+  "Te",
+  "Trailer",
+  "Transfer-Encoding",
+  "Upgrade",
+}
+
+var (
+  httpRequestRate metrics.Meter
+  httpRequestError metrics.Meter
+  httpRequestTimer metrics.Timer
+)
+
+func init() {
+  httpRequestRate = metrics.NewMeter()
+  metrics.Register("percolator.http.request.rate", httpRequestRate)
+  httpRequestError = metrics.NewMeter()
+  metrics.Register("percolator.http.request.error", httpRequestError)
+  httpRequestTimer = metrics.NewTimer()
+  metrics.Register("percolator.http.request.latency", httpRequestTimer)
+}
+
+// Serve HTTP requests from a client until it closes the connection. Each
+// request is routed to the frontend whose route best matches its host and
+// path and is proxied over its own backend connection. Once the done channel
+// is closed the connection is closed as soon as it is idle.
+func (s *Service) serveHTTP(fs []*frontend, done <-chan struct{}, c net.Conn, caddr string, secure bool) {
+  defer c.Close()
+  
+  if debug.VERBOSE {
+    alt.Debugf("%v: Accepted HTTP connection", c.RemoteAddr())
+  }
+  
+  // interrupt the wait for the next request if the server stops while the
+  // connection is idle
+  var idle int32
+  stop := make(chan struct{})
+  defer close(stop)
+  go func() {
+    select {
+      case <- done:
+        if atomic.LoadInt32(&idle) == 1 {
+          c.SetReadDeadline(time.Now())
+        }
+      case <- stop:
+    }
+  }()
+  
+  r := getReader(c)
+  defer putReader(r)
+  for {
+    atomic.StoreInt32(&idle, 1)
+    select {
+      case <- done:
+        return
+      default:
+    }
+    if s.rto > 0 {
+      c.SetReadDeadline(time.Now().Add(s.rto))
+    }
+    _, err := r.Peek(1)
+    atomic.StoreInt32(&idle, 0)
+    var req *http.Request
+    if err == nil {
+      req, err = http.ReadRequest(r) // the whole header is read within the timeout
+    }
+    if err == nil {
+      c.SetReadDeadline(time.Time{})
+    }
+    if err != nil {
+      if err != io.EOF && !isTimeout(err) {
+        httpRequestError.Mark(1)
+        if debug.VERBOSE {
+          alt.Debugf("service: %v: Could not read request: %v", c.RemoteAddr(), err)
+        }
+      }
+      return
+    }
+    if !s.serveRequest(fs, done, c, r, req, caddr, secure) {
+      return
+    }
+  }
+}
+
+// Proxy a single request and its response. Returns whether the client
+// connection may be used for another request.
+func (s *Service) serveRequest(fs []*frontend, done <-chan struct{}, c net.Conn, cr *bufio.Reader, req *http.Request, caddr string, secure bool) bool {
+  start := time.Now()
+  httpRequestRate.Mark(1)
+  
+  host := req.Host
+  if h, _, err := net.SplitHostPort(host); err == nil {
+    host = h
+  }
+  f := selectRequestFrontend(fs, host, req.URL.Path)
+  
+  var tr trace.Trace
+  if s.debug {
+    var b string
+    if f == nil {
+      b = "<none>"
+    }else if f.route.Service {
+      b = f.route.Any().String()
+    }else{
+      b = "<next>"
+    }
+    tr = trace.New("perc.Service", fmt.Sprintf("%v -> %v", caddr, b))
+    defer tr.Finish()
+    tr.LazyPrintf("%v: %v %v%v", c.RemoteAddr(), req.Method, req.Host, req.URL.RequestURI())
+  }
+  
+  atomic.AddInt64(&s.handlerOpen, 1)
+  atomic.AddInt64(&s.handlerTotal, 1)
+  defer atomic.AddInt64(&s.handlerOpen, -1)
+  
+  if f == nil {
+    httpRequestError.Mark(1)
+    if debug.VERBOSE {
+      alt.Debugf("service: %v: No route for request: %v%v", c.RemoteAddr(), req.Host, req.URL.Path)
+    }
+    if tr != nil {
+      tr.LazyPrintf("No route for request")
+      tr.SetError()
+    }
+    writeStatus(c, http.StatusNotFound)
+    return false
+  }
+  r := f.route
+  
+  if !s.permit(f, caddr) {
+    httpRequestError.Mark(1)
+    if tr != nil {
+      tr.LazyPrintf("Client denied by access control")
+      tr.SetError()
+    }
+    writeStatus(c, http.StatusForbidden)
+    return false
+  }
+  if !s.throttle(r, caddr, done) {
+    httpRequestError.Mark(1)
+    if debug.VERBOSE {
+      alt.Debugf("service: %v: Rejected request; client exceeded the rate limit for route: %v", c.RemoteAddr(), r.Key())
+    }
+    if tr != nil {
+      tr.LazyPrintf("Client exceeded the rate limit")
+      tr.SetError()
+    }
+    writeStatus(c, http.StatusTooManyRequests)
+    return false
+  }
+  
+  x, ok := s.limits.Admit(r, done, true)
+  if !ok {
+    httpRequestError.Mark(1)
+    if debug.VERBOSE {
+      alt.Debugf("service: %v: Rejected request; route is at its connection limit: %v", c.RemoteAddr(), r.Key())
+    }
+    if tr != nil {
+      tr.LazyPrintf("Route is at its connection limit")
+      tr.SetError()
+    }
+    writeStatus(c, http.StatusServiceUnavailable)
+    return false
+  }
+  defer x.Release()
+  
+  p, t, err := s.open(r, c, caddr, tr)
+  if err == ErrBackendsFull || err == ErrUnavailable {
+    httpRequestError.Mark(1)
+    writeStatus(c, http.StatusServiceUnavailable)
+    return false
+  }else if err != nil {
+    httpRequestError.Mark(1)
+    writeStatus(c, http.StatusBadGateway)
+    return false
+  }
+  defer p.Close()
+  defer s.limits.Unreserve(t.addr)
+  
+  balancer := r.Balancer()
+  balancer.Acquire(t.addr)
+  defer balancer.Release(t.addr)
+  
+  // each request has its own backend connection, so the client's preference
+  // only determines whether its connection is kept alive
+  keepalive := !req.Close
+  select {
+    case <- done:
+      keepalive = false
+    default:
+  }
+  upgrade := upgradeProtocol(req.Header)
+  removeHopHeaders(req.Header)
+  if upgrade != "" {
+    req.Header.Set("Connection", "Upgrade")
+    req.Header.Set("Upgrade", upgrade)
+  }else{
+    req.Close = true
+  }
+  if _, ok := req.Header["User-Agent"]; !ok {
+    req.Header.Set("User-Agent", "") // don't add the default user agent
+  }
+  forwarded(req, caddr, secure)
+  
+  // bodies are streamed between the client and backend with the same read and
+  // write timeouts as any other connection; the backend must also begin
+  // responding within the read timeout
+  if req.Body != nil && req.Body != http.NoBody {
+    cd := newDeadlines(c, s.rto, 0)
+    req.Body = &deadlineReader{req.Body, &cd}
+  }
+  wd := newDeadlines(p, 0, s.wto)
+  err = req.Write(&meteredWriter{p, s, proxyBytesWriteRate, &wd})
+  if err != nil {
+    s.requestError(c, t, tr, "Could not write request", err)
+    return false
+  }
+  if s.rto > 0 {
+    p.SetReadDeadline(time.Now().Add(s.rto))
+  }
+  pr := getReader(p)
+  defer putReader(pr)
+  rsp, err := http.ReadResponse(pr, req)
+  if err != nil {
+    s.requestError(c, t, tr, "Could not read response", err)
+    return false
+  }
+  defer rsp.Body.Close()
+  if rsp.Body != http.NoBody {
+    pd := newDeadlines(p, s.rto, 0)
+    rsp.Body = &deadlineReader{rsp.Body, &pd}
+  }
+  
+  switched := rsp.StatusCode == http.StatusSwitchingProtocols
+  if !switched {
+    removeHopHeaders(rsp.Header)
+    if rsp.ContentLength < 0 && !chunked(rsp.TransferEncoding) {
+      keepalive = false // the body is delimited by the backend closing its connection
+    }
+    rsp.Close = !keepalive
+  }
+  
+  cd := newDeadlines(c, 0, s.wto)
+  err = rsp.Write(&meteredWriter{c, s, proxyBytesReadRate, &cd})
+  c.SetWriteDeadline(time.Time{})
+  if err != nil {
+    proxyXferError.Mark(1)
+    if debug.VERBOSE {
+      alt.Debugf("service: %v -> %v (%v): Could not proxy response: %v", c.RemoteAddr(), t.addr, t.backend, err)
+    }
+    if tr != nil {
+      tr.LazyPrintf("%v -> %v (%v): Could not proxy response: %v", c.RemoteAddr(), t.addr, t.backend, err)
+      tr.SetError()
+    }
+    return false
+  }
+  
+  httpRequestTimer.Update(time.Since(start))
+  if debug.VERBOSE {
+    alt.Debugf("%v: Request complete: %v (%v): %v", c.RemoteAddr(), t.addr, t.backend, rsp.Status)
+  }
+  if tr != nil {
+    tr.LazyPrintf("%v: Request complete: %v (%v): %v", c.RemoteAddr(), t.addr, t.backend, rsp.Status)
+  }
+  if !switched {
+    return keepalive
+  }
+  
+  // the connection has switched protocols; proxy it as a stream, replaying
+  // anything either side has already buffered
+  c.SetDeadline(time.Time{})
+  p.SetDeadline(time.Time{})
+  err = s.proxy(&peekedConn{c, cr}, &peekedConn{p, pr}, r.BufferSize(), tr)
+  if err != nil {
+    proxyXferError.Mark(1)
+    if debug.VERBOSE {
+      alt.Debugf("service: %v -> %v (%v): Could not proxy: %v\n", c.RemoteAddr(), t.addr, t.backend, err)
+    }
+    if tr != nil {
+      tr.LazyPrintf("%v -> %v (%v): Could not proxy: %v\n", c.RemoteAddr(), t.addr, t.backend, err)
+      tr.SetError()
+    }
+  }
+  return false
+}
+
+// Report a failure to proxy a request to a backend and respond to the client
+func (s *Service) requestError(c net.Conn, t target, tr trace.Trace, msg string, err error) {
+  httpRequestError.Mark(1)
+  if debug.VERBOSE {
+    alt.Debugf("service: %v -> %v (%v): %s: %v", c.RemoteAddr(), t.addr, t.backend, msg, err)
+  }
+  if tr != nil {
+    tr.LazyPrintf("%v -> %v (%v): %s: %v", c.RemoteAddr(), t.addr, t.backend, msg, err)
+    tr.SetError()
+  }
+  writeStatus(c, http.StatusBadGateway)
+}
+
+// Select the frontend which handles a request. The frontend whose route
+// matches the request most specifically is selected; if none match, nil is
+// returned.
+func selectRequestFrontend(f []*frontend, host, path string) *frontend {
+  var m *frontend
+  var n int
+  for _, e := range f {
+    if v := e.route.MatchRequest(host, path); v > n {
+      m, n = e, v
+    }
+  }
+  return m
+}
+
+// Describe the client a request is forwarded for
+func forwarded(req *http.Request, caddr string, secure bool) {
+  if v := req.Header.Get("X-Forwarded-For"); v != "" {
+    req.Header.Set("X-Forwarded-For", v +", "+ caddr)
+  }else{
+    req.Header.Set("X-Forwarded-For", caddr)
+  }
+  if secure {
+    req.Header.Set("X-Forwarded-Proto", "https")
+  }else{
+    req.Header.Set("X-Forwarded-Proto", "http")
+  }
+}
+
+// Obtain the protocol a request asks to upgrade to, if any
+func upgradeProtocol(h http.Header) string {
+  for _, e := range h["Connection"] {
+    for _, v := range strings.Split(e, ",") {
+      if strings.EqualFold(strings.TrimSpace(v), "upgrade") {
+        return h.Get("Upgrade")
+      }
+    }
+  }
+  return ""
+}
+
+// Remove hop-by-hop headers, including any named by the Connection header
+func removeHopHeaders(h http.Header) {
+  for _, e := range h["Connection"] {
+    for _, v := range strings.Split(e, ",") {
+      if v = strings.TrimSpace(v); v != "" {
+        h.Del(v)
+      }
+    }
+  }
+  for _, e := range hopHeaders {
+    h.Del(e)
+  }
+}
+
+// Determine whether an error is a timeout
+func isTimeout(err error) bool {
+  n, ok := err.(net.Error)
+  return ok && n.Timeout()
+}
+
+// Determine whether a message is chunked
+func chunked(te []string) bool {
+  return len(te) > 0 && te[0] == "chunked"
+}
+
+// Write a response with no content other than its status and close the
+// connection it is written to
+func writeStatus(w io.Writer, code int) {
+  text := http.StatusText(code)
+  fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s\n", code, text, len(text) + 1, text)
+}
+
+// A message body which extends the deadlines of the connection it is read
+// from before each read
+type deadlineReader struct {
+  io.ReadCloser
+  deadlines *deadlines
+}
+
+func (r *deadlineReader) Read(b []byte) (int, error) {
+  r.deadlines.Extend()
+  return r.ReadCloser.Read(b)
+}
+
+// A writer which records the bytes written through it as transferred
+type meteredWriter struct {
+  w         io.Writer
+  s         *Service
+  xfer      metrics.Meter
+  deadlines *deadlines // extended before each write, if provided
+}
+
+func (w *meteredWriter) Write(b []byte) (int, error) {
+  if w.deadlines != nil {
+    w.deadlines.Extend()
+  }
+  n, err := w.w.Write(b)
+  w.xfer.Mark(int64(n))
+  atomic.AddInt64(&w.s.handlerXfer, int64(n))
+  return n, err
+}
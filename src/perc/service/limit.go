@@ -0,0 +1,227 @@
+package service
+
+import (
+  "fmt"
+  "sync"
+  "time"
+  "sync/atomic"
+  
+  "perc/route"
+)
+
+import (
+  "github.com/rcrowley/go-metrics"
+)
+
+var (
+  ErrBackendsFull = fmt.Errorf("Every backend is at its connection limit")
+)
+
+var (
+  proxyConnReject metrics.Meter
+)
+
+func init() {
+  proxyConnReject = metrics.NewMeter()
+  metrics.Register("percolator.proxy.conn.reject", proxyConnReject)
+}
+
+// Connection limit stats
+type LimitStats struct {
+  Queued            int64             `json:"queued"`
+  Rejected          int64             `json:"rejected"`
+  RejectedByRoute   map[string]int64  `json:"rejected_by_route"`
+  RejectedByBackend map[string]int64  `json:"rejected_by_backend"`
+}
+
+// A limiter bounds how many of something may be held at once. A nil limiter
+// is unlimited.
+type limiter struct {
+  slots chan struct{}
+}
+
+// Create a limiter
+func newLimiter(n int) *limiter {
+  return &limiter{make(chan struct{}, n)}
+}
+
+// Acquire a slot, waiting up to the timeout for one to be released. Returns
+// false if no slot became available or the done channel was closed first.
+func (l *limiter) Acquire(timeout time.Duration, done <-chan struct{}) bool {
+  if l == nil {
+    return true
+  }
+  select {
+    case l.slots <- struct{}{}:
+      return true
+    default:
+  }
+  if timeout <= 0 {
+    return false
+  }
+  t := time.NewTimer(timeout)
+  defer t.Stop()
+  select {
+    case l.slots <- struct{}{}:
+      return true
+    case <- t.C:
+      return false
+    case <- done:
+      return false
+  }
+}
+
+// Release a slot
+func (l *limiter) Release() {
+  if l != nil {
+    <- l.slots
+  }
+}
+
+// The connection limits of a service. Accepted connections are limited
+// globally, the connections each route handles are limited by its listener
+// params, and the connections to each backend address are limited by its
+// backend params.
+type limits struct {
+  sync.Mutex
+  global    *limiter
+  queue     time.Duration
+  routes    map[string]*limiter
+  backends  map[string]int
+  queued    int64
+  rejected  int64
+  rejectedByRoute   map[string]int64
+  rejectedByBackend map[string]int64
+}
+
+// Create limits. A global limit of zero is unlimited; the queue timeout is
+// how long connections wait for a slot when a limit is reached.
+func newLimits(max int, queue time.Duration) *limits {
+  l := &limits{queue:queue, routes:make(map[string]*limiter), backends:make(map[string]int), rejectedByRoute:make(map[string]int64), rejectedByBackend:make(map[string]int64)}
+  if max > 0 {
+    l.global = newLimiter(max)
+  }
+  return l
+}
+
+// Admit a connection accepted by the service, waiting for the global limit if
+// necessary. The returned limiter must be released when the connection is
+// closed.
+func (l *limits) Accept(done <-chan struct{}) (*limiter, bool) {
+  if !l.wait(l.global, l.queue, done) {
+    atomic.AddInt64(&l.rejected, 1)
+    proxyConnReject.Mark(1)
+    return nil, false
+  }
+  return l.global, true
+}
+
+// Admit a connection, request, stream, or flow to a route, waiting for the
+// route's limit if necessary and the caller can queue. The returned limiter
+// must be released when it ends.
+func (l *limits) Admit(r *route.Route, done <-chan struct{}, queue bool) (*limiter, bool) {
+  x := l.route(r)
+  timeout := l.queue
+  if v, ok := r.QueueTimeout(); ok {
+    timeout = v
+  }
+  if !queue {
+    timeout = 0
+  }
+  if !l.wait(x, timeout, done) {
+    l.Lock()
+    l.rejectedByRoute[r.Key()]++
+    l.Unlock()
+    proxyConnReject.Mark(1)
+    return nil, false
+  }
+  return x, true
+}
+
+// Reserve a connection to a backend address. Returns false if the address is
+// at its backend's limit.
+func (l *limits) Reserve(addr string, b route.Backend) bool {
+  l.Lock()
+  defer l.Unlock()
+  if n := b.MaxConns(); n > 0 && l.backends[addr] >= n {
+    l.rejectedByBackend[addr]++
+    proxyConnReject.Mark(1)
+    return false
+  }
+  l.backends[addr]++
+  return true
+}
+
+// Release a connection to a backend address
+func (l *limits) Unreserve(addr string) {
+  l.Lock()
+  defer l.Unlock()
+  if n := l.backends[addr] - 1; n > 0 {
+    l.backends[addr] = n
+  }else{
+    delete(l.backends, addr)
+  }
+}
+
+// Discard the limiters for routes which are no longer served
+func (l *limits) Retain(routes []*route.Route) {
+  keep := make(map[string]struct{})
+  for _, r := range routes {
+    keep[r.Key()] = struct{}{}
+  }
+  l.Lock()
+  defer l.Unlock()
+  for k := range l.routes {
+    if _, ok := keep[k]; !ok {
+      delete(l.routes, k)
+    }
+  }
+}
+
+// Obtain limit stats
+func (l *limits) Stats() LimitStats {
+  l.Lock()
+  defer l.Unlock()
+  s := LimitStats{
+    Queued: atomic.LoadInt64(&l.queued),
+    Rejected: atomic.LoadInt64(&l.rejected),
+    RejectedByRoute: make(map[string]int64),
+    RejectedByBackend: make(map[string]int64),
+  }
+  for k, v := range l.rejectedByRoute {
+    s.RejectedByRoute[k] = v
+  }
+  for k, v := range l.rejectedByBackend {
+    s.RejectedByBackend[k] = v
+  }
+  return s
+}
+
+// Wait for a slot, counting the connections which are waiting
+func (l *limits) wait(x *limiter, timeout time.Duration, done <-chan struct{}) bool {
+  if x == nil {
+    return true
+  }
+  atomic.AddInt64(&l.queued, 1)
+  defer atomic.AddInt64(&l.queued, -1)
+  return x.Acquire(timeout, done)
+}
+
+// Obtain the limiter for a route. When a route's limit changes it is given a
+// new limiter; connections admitted by the old one release it as they end.
+func (l *limits) route(r *route.Route) *limiter {
+  n := r.MaxConns()
+  k := r.Key()
+  l.Lock()
+  defer l.Unlock()
+  if n < 1 {
+    delete(l.routes, k)
+    return nil
+  }
+  if x, ok := l.routes[k]; ok && cap(x.slots) == n {
+    return x
+  }
+  x := newLimiter(n)
+  l.routes[k] = x
+  return x
+}
@@ -0,0 +1,347 @@
+package service
+
+import (
+  "net"
+  "sync"
+  "time"
+  
+  "perc/route"
+)
+
+import (
+  "github.com/bww/go-alert"
+  "github.com/bww/go-util/debug"
+  "github.com/rcrowley/go-metrics"
+)
+
+// Idle pooled connections are checked at least this often, but no more often
+// than the minimum
+const (
+  poolSweep     = 10 * time.Second
+  poolSweepMin  = 250 * time.Millisecond
+)
+
+// Pools for discovered service providers are closed after going unused for
+// this long, since the provider may no longer exist
+const poolUnused = 10 * time.Minute
+
+var (
+  proxyPoolHit  metrics.Meter
+  proxyPoolMiss metrics.Meter
+)
+
+func init() {
+  proxyPoolHit = metrics.NewMeter()
+  metrics.Register("percolator.proxy.pool.hit", proxyPoolHit)
+  proxyPoolMiss = metrics.NewMeter()
+  metrics.Register("percolator.proxy.pool.miss", proxyPoolMiss)
+}
+
+// Backend connection pool stats
+type PoolStats struct {
+  Idle    int   `json:"idle"`
+  Hits    int64 `json:"hits"`
+  Misses  int64 `json:"misses"`
+  Expired int64 `json:"expired"`
+}
+
+// Identifies the pool for a target. Backends with the same address but
+// different params, like TLS configuration, have separate pools.
+type poolKey struct {
+  backend string
+  addr    string
+}
+
+// Pools of idle connections to backends which have been established ahead of
+// time, so clients can be handed a ready connection rather than waiting for
+// one to be dialed. Pools for static backends are filled when their routes are
+// loaded; pools for discovered service providers are filled once a client
+// first connects to them.
+type pools struct {
+  sync.Mutex
+  s       *Service
+  pools   map[poolKey]*connPool
+  closed  bool
+}
+
+// Create pools for a service
+func newPools(s *Service) *pools {
+  return &pools{s:s, pools:make(map[poolKey]*connPool)}
+}
+
+// Obtain an idle connection to a target from its pool. If the target's
+// backend does not pool connections, or none are idle, nil is returned.
+func (p *pools) Get(t target) net.Conn {
+  conf, ok := t.backend.Pool()
+  if !ok {
+    return nil
+  }
+  k := poolKey{t.backend.Detail(), t.addr}
+  p.Lock()
+  if p.closed {
+    p.Unlock()
+    return nil
+  }
+  x, ok := p.pools[k]
+  if !ok || x.Closed() {
+    x = p.s.newConnPool(t, conf, t.addr != t.backend.Addr)
+    p.pools[k] = x
+  }
+  p.Unlock()
+  return x.Get()
+}
+
+// Fill the pools for the static backends of routes which pool connections
+// and close the pools for backends which are no longer used by any route
+func (p *pools) Retain(routes []*route.Route) {
+  keep := make(map[string]struct{})
+  p.Lock()
+  defer p.Unlock()
+  if p.closed {
+    return
+  }
+  for _, r := range routes {
+    for _, b := range r.Backends {
+      conf, ok := b.Pool()
+      if !ok {
+        continue
+      }
+      keep[b.Detail()] = struct{}{}
+      if r.Service {
+        continue
+      }
+      k := poolKey{b.Detail(), b.Addr}
+      if x, ok := p.pools[k]; !ok || x.Closed() {
+        p.pools[k] = p.s.newConnPool(target{b, b.Addr}, conf, false)
+      }
+    }
+  }
+  for k, x := range p.pools {
+    if _, ok := keep[k.backend]; !ok {
+      x.Close()
+      delete(p.pools, k)
+    }
+  }
+}
+
+// Close every pool and its idle connections
+func (p *pools) Close() {
+  p.Lock()
+  defer p.Unlock()
+  p.closed = true
+  for k, x := range p.pools {
+    x.Close()
+    delete(p.pools, k)
+  }
+}
+
+// Obtain pool stats, by backend address
+func (p *pools) Stats() map[string]PoolStats {
+  p.Lock()
+  defer p.Unlock()
+  s := make(map[string]PoolStats)
+  for k, x := range p.pools {
+    v := x.Stats()
+    c := s[k.addr]
+    c.Idle += v.Idle
+    c.Hits += v.Hits
+    c.Misses += v.Misses
+    c.Expired += v.Expired
+    s[k.addr] = c
+  }
+  return s
+}
+
+// An idle connection and when it became idle
+type idleConn struct {
+  conn  net.Conn
+  since time.Time
+}
+
+// A pool of idle connections to a single target. The pool aims to keep a
+// number of connections idle between its minimum and maximum size: each time a
+// client finds it empty that number grows, and each time a connection expires
+// unused it shrinks. Connections are dialed in the background; if dialing
+// fails the pool is not refilled again until it is next swept.
+type connPool struct {
+  sync.Mutex
+  s         *Service
+  target    target
+  conf      route.Pool
+  demand    bool
+  idle      []idleConn
+  size      int
+  dialing   int
+  failed    bool
+  closed    bool
+  used      time.Time
+  hits      int64
+  misses    int64
+  expired   int64
+  done      chan struct{}
+}
+
+// Create and begin filling a pool for a target. A pool created on demand is
+// closed once it goes unused.
+func (s *Service) newConnPool(t target, conf route.Pool, demand bool) *connPool {
+  p := &connPool{s:s, target:t, conf:conf, demand:demand, size:conf.Min, used:time.Now(), done:make(chan struct{})}
+  p.Lock()
+  p.refill()
+  p.Unlock()
+  go p.sweep()
+  return p
+}
+
+// Take the most recently idle connection which is still open from the pool,
+// or nil if there are none
+func (p *connPool) Get() net.Conn {
+  p.Lock()
+  defer p.Unlock()
+  p.used = time.Now()
+  for n := len(p.idle); n > 0; n = len(p.idle) {
+    c := p.idle[n-1].conn
+    p.idle[n-1] = idleConn{}
+    p.idle = p.idle[:n-1]
+    if alive(c) {
+      p.hits++
+      proxyPoolHit.Mark(1)
+      p.refill()
+      return c
+    }
+    c.Close()
+  }
+  p.misses++
+  proxyPoolMiss.Mark(1)
+  if p.size < p.conf.Max {
+    p.size++
+  }
+  p.refill()
+  return nil
+}
+
+// Is the pool closed
+func (p *connPool) Closed() bool {
+  p.Lock()
+  defer p.Unlock()
+  return p.closed
+}
+
+// Close the pool and its idle connections
+func (p *connPool) Close() {
+  p.Lock()
+  defer p.Unlock()
+  p.close()
+}
+
+// Obtain stats for the pool
+func (p *connPool) Stats() PoolStats {
+  p.Lock()
+  defer p.Unlock()
+  return PoolStats{len(p.idle), p.hits, p.misses, p.expired}
+}
+
+// Close the pool. The pool must be locked.
+func (p *connPool) close() {
+  if p.closed {
+    return
+  }
+  p.closed = true
+  close(p.done)
+  for _, e := range p.idle {
+    e.conn.Close()
+  }
+  p.idle = nil
+}
+
+// Dial connections in the background until the pool will be full. The pool
+// must be locked.
+func (p *connPool) refill() {
+  if p.closed || p.failed {
+    return
+  }
+  for len(p.idle) + p.dialing < p.size {
+    p.dialing++
+    go p.fill()
+  }
+}
+
+// Dial a connection and add it to the pool
+func (p *connPool) fill() {
+  c, err := p.s.dial(nil, p.target, time.Time{}, nil)
+  if err != nil {
+    p.s.detector.Failure(p.target.addr, p.target.backend)
+  }else{
+    p.s.detector.Success(p.target.addr, p.target.backend)
+  }
+  
+  p.Lock()
+  defer p.Unlock()
+  p.dialing--
+  if err != nil {
+    p.failed = true
+    if debug.VERBOSE {
+      alt.Debugf("service: Could not fill pool for backend: %v (%v): %v", p.target.addr, p.target.backend, err)
+    }
+    return
+  }
+  if p.closed || len(p.idle) >= p.size {
+    c.Close()
+    return
+  }
+  p.idle = append(p.idle, idleConn{c, time.Now()})
+}
+
+// Periodically expire idle connections until the pool is closed
+func (p *connPool) sweep() {
+  d := p.conf.Idle / 4
+  if d > poolSweep {
+    d = poolSweep
+  }else if d < poolSweepMin {
+    d = poolSweepMin
+  }
+  t := time.NewTicker(d)
+  defer t.Stop()
+  for {
+    select {
+      case <- p.done:
+        return
+      case now := <- t.C:
+        p.expire(now)
+    }
+  }
+}
+
+// Close connections which have been idle too long or which the backend has
+// closed, shrinking the pool by as many down to its minimum size, and refill
+// it. A pool created on demand which has gone unused is closed instead.
+func (p *connPool) expire(now time.Time) {
+  p.Lock()
+  defer p.Unlock()
+  if p.closed {
+    return
+  }
+  if p.demand && now.Sub(p.used) > poolUnused {
+    p.close()
+    return
+  }
+  var n int
+  keep := p.idle[:0]
+  for _, e := range p.idle {
+    if now.Sub(e.since) < p.conf.Idle && alive(e.conn) {
+      keep = append(keep, e)
+    }else{
+      e.conn.Close()
+      n++
+    }
+  }
+  for i := len(keep); i < len(p.idle); i++ {
+    p.idle[i] = idleConn{}
+  }
+  p.idle = keep
+  p.expired += int64(n)
+  if p.size -= n; p.size < p.conf.Min {
+    p.size = p.conf.Min
+  }
+  p.failed = false
+  p.refill()
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package service
+
+import (
+  "net"
+)
+
+// Idle connections can't be checked on this platform, so they are assumed to
+// be open; a client handed one the backend has closed fails as it would if
+// the backend closed it while in use
+func alive(c net.Conn) bool {
+  return true
+}
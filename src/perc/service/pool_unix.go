@@ -0,0 +1,45 @@
+//go:build unix
+
+package service
+
+import (
+  "net"
+  "syscall"
+  "crypto/tls"
+)
+
+import (
+  "golang.org/x/sys/unix"
+)
+
+// Determine whether an idle connection is still open by peeking at its socket
+// without blocking. A connection the backend has closed reads EOF or fails;
+// one with nothing to read, or with data the backend has sent unprompted, is
+// still open and the data is left to be read.
+func alive(c net.Conn) bool {
+  if x, ok := c.(*tls.Conn); ok {
+    c = x.NetConn()
+  }
+  x, ok := c.(syscall.Conn)
+  if !ok {
+    return true
+  }
+  rc, err := x.SyscallConn()
+  if err != nil {
+    return false
+  }
+  var b [1]byte
+  var n int
+  var er error
+  err = rc.Read(func(fd uintptr) bool {
+    n, _, er = unix.Recvfrom(int(fd), b[:], unix.MSG_PEEK | unix.MSG_DONTWAIT)
+    return true // never wait
+  })
+  if err != nil {
+    return false
+  }
+  if er == unix.EAGAIN {
+    return true
+  }
+  return er == nil && n > 0
+}
@@ -0,0 +1,203 @@
+package service
+
+import (
+  "sort"
+  "sync"
+  "time"
+  
+  "perc/route"
+)
+
+import (
+  "github.com/rcrowley/go-metrics"
+)
+
+// Idle rate limit buckets and limited clients are swept at most this often
+const rateSweep = time.Minute
+
+// How long a client is reported after it was last limited
+const rateReport = time.Minute * 10
+
+// The most limited clients reported in stats
+const rateTopClients = 10
+
+var (
+  proxyRateLimited metrics.Meter
+  proxyRateDelayed metrics.Meter
+)
+
+func init() {
+  proxyRateLimited = metrics.NewMeter()
+  metrics.Register("percolator.proxy.rate.limited", proxyRateLimited)
+  proxyRateDelayed = metrics.NewMeter()
+  metrics.Register("percolator.proxy.rate.delayed", proxyRateDelayed)
+}
+
+// Rate limit stats
+type RateStats struct {
+  Limited     int64           `json:"limited"`
+  Delayed     int64           `json:"delayed"`
+  TopClients  []LimitedClient `json:"top_clients"`
+}
+
+// A client whose connections have been limited
+type LimitedClient struct {
+  Addr    string    `json:"addr"`
+  Limited int64     `json:"limited"`
+  Last    time.Time `json:"last"`
+}
+
+// A client's token bucket
+type bucket struct {
+  tokens  float64
+  last    time.Time
+  full    time.Time // when the bucket will be full again if it is not used
+}
+
+// Rate limits track a token bucket for each client of each limit, keyed by
+// the client address and, for route limits, the route.
+type rateLimits struct {
+  sync.Mutex
+  buckets map[string]*bucket
+  clients map[string]*LimitedClient
+  limited int64
+  delayed int64
+  swept   time.Time
+}
+
+// Create rate limits
+func newRateLimits() *rateLimits {
+  return &rateLimits{sync.Mutex{}, make(map[string]*bucket), make(map[string]*LimitedClient), 0, 0, time.Now()}
+}
+
+// Take a token for a connection from a client. If the client's bucket is
+// empty and a token will be available within the limit's delay, the token
+// is reserved and the caller waits for it, unless the done channel is closed
+// first. Returns false if the connection exceeds the limit and should be
+// closed.
+func (l *rateLimits) Wait(key, client string, limit route.RateLimit, done <-chan struct{}) bool {
+  wait, ok := l.reserve(key, client, limit)
+  if !ok {
+    proxyRateLimited.Mark(1)
+    return false
+  }
+  if wait <= 0 {
+    return true
+  }
+  proxyRateDelayed.Mark(1)
+  t := time.NewTimer(wait)
+  defer t.Stop()
+  select {
+    case <- t.C:
+      return true
+    case <- done:
+      return false
+  }
+}
+
+// Take or reserve a token, returning how long the caller must wait for it
+func (l *rateLimits) reserve(key, client string, limit route.RateLimit) (time.Duration, bool) {
+  l.Lock()
+  defer l.Unlock()
+  now := time.Now()
+  l.sweep(now)
+  
+  burst := float64(limit.Burst)
+  b, ok := l.buckets[key]
+  if !ok {
+    b = &bucket{tokens:burst, last:now}
+    l.buckets[key] = b
+  }else{
+    b.tokens += now.Sub(b.last).Seconds() * limit.Rate
+    if b.tokens > burst {
+      b.tokens = burst
+    }
+    b.last = now
+  }
+  
+  var wait time.Duration
+  if b.tokens < 1 {
+    wait = time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+    if wait > limit.Delay {
+      l.limited++
+      c, ok := l.clients[client]
+      if !ok {
+        c = &LimitedClient{Addr:client}
+        l.clients[client] = c
+      }
+      c.Limited++
+      c.Last = now
+      return 0, false
+    }
+    l.delayed++
+  }
+  b.tokens--
+  b.full = now.Add(time.Duration((burst - b.tokens) / limit.Rate * float64(time.Second)))
+  return wait, true
+}
+
+// Obtain rate limit stats, including the most limited clients
+func (l *rateLimits) Stats() RateStats {
+  l.Lock()
+  defer l.Unlock()
+  l.sweep(time.Now())
+  s := RateStats{Limited:l.limited, Delayed:l.delayed, TopClients:make([]LimitedClient, 0, len(l.clients))}
+  for _, e := range l.clients {
+    s.TopClients = append(s.TopClients, *e)
+  }
+  sort.Slice(s.TopClients, func(i, j int) bool {
+    if a, b := s.TopClients[i], s.TopClients[j]; a.Limited != b.Limited {
+      return a.Limited > b.Limited
+    }else{
+      return a.Addr < b.Addr
+    }
+  })
+  if len(s.TopClients) > rateTopClients {
+    s.TopClients = s.TopClients[:rateTopClients]
+  }
+  return s
+}
+
+// Remove buckets which have refilled and clients which have not been limited
+// recently. The limits must be locked.
+func (l *rateLimits) sweep(now time.Time) {
+  if now.Sub(l.swept) < rateSweep {
+    return
+  }
+  for k, e := range l.buckets {
+    if !now.Before(e.full) {
+      delete(l.buckets, k)
+    }
+  }
+  for k, e := range l.clients {
+    if now.Sub(e.Last) > rateReport {
+      delete(l.clients, k)
+    }
+  }
+  l.swept = now
+}
+
+// Apply the per-client rate limit of a route, or of the service if no route
+// is provided, to a connection from a client. Returns false if the connection
+// exceeds the limit and should be closed. If the done channel is nil the
+// connection is not delayed.
+func (s *Service) throttle(r *route.Route, caddr string, done <-chan struct{}) bool {
+  var key string
+  var limit route.RateLimit
+  if r == nil {
+    if s.rate.Rate <= 0 {
+      return true
+    }
+    key, limit = caddr, s.rate
+  }else{
+    var ok bool
+    if limit, ok = r.RateLimit(); !ok {
+      return true
+    }
+    key = r.Key() +"/"+ caddr
+  }
+  if done == nil {
+    limit.Delay = 0
+  }
+  return s.rates.Wait(key, caddr, limit, done)
+}
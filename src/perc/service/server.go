@@ -0,0 +1,209 @@
+package service
+
+import (
+  "fmt"
+  "net"
+  "sync"
+  "crypto/tls"
+  
+  "perc/route"
+  "perc/proxyproto"
+  "perc/tlsconfig"
+)
+
+import (
+  "golang.org/x/net/http2"
+)
+
+// A server accepts connections for the routes which share a listen address,
+// or datagrams for a UDP route. Its fields are guarded by the lock of the
+// service it belongs to.
+type server struct {
+  frontends []*frontend
+  listener  net.Listener
+  packets   net.PacketConn
+  handlers  sync.WaitGroup
+  closing   bool
+  done      chan struct{} // closed when the server stops accepting connections
+}
+
+// Open a server for the frontends which share a listen address
+func openServer(f []*frontend) (*server, error) {
+  r := f[0].route
+  e := &server{frontends:f, done:make(chan struct{})}
+  var err error
+  switch r.Network() {
+    case route.NetworkUDP:
+      e.packets, err = net.ListenPacket("udp", r.Addr())
+    case route.NetworkUnix:
+      e.listener, err = listenUnix(r)
+    default:
+      e.listener, err = net.Listen("tcp", r.Addr())
+  }
+  if err != nil {
+    return nil, err
+  }
+  return e, nil
+}
+
+// Obtain the address a server listens on
+func (e *server) Addr() net.Addr {
+  if e.packets != nil {
+    return e.packets.LocalAddr()
+  }
+  return e.listener.Addr()
+}
+
+// Close the server's listener
+func (e *server) Close() error {
+  if e.packets != nil {
+    return e.packets.Close()
+  }
+  return e.listener.Close()
+}
+
+// A frontend is the route a server handles connections with and the state
+// derived from its listener params, like TLS certificates. Frontends are
+// recreated whenever routes are reloaded, so changes to the files they load
+// are picked up.
+type frontend struct {
+  route     *route.Route
+  acceptor  *proxyproto.Acceptor
+  tls       *tls.Config
+  acl       *route.ACL
+}
+
+// Create a frontend for a route
+func newFrontend(r *route.Route) (*frontend, error) {
+  a, err := proxyproto.NewAcceptor(r.Network(), r.Params)
+  if err != nil {
+    return nil, fmt.Errorf("Invalid PROXY protocol for listener: %v: %v", r.Listen, err)
+  }
+  t, err := tlsconfig.Server(r.Params)
+  if err != nil {
+    return nil, fmt.Errorf("Invalid TLS for listener: %v: %v", r.Listen, err)
+  }
+  if t != nil && r.Mode() == route.ModeGRPC {
+    t.NextProtos = []string{http2.NextProtoTLS}
+  }
+  l, err := r.ACL()
+  if err != nil {
+    return nil, fmt.Errorf("Invalid access control for listener: %v: %v", r.Listen, err)
+  }
+  return &frontend{r, a, t, l}, nil
+}
+
+// Listener params which configure the listener itself rather than a route,
+// and which routes that share a listener must agree on
+var listenerParams = []string{
+  proxyproto.ParamProxyProtocol,
+  proxyproto.ParamProxyTrusted,
+  tlsconfig.ParamCert,
+  tlsconfig.ParamKey,
+  tlsconfig.ParamClientCA,
+  tlsconfig.ParamClientAuth,
+  tlsconfig.ParamMinVersion,
+  tlsconfig.ParamMaxVersion,
+  tlsconfig.ParamCiphers,
+}
+
+// Validate the frontends which share a listen address. Only routes selected
+// by server name or by request may share a listener, and since the listener
+// is shared they must agree on how the PROXY protocol is accepted and, for
+// routes selected by request, how TLS is terminated. Routes selected by server
+// name pass TLS through, so they cannot terminate it.
+func validateFrontends(f []*frontend) error {
+  for _, e := range f {
+    for _, b := range e.route.Backends {
+      if _, ok := b.Pool(); ok && anyParam(b.Params, proxyproto.ParamProxyProtocol) != "" {
+        return fmt.Errorf("Backend connections which send the PROXY protocol describe a single client and cannot be pooled: %v", b)
+      }
+    }
+  }
+  if r := f[0].route; r.Network() == route.NetworkUDP {
+    if len(f) > 1 {
+      return fmt.Errorf("Multiple routes listen on: %v", r.Listen)
+    }
+    if f[0].acceptor != nil || f[0].tls != nil {
+      return fmt.Errorf("Routes which listen on %v cannot accept the PROXY protocol or terminate TLS: %v", route.NetworkUDP, r.Listen)
+    }
+    for _, b := range r.Backends {
+      if k := anyParam(b.Params, proxyproto.ParamProxyProtocol, tlsconfig.ParamTLS, route.ParamPoolMin, route.ParamPoolMax); k != "" {
+        return fmt.Errorf("The %v param is not supported for backends of %v routes: %v", k, route.NetworkUDP, b)
+      }
+    }
+    return nil
+  }
+  if m := f[0].route.Mode(); f[0].route.PerRequest() {
+    for _, e := range f {
+      r := e.route
+      if r.Mode() != m {
+        return fmt.Errorf("Routes which share a listener must all use the %v mode: %v", m, r.Listen)
+      }
+      if m == route.ModeGRPC {
+        for _, b := range r.Backends {
+          if _, ok := b.Params[proxyproto.ParamProxyProtocol]; ok {
+            return fmt.Errorf("Backend connections are shared by %v routes and cannot send the PROXY protocol: %v", m, b)
+          }
+          if _, ok := b.Pool(); ok {
+            return fmt.Errorf("Backend connections are shared by %v routes and cannot be pooled: %v", m, b)
+          }
+        }
+      }
+      if k := disagree(r, f[0].route, listenerParams); k != "" {
+        return fmt.Errorf("Routes which share a listener must agree on the %v param: %v", k, r.Listen)
+      }
+    }
+    return nil
+  }
+  if len(f) < 2 && f[0].route.ServerName() == "" {
+    return nil
+  }
+  for _, e := range f {
+    r := e.route
+    if r.ServerName() == "" {
+      return fmt.Errorf("Multiple routes listen on: %v; routes which share a listener must set the %v param or use the %v or %v mode", r.Listen, route.ParamSNI, route.ModeHTTP, route.ModeGRPC)
+    }
+    if e.tls != nil {
+      return fmt.Errorf("Routes selected by server name cannot terminate TLS: %v", r.Key())
+    }
+    if k := disagree(r, f[0].route, listenerParams); k != "" {
+      return fmt.Errorf("Routes which share a listener must agree on the %v param: %v", k, r.Listen)
+    }
+  }
+  return nil
+}
+
+// Find the first of the named params which is set
+func anyParam(p map[string]string, names ...string) string {
+  for _, k := range names {
+    if _, ok := p[k]; ok {
+      return k
+    }
+  }
+  return ""
+}
+
+// Find the first of the named params two routes do not agree on
+func disagree(a, b *route.Route, names []string) string {
+  for _, k := range names {
+    if a.Params[k] != b.Params[k] {
+      return k
+    }
+  }
+  return ""
+}
+
+// Select the frontend which handles a connection requesting a server name.
+// The frontend whose route matches the name most specifically is selected; if
+// none match, nil is returned.
+func selectFrontend(f []*frontend, name string) *frontend {
+  var m *frontend
+  var n int
+  for _, e := range f {
+    if v := e.route.MatchServerName(name); v > n {
+      m, n = e, v
+    }
+  }
+  return m
+}
@@ -4,11 +4,17 @@ import (
   "io"
   "fmt"
   "net"
+  "sync"
   "time"
+  "context"
   "crypto/tls"
   "sync/atomic"
   
   "perc/route"
+  "perc/health"
+  "perc/outlier"
+  "perc/proxyproto"
+  "perc/tlsconfig"
   "perc/discovery"
 )
 
@@ -19,8 +25,24 @@ import (
   "github.com/rcrowley/go-metrics"
 )
 
-const (
-  paramTLS  = "tls"
+// The maximum number of providers considered for a service connection
+const maxProviders = 16
+
+// The default number of backends a connection is attempted with
+const DefaultDialAttempts = 3
+
+// How long a client has to complete a TLS handshake
+const handshakeTimeout = time.Second * 10
+
+// How long handlers are given to finish on shutdown once their connections
+// have been forcibly closed
+const closeTimeout = time.Second * 5
+
+var (
+  ErrShutdown = fmt.Errorf("Service is shut down")
+  ErrNoDiscovery = fmt.Errorf("Discovery not available")
+  ErrUnavailable = fmt.Errorf("Every backend is failing health checks or ejected")
+  errNoCloseWrite = proxyproto.ErrNoCloseWrite // shared so wrapped connections report it alike
 )
 
 var (
@@ -29,6 +51,10 @@ var (
   proxyResolveError metrics.Meter
   proxyLatencyTimer metrics.Timer
   proxyConnError metrics.Meter
+  proxyDialRetry metrics.Meter
+  proxyHeaderError metrics.Meter
+  proxyTLSError metrics.Meter
+  proxySNIError metrics.Meter
   proxyXferError metrics.Meter
   proxyBytesReadRate metrics.Meter
   proxyBytesWriteRate metrics.Meter
@@ -39,6 +65,14 @@ func init() {
   metrics.Register("percolator.proxy.conn.rate", proxyConnRate)
   proxyConnError = metrics.NewMeter()
   metrics.Register("percolator.proxy.conn.error", proxyConnError)
+  proxyDialRetry = metrics.NewMeter()
+  metrics.Register("percolator.proxy.dial.retry", proxyDialRetry)
+  proxyHeaderError = metrics.NewMeter()
+  metrics.Register("percolator.proxy.header.error", proxyHeaderError)
+  proxyTLSError = metrics.NewMeter()
+  metrics.Register("percolator.proxy.tls.error", proxyTLSError)
+  proxySNIError = metrics.NewMeter()
+  metrics.Register("percolator.proxy.sni.error", proxySNIError)
   proxyXferError = metrics.NewMeter()
   metrics.Register("percolator.proxy.xfer.error", proxyXferError)
   proxyResolveError = metrics.NewMeter()
@@ -55,11 +89,17 @@ func init() {
 
 // Service stats
 type Stats struct {
-  OpenConnections           int64             `json:"open_conns"`
-  TotalConnections          int64             `json:"total_conns"`
-  BytesTransferred          int64             `json:"bytes_xfer"`
-  TotalConnectionsByRoute   map[string]int64  `json:"total_conns_by_route"`
-  RunningWorkers            int64             `json:"io_workers"`
+  OpenConnections           int64                      `json:"open_conns"`
+  TotalConnections          int64                      `json:"total_conns"`
+  BytesTransferred          int64                      `json:"bytes_xfer"`
+  TotalConnectionsByRoute   map[string]int64           `json:"total_conns_by_route"`
+  RunningWorkers            int64                      `json:"io_workers"`
+  BackendHealth             map[string]health.Status   `json:"backend_health"`
+  BackendOutliers           map[string]outlier.Status  `json:"backend_outliers"`
+  Affinity                  AffinityStats              `json:"affinity"`
+  Limits                    LimitStats                 `json:"limits"`
+  RateLimits                RateStats                  `json:"rate_limits"`
+  BackendPools              map[string]PoolStats       `json:"backend_pools"`
 }
 
 // Service config
@@ -71,16 +111,31 @@ type Config struct {
   ConnTimeout   time.Duration
   ReadTimeout   time.Duration
   WriteTimeout  time.Duration
+  DrainTimeout  time.Duration
+  DialAttempts  int
+  DialBudget    time.Duration
+  MaxConns      int
+  QueueTimeout  time.Duration
+  RateLimit     float64
+  RateBurst     int
+  RateDelay     time.Duration
+  Optimize      bool
   Debug         bool
 }
 
 // An API service
 type Service struct {
+  sync.Mutex
   name            string
   instance        string
   discovery       discovery.Service
   routes          []*route.Route
   cto, rto, wto   time.Duration
+  dto             time.Duration
+  attempts        int
+  budget          time.Duration
+  rate            route.RateLimit
+  optimize        bool
   debug           bool
   //
   copyOpen        int64
@@ -89,15 +144,37 @@ type Service struct {
   handlerXfer     int64
   handlerByRoute  *cmap
   handlerUpdate   chan<- entry
+  checker         *health.Checker
+  detector        *outlier.Detector
+  affinity        *affinity
+  transports      *transports
+  limits          *limits
+  rates           *rateLimits
+  pools           *pools
+  //
+  servers         map[string]*server
+  conns           map[net.Conn]*server
+  handlers        sync.WaitGroup
+  closing         bool
+  done            chan struct{}
+  stop            sync.Once
 }
 
 // Create a new service
 func New(conf Config) *Service {
   m := newCmap()
-  return &Service{
-    conf.Name, conf.Instance, conf.Discovery, conf.Routes, conf.ConnTimeout, conf.ReadTimeout, conf.WriteTimeout, conf.Debug,
-    0, 0, 0, 0, m, m.Put(),
+  if conf.DialAttempts < 1 {
+    conf.DialAttempts = DefaultDialAttempts
   }
+  s := &Service{
+    sync.Mutex{},
+    conf.Name, conf.Instance, conf.Discovery, conf.Routes, conf.ConnTimeout, conf.ReadTimeout, conf.WriteTimeout, conf.DrainTimeout, conf.DialAttempts, conf.DialBudget, route.NewRateLimit(conf.RateLimit, conf.RateBurst, conf.RateDelay), conf.Optimize, conf.Debug,
+    0, 0, 0, 0, m, m.Put(), health.NewChecker(), outlier.NewDetector(), newAffinity(maxAffinity), nil, newLimits(conf.MaxConns, conf.QueueTimeout), newRateLimits(), nil,
+    make(map[string]*server), make(map[net.Conn]*server), sync.WaitGroup{}, false, make(chan struct{}), sync.Once{},
+  }
+  s.transports = newTransports(s)
+  s.pools = newPools(s)
+  return s
 }
 
 // How many connections are we currently handling
@@ -108,52 +185,442 @@ func (s *Service) Stats() Stats {
     BytesTransferred:atomic.LoadInt64(&s.handlerXfer),
     TotalConnectionsByRoute:s.handlerByRoute.Copy(),
     RunningWorkers:atomic.LoadInt64(&s.copyOpen),
+    BackendHealth:s.checker.Status(),
+    BackendOutliers:s.detector.Status(),
+    Affinity:s.affinity.Stats(),
+    Limits:s.limits.Stats(),
+    RateLimits:s.rates.Stats(),
+    BackendPools:s.pools.Stats(),
   }
 }
 
-// Handle requests forever
-func (s *Service) Run() error {
-  var err error
+// Obtain the routes currently being served
+func (s *Service) Routes() []*route.Route {
+  s.Lock()
+  defer s.Unlock()
+  r := make([]*route.Route, 0, len(s.servers))
+  for _, e := range s.servers {
+    for _, f := range e.frontends {
+      r = append(r, f.route)
+    }
+  }
+  return r
+}
+
+// Handle requests until the service is shut down, either by canceling the
+// provided context or by calling Shutdown. When the context is canceled open
+// connections are allowed to finish without a deadline before Run returns.
+func (s *Service) Run(cxt context.Context) error {
+  err := s.Reload(s.routes)
+  if err == ErrShutdown {
+    return nil
+  }else if err != nil {
+    return err
+  }
+  select {
+    case <- cxt.Done():
+      return s.Shutdown(context.Background())
+    case <- s.done:
+      return nil
+  }
+}
+
+// Replace the set of routes being served. Listeners are opened for routes
+// which are not currently served, routes which are no longer present stop
+// accepting connections and are drained in the background, and routes whose
+// backends have changed are updated in place without interrupting their
+// listeners. Listener state and backend TLS material, like certificates, are
+// reloaded for every route. If any route is invalid or any new listener cannot
+// be opened no changes are made.
+func (s *Service) Reload(routes []*route.Route) error {
+  s.Lock()
+  defer s.Unlock()
+  if s.closing {
+    return ErrShutdown
+  }
+  
+  // the routes currently being served, by key
+  current := make(map[string]*route.Route)
+  for _, e := range s.servers {
+    for _, f := range e.frontends {
+      current[f.route.Key()] = f.route
+    }
+  }
+  
+  tlsconfig.Reset() // reload certificates used to connect to backends
+  keys := make(map[string]struct{})
+  update := make(map[string][]*frontend)
+  var listen []string
+  for _, e := range routes {
+    if _, ok := keys[e.Key()]; ok {
+      return fmt.Errorf("Multiple routes listen on: %v", e.Key())
+    }
+    keys[e.Key()] = struct{}{}
+    for _, b := range e.Backends {
+      if err := health.Validate(b); err != nil {
+        return fmt.Errorf("Invalid health check for backend: %v: %v", b, err)
+      }
+      if err := outlier.Validate(b); err != nil {
+        return fmt.Errorf("Invalid outlier detection for backend: %v: %v", b, err)
+      }
+      if err := proxyproto.Validate(b); err != nil {
+        return fmt.Errorf("Invalid PROXY protocol for backend: %v: %v", b, err)
+      }
+      if err := tlsconfig.Validate(b); err != nil {
+        return fmt.Errorf("Invalid TLS for backend: %v: %v", b, err)
+      }
+    }
+    r := e
+    if x, ok := current[e.Key()]; ok && x.Equal(e) {
+      r = x // unchanged; keep its balancing state
+    }
+    f, err := newFrontend(r)
+    if err != nil {
+      return err
+    }
+    if _, ok := update[e.Listen]; !ok {
+      listen = append(listen, e.Listen)
+    }
+    update[e.Listen] = append(update[e.Listen], f)
+  }
+  for _, e := range listen {
+    if err := validateFrontends(update[e]); err != nil {
+      return err
+    }
+  }
   
-  l := make([]net.Listener, len(s.routes))
-  for i, e := range s.routes {
-    l[i], err = net.Listen("tcp", e.Listen)
+  var added []*server
+  for _, e := range listen {
+    if _, ok := s.servers[e]; ok {
+      continue
+    }
+    x, err := openServer(update[e])
     if err != nil {
+      for _, x := range added {
+        x.Close()
+      }
       return err
     }
+    added = append(added, x)
   }
   
-  errs := make(chan error)
-  for i, e := range l {
-    r := s.routes[i]
-    fmt.Printf("-----> Serving requests on: %s\n", r.Detail())
-    go func(r *route.Route, l net.Listener){
-      for {
-        conn, err := l.Accept()
-        if err != nil {
-          alt.Errorf("service: Could not accept: %v", err)
-          continue
-        }else{
-          proxyConnRate.Mark(1)
-          go s.handle(r, conn)
-        }
+  for k, e := range s.servers {
+    f, ok := update[k]
+    if !ok {
+      for _, x := range e.frontends {
+        fmt.Printf("-----> No longer serving requests on: %s\n", x.route.Detail())
+      }
+      delete(s.servers, k)
+      s.closeServer(e)
+      go s.drain(e, s.dto)
+      continue
+    }
+    for _, x := range f {
+      if r, ok := current[x.route.Key()]; !ok {
+        fmt.Printf("-----> Serving requests on: %s\n", x.route.Detail())
+      }else if r != x.route {
+        fmt.Printf("-----> Updated route: %s\n", x.route.Detail())
+      }
+      delete(current, x.route.Key())
+    }
+    for _, x := range e.frontends {
+      if _, ok := current[x.route.Key()]; ok {
+        fmt.Printf("-----> No longer serving requests on: %s\n", x.route.Detail())
+      }
+    }
+    e.frontends = f
+  }
+  for _, e := range added {
+    for _, x := range e.frontends {
+      fmt.Printf("-----> Serving requests on: %s\n", x.route.Detail())
+    }
+    s.servers[e.frontends[0].route.Listen] = e
+    go s.serve(e)
+  }
+  
+  s.checker.Routes(routes)
+  s.transports.Retain(routes)
+  s.limits.Retain(routes)
+  s.pools.Retain(routes)
+  return nil
+}
+
+// Stop accepting connections on every route and wait for open connections to
+// finish. If the context expires before they do, the remaining connections are
+// forcibly closed and the context's error is returned.
+func (s *Service) Shutdown(cxt context.Context) error {
+  s.Lock()
+  s.closing = true
+  for k, e := range s.servers {
+    delete(s.servers, k)
+    s.closeServer(e)
+  }
+  s.Unlock()
+  
+  var err error
+  w := waitChan(&s.handlers)
+  select {
+    case <- w:
+    case <- cxt.Done():
+      err = cxt.Err()
+      if n := s.closeConns(nil); n > 0 {
+        alt.Errorf("service: Forcibly closed %d connections on shutdown", n)
+      }
+      select {
+        case <- w:
+        case <- time.After(closeTimeout):
+          alt.Errorf("service: Handlers did not finish within %v of their connections being closed", closeTimeout)
       }
-    }(r, e)
   }
   
-  return <- errs
+  s.checker.Stop()
+  s.pools.Close()
+  s.stop.Do(func(){ close(s.done) })
+  return err
+}
+
+// Stop accepting connections for a server. The service must be locked.
+func (s *Service) closeServer(e *server) {
+  e.closing = true
+  close(e.done)
+  err := e.Close()
+  if err != nil {
+    alt.Errorf("service: Could not close listener: %v: %v", e.Addr(), err)
+  }
+}
+
+// Wait for the connections open on a server that is no longer accepting
+// connections to finish. After the timeout, if any, they are forcibly closed.
+func (s *Service) drain(e *server, timeout time.Duration) {
+  var expire <-chan time.Time
+  if timeout > 0 {
+    expire = time.After(timeout)
+  }
+  select {
+    case <- waitChan(&e.handlers):
+    case <- expire:
+      if n := s.closeConns(e); n > 0 {
+        alt.Errorf("service: Forcibly closed %d connections on removed listener: %v", n, e.Addr())
+      }
+  }
+}
+
+// Accept connections for a server until its listener is closed
+func (s *Service) serve(e *server) {
+  if e.packets != nil {
+    s.serveUDP(e)
+    return
+  }
+  for {
+    conn, err := e.listener.Accept()
+    if err != nil {
+      if s.isClosing(e) {
+        return
+      }
+      alt.Errorf("service: Could not accept: %v", err)
+      continue
+    }
+    // when the service is at its connection limit accepting waits for a
+    // connection to close, up to the queue timeout
+    x, ok := s.limits.Accept(e.done)
+    if !ok {
+      if debug.VERBOSE {
+        alt.Debugf("service: %v: Rejected connection; service is at its connection limit", conn.RemoteAddr())
+      }
+      conn.Close()
+      continue
+    }
+    f, ok := s.track(e, conn)
+    if !ok {
+      x.Release()
+      conn.Close()
+      return
+    }
+    proxyConnRate.Mark(1)
+    go func(){
+      defer x.Release()
+      defer s.release(conn)
+      s.handle(f, e.done, conn)
+    }()
+  }
+}
+
+// Is the server shutting down
+func (s *Service) isClosing(e *server) bool {
+  s.Lock()
+  defer s.Unlock()
+  return e.closing
+}
+
+// Begin tracking a client connection accepted by a server and obtain the
+// frontends it may be handled with. Returns false if the server is shutting
+// down and the connection should not be handled.
+func (s *Service) track(e *server, c net.Conn) ([]*frontend, bool) {
+  s.Lock()
+  defer s.Unlock()
+  if e.closing {
+    return nil, false
+  }
+  s.conns[c] = e
+  s.handlers.Add(1)
+  e.handlers.Add(1)
+  return e.frontends, true
+}
+
+// Stop tracking a client connection once it has been handled
+func (s *Service) release(c net.Conn) {
+  s.Lock()
+  e := s.conns[c]
+  delete(s.conns, c)
+  s.Unlock()
+  e.handlers.Done()
+  s.handlers.Done()
+}
+
+// Forcibly close the open client connections for a server, or for every
+// server if none is provided, and report how many there were
+func (s *Service) closeConns(e *server) int {
+  s.Lock()
+  defer s.Unlock()
+  var n int
+  for c, x := range s.conns {
+    if e == nil || e == x {
+      c.Close()
+      n++
+    }
+  }
+  return n
+}
+
+// Obtain a channel which is closed when the wait group is done
+func waitChan(w *sync.WaitGroup) <-chan struct{} {
+  c := make(chan struct{})
+  go func() {
+    w.Wait()
+    close(c)
+  }()
+  return c
 }
 
-// Handle a request for a particular route
-func (s *Service) handle(r *route.Route, c net.Conn) {
+// Handle a request for a particular route. The done channel is closed when
+// the server the connection was accepted by stops accepting connections.
+func (s *Service) handle(fs []*frontend, done <-chan struct{}, c net.Conn) {
   var p net.Conn
   var err error
+  f := fs[0]
+  
+  // when the route accepts the PROXY protocol the client address is the one
+  // described by the header rather than the peer's
+  if f.acceptor != nil {
+    x, err := f.acceptor.Accept(c)
+    if err != nil {
+      proxyHeaderError.Mark(1)
+      if debug.VERBOSE {
+        alt.Debugf("service: %v: Could not accept connection: %v", c.RemoteAddr(), err)
+      }
+      c.Close()
+      return
+    }
+    c = x
+  }
   
   var caddr string
+  var anon bool
   if h, _, err := net.SplitHostPort(c.RemoteAddr().String()); err == nil {
     caddr = h
   }else{
-    caddr = "<unknown>"
+    caddr, anon = "<unknown>", true
+  }
+  
+  // when routes are selected by server name, select one using the name in the
+  // client's ClientHello, which is replayed to the backend
+  if f.route.ServerName() != "" {
+    name, x, err := peekServerName(c, handshakeTimeout)
+    if err == nil {
+      c, f = x, selectFrontend(fs, name)
+      if f == nil {
+        err = fmt.Errorf("No route for server name: %q", name)
+      }
+    }
+    if err != nil {
+      proxySNIError.Mark(1)
+      if debug.VERBOSE {
+        alt.Debugf("service: %v: Could not select route: %v", c.RemoteAddr(), err)
+      }
+      c.Close()
+      return
+    }
+  }
+  r := f.route
+  
+  // access control is checked before any rate limit, so clients which are
+  // denied can't use up tokens other clients need. Clients of routes proxied
+  // per request are checked per request, so here they are only denied if no
+  // route on the listener permits them.
+  if r.PerRequest() {
+    if !s.permitAny(fs, caddr) {
+      c.Close()
+      return
+    }
+  }else if !s.permit(f, caddr) {
+    c.Close()
+    return
+  }
+  // clients without an address, like those of Unix sockets, would all share
+  // one per-client limit, so they are not limited
+  if !anon && !s.throttle(nil, caddr, done) {
+    if debug.VERBOSE {
+      alt.Debugf("service: %v: Rejected connection; client exceeded the rate limit", c.RemoteAddr())
+    }
+    c.Close()
+    return
+  }
+  
+  // clients of routes proxied per request are limited per request
+  if !r.PerRequest() {
+    if !s.throttle(r, caddr, done) {
+      if debug.VERBOSE {
+        alt.Debugf("service: %v: Rejected connection; client exceeded the rate limit for route: %v", c.RemoteAddr(), r.Key())
+      }
+      c.Close()
+      return
+    }
+    x, ok := s.limits.Admit(r, done, true)
+    if !ok {
+      if debug.VERBOSE {
+        alt.Debugf("service: %v: Rejected connection; route is at its connection limit: %v", c.RemoteAddr(), r.Key())
+      }
+      c.Close()
+      return
+    }
+    defer x.Release()
+  }
+  
+  // terminate TLS before anything else is done with the connection
+  if f.tls != nil {
+    x := tls.Server(c, f.tls)
+    c.SetDeadline(time.Now().Add(handshakeTimeout))
+    err := x.Handshake()
+    if err != nil {
+      proxyTLSError.Mark(1)
+      if debug.VERBOSE {
+        alt.Debugf("service: %v: Could not complete TLS handshake: %v", c.RemoteAddr(), err)
+      }
+      c.Close()
+      return
+    }
+    c.SetDeadline(time.Time{})
+    c = x
+  }
+  
+  // HTTP and gRPC routes are selected and proxied per request
+  switch r.Mode() {
+    case route.ModeHTTP:
+      s.serveHTTP(fs, done, c, caddr, f.tls != nil)
+      return
+    case route.ModeGRPC:
+      s.serveGRPC(fs, done, c, caddr, f.tls != nil)
+      return
   }
   
   var tr trace.Trace
@@ -202,127 +669,227 @@ func (s *Service) handle(r *route.Route, c net.Conn) {
     }
   }()
   
-  start := time.Now()
+  var t target
+  p, t, err = s.open(r, c, caddr, tr)
+  if err != nil {
+    return
+  }
+  defer s.limits.Unreserve(t.addr)
+  addr, backend := t.addr, t.backend
   
-  var addr string
-  var backend route.Backend
-  if r.Service {
-    if s.discovery == nil {
-      proxyResolveError.Mark(1)
-      if debug.VERBOSE {
-        alt.Errorf("service: Discovery not available")
-      }
-      if tr != nil {
-        tr.LazyPrintf("Discovery not available")
-        tr.SetError()
-      }
-      return
+  balancer := r.Balancer()
+  balancer.Acquire(addr)
+  defer balancer.Release(addr)
+  
+  err = s.proxy(c, p, r.BufferSize(), tr)
+  if err != nil {
+    proxyXferError.Mark(1)
+    if debug.VERBOSE {
+      alt.Debugf("service: %v -> %v (%v): Could not proxy: %v\n", c.RemoteAddr(), p.RemoteAddr(), backend, err)
     }
-    backend = r.Any()
-    addr, err = s.discovery.LookupProvider(backend.Addr)
-    if err != nil {
-      proxyResolveError.Mark(1)
-      if debug.VERBOSE {
-        alt.Errorf("service: Could not discover service: %v: %v", r.String(), err)
-      }
-      if tr != nil {
-        tr.LazyPrintf("Could not discover service: %v: %v", r.String(), err)
-        tr.SetError()
-      }
-      return
+    if tr != nil {
+      tr.LazyPrintf("%v -> %v (%v): Could not proxy: %v\n", c.RemoteAddr(), p.RemoteAddr(), backend, err)
+      tr.SetError()
     }
-    s.handlerUpdate <- entry{backend.String(), 1, caddr}
-  }else{
-    backend = r.Next()
-    addr = backend.Addr
-    s.handlerUpdate <- entry{addr, 1, caddr}
   }
   
-  proxyResolveTimer.Update(time.Since(start))
-  
   if debug.VERBOSE {
-    alt.Debugf("%v: Proxying to backend: %v (%v)", c.RemoteAddr(), addr, backend)
+    alt.Debugf("%v: Connection will end: %v (%v)", c.RemoteAddr(), addr, backend)
+  }
+  if tr != nil {
+    tr.LazyPrintf("%v: Connection will end: %v (%v)", c.RemoteAddr(), addr, backend)
   }
+}
+
+// Resolve the targets for a route and connect a client to one of them,
+// recording the outcome. Failures are logged and traced before they are
+// returned.
+func (s *Service) open(r *route.Route, c net.Conn, caddr string, tr trace.Trace) (net.Conn, target, error) {
+  start := time.Now()
   
+  targets, bound, err := s.resolve(r, caddr, tr)
+  if err != nil {
+    return nil, target{}, err
+  }
+  
+  proxyResolveTimer.Update(time.Since(start))
   start = time.Now()
   
-  d := &net.Dialer{Timeout:s.cto}
-  if name, ok := backend.Params[paramTLS]; ok {
+  p, t, err := s.connect(c, targets, tr)
+  if t.addr != "" {
+    s.count(r, t, caddr)
+  }
+  if err != nil {
+    proxyConnError.Mark(1)
+    if debug.VERBOSE {
+      alt.Debugf("service: %v: Could not connect to any backend: %v", c.RemoteAddr(), err)
+    }
     if tr != nil {
-      tr.LazyPrintf("%v: Proxying to backend: %v (%v) via TLS (SNI: %v)", c.RemoteAddr(), addr, backend, name)
+      tr.LazyPrintf("%v: Could not connect to any backend: %v", c.RemoteAddr(), err)
+      tr.SetError()
+    }
+    return nil, target{}, err
+  }
+  
+  proxyLatencyTimer.Update(time.Since(start))
+  s.bind(r, caddr, bound, t.addr)
+  return p, t, nil
+}
+
+// Resolve the targets a client of a route may be proxied to, in the order
+// they should be attempted, and the address the client is bound to by session
+// affinity, if any. Failures are logged and traced before they are returned.
+func (s *Service) resolve(r *route.Route, caddr string, tr trace.Trace) ([]target, string, error) {
+  if r.Service && s.discovery == nil {
+    proxyResolveError.Mark(1)
+    if debug.VERBOSE {
+      alt.Errorf("service: Discovery not available")
     }
-    p, err = tls.DialWithDialer(d, "tcp", addr, &tls.Config{ServerName:name})
-  }else{
     if tr != nil {
-      tr.LazyPrintf("%v: Proxying to backend: %v (%v)", c.RemoteAddr(), addr, backend)
+      tr.LazyPrintf("Discovery not available")
+      tr.SetError()
     }
-    p, err = d.Dial("tcp", addr)
+    return nil, "", ErrNoDiscovery
   }
+  
+  var bound string
+  if mode, _ := r.Affinity(); mode == route.AffinityClientIP {
+    bound, _ = s.affinity.Get(r.Key(), caddr)
+  }
+  
+  targets, err := s.targets(r, caddr, bound)
   if err != nil {
-    proxyConnError.Mark(1)
+    proxyResolveError.Mark(1)
     if debug.VERBOSE {
-      alt.Debugf("service: %v: Could not connect to backend: %v (%v): %v", c.RemoteAddr(), addr, backend, err)
+      alt.Errorf("service: Could not discover service: %v: %v", r.String(), err)
     }
     if tr != nil {
-      tr.LazyPrintf("%v: Could not connect to backend: %v (%v): %v", c.RemoteAddr(), addr, backend, err)
+      tr.LazyPrintf("Could not discover service: %v: %v", r.String(), err)
       tr.SetError()
     }
-    return
+    return nil, "", err
   }
   
-  proxyLatencyTimer.Update(time.Since(start))
-  
+  return targets, bound, nil
+}
+
+// Count a connection from a client to a route's target
+func (s *Service) count(r *route.Route, t target, caddr string) {
+  if r.Service {
+    s.handlerUpdate <- entry{t.backend.String(), 1, caddr}
+  }else{
+    s.handlerUpdate <- entry{t.addr, 1, caddr}
+  }
+}
+
+// Bind a client to the address it was proxied to when the route uses session
+// affinity, recording whether it was already bound there
+func (s *Service) bind(r *route.Route, caddr, bound, addr string) {
+  if mode, ttl := r.Affinity(); mode == route.AffinityClientIP {
+    s.affinity.Record(bound != "" && bound == addr)
+    s.affinity.Put(r.Key(), caddr, addr, ttl)
+  }
+}
+
+// Proxy data between a client and a backend connection until both directions
+// are finished. When one side finishes sending, the connection it was sending
+// to is closed for writing so its peer reads EOF, and the other direction
+// continues until it finishes too or times out. If a connection can't be
+// closed for writing both directions end. Data is copied through buffers of
+// the provided size. Returns the first error other than EOF, if any.
+func (s *Service) proxy(c, p net.Conn, size int, tr trace.Trace) error {
   rerrs := make(chan error, 1)
   werrs := make(chan error, 1)
   
-  go s.copyGeneric(c, p, tr, proxyBytesReadRate, rerrs)
-  go s.copyGeneric(p, c, tr, proxyBytesWriteRate, werrs)
+  go s.transfer(c, p, size, tr, proxyBytesReadRate, rerrs)
+  go s.transfer(p, c, size, tr, proxyBytesWriteRate, werrs)
   
-  var ok bool
-  select {
-    case err, ok = <- rerrs:
-    case err, ok = <- werrs:
-  }
-  if ok && err != io.EOF {
-    proxyXferError.Mark(1)
-    if debug.VERBOSE {
-      alt.Debugf("service: %v -> %v (%v): Could not proxy: %v\n", c.RemoteAddr(), p.RemoteAddr(), backend, err)
+  for rerrs != nil || werrs != nil {
+    var dst net.Conn
+    var err error
+    var ok bool
+    select {
+      case err, ok = <- rerrs:
+        rerrs, dst = nil, c
+      case err, ok = <- werrs:
+        werrs, dst = nil, p
+    }
+    if ok {
+      return err
+    }
+    if rerrs == nil && werrs == nil {
+      break
+    }
+    if err := closeWrite(dst); err != nil {
+      if debug.VERBOSE && err != errNoCloseWrite {
+        alt.Debugf("service: %v: Could not close for writing: %v", dst.RemoteAddr(), err)
+      }
+      return nil
     }
     if tr != nil {
-      tr.LazyPrintf("%v -> %v (%v): Could not proxy: %v\n", c.RemoteAddr(), p.RemoteAddr(), backend, err)
-      tr.SetError()
+      tr.LazyPrintf("%v: Closed for writing", dst.RemoteAddr())
+    }
+    if s.rto > 0 { // the direction still open reads from the half-closed connection
+      dst.SetReadDeadline(time.Now().Add(s.rto))
     }
   }
-  
-  if debug.VERBOSE {
-    alt.Debugf("%v: Connection will end: %v (%v)", c.RemoteAddr(), addr, backend)
+  return nil
+}
+
+// A connection which can be closed for writing while it is still read from
+type closeWriter interface {
+  CloseWrite() error
+}
+
+// Close a connection for writing. A TLS connection sends a close_notify alert
+// and then closes the connection beneath it for writing.
+func closeWrite(c net.Conn) error {
+  if t, ok := c.(*tls.Conn); ok {
+    if err := t.CloseWrite(); err != nil {
+      return err
+    }
+    return closeWrite(t.NetConn())
   }
-  if tr != nil {
-    tr.LazyPrintf("%v: Connection will end: %v (%v)", c.RemoteAddr(), addr, backend)
+  if w, ok := c.(closeWriter); ok {
+    return w.CloseWrite()
   }
+  return errNoCloseWrite
 }
 
-// Handling copying from a source to destination connection
-func (s *Service) copyGeneric(dst, src net.Conn, tr trace.Trace, xfer metrics.Meter, errs chan<- error) {
+// Transfer from a source to destination connection. When optimization is
+// enabled and both are plain sockets data is spliced between them without
+// being copied through user space; otherwise it is copied. Either way at most
+// size bytes are moved at once.
+func (s *Service) transfer(dst, src net.Conn, size int, tr trace.Trace, xfer metrics.Meter, errs chan<- error) {
+  if s.optimize && spliceable(dst, src) {
+    s.copySplice(dst, src, size, tr, xfer, errs)
+  }else{
+    s.copyGeneric(dst, src, size, tr, xfer, errs)
+  }
+}
+
+// Handling copying from a source to destination connection through a pooled
+// buffer of the provided size
+func (s *Service) copyGeneric(dst, src net.Conn, size int, tr trace.Trace, xfer metrics.Meter, errs chan<- error) {
   var copied int64
   
   atomic.AddInt64(&s.copyOpen, 1)
+  b := buffers.Get(size)
   defer func(){
+    buffers.Put(b)
     atomic.AddInt64(&s.copyOpen, -1)
     close(errs)
   }()
   
-  buf := make([]byte, 32 * 1024)
+  buf := *b
+  deadlines := newDeadlines(src, s.rto, s.wto)
   for {
     nr, er := src.Read(buf)
-    xfer.Mark(int64(nr)) // read side is instrumented
-    atomic.AddInt64(&s.handlerXfer, int64(nr))
-    if s.rto > 0 { // read deadline on src only
-      src.SetReadDeadline(time.Now().Add(s.rto))
-    }
-    if s.wto > 0 { // write deadline on src only
-      src.SetWriteDeadline(time.Now().Add(s.wto))
+    if nr > 0 {
+      xfer.Mark(int64(nr)) // read side is instrumented
+      atomic.AddInt64(&s.handlerXfer, int64(nr))
     }
+    deadlines.Extend()
     if nr > 0 {
       nw, ew := dst.Write(buf[0:nr])
       if nw > 0 {
@@ -0,0 +1,1353 @@
+package service
+
+import (
+  "io"
+  "os"
+  "fmt"
+  "bufio"
+  "io/ioutil"
+  "net"
+  "time"
+  "context"
+  "testing"
+  "sync/atomic"
+  "strings"
+  "net/http"
+  "crypto/tls"
+  "path/filepath"
+  "net/http/httptest"
+  
+  "perc/route"
+  "perc/tlsconfig"
+  "perc/tlsconfig/tlstest"
+)
+
+import (
+  "google.golang.org/grpc"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/status"
+  "google.golang.org/grpc/health"
+  "google.golang.org/grpc/health/grpc_health_v1"
+  "github.com/stretchr/testify/assert"
+)
+
+// Start an echo backend and return its address
+func echoBackend(t *testing.T) (net.Listener, string) {
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  go func() {
+    for {
+      c, err := l.Accept()
+      if err != nil {
+        return
+      }
+      go func(){
+        defer c.Close()
+        io.Copy(c, c)
+      }()
+    }
+  }()
+  return l, l.Addr().String()
+}
+
+// Obtain a free local address to listen on
+func freeAddr(t *testing.T) string {
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer l.Close()
+  return l.Addr().String()
+}
+
+// Dial a service, retrying until it is listening
+func dialService(t *testing.T, addr string) net.Conn {
+  var err error
+  for i := 0; i < 50; i++ {
+    var c net.Conn
+    c, err = net.Dial("tcp", addr)
+    if err == nil {
+      return c
+    }
+    <- time.After(time.Millisecond * 20)
+  }
+  t.Fatal(err)
+  return nil
+}
+
+func TestShutdown(t *testing.T) {
+  b, baddr := echoBackend(t)
+  defer b.Close()
+  
+  r, err := route.Parse(freeAddr(t) +"="+ baddr)
+  if !assert.Nil(t, err) {
+    return
+  }
+  
+  s := New(Config{Routes:[]*route.Route{r}, ConnTimeout:time.Second})
+  errs := make(chan error, 1)
+  go func(){
+    errs <- s.Run(context.Background())
+  }()
+  
+  c := dialService(t, r.Listen)
+  defer c.Close()
+  
+  buf := make([]byte, 5)
+  c.Write([]byte("hello"))
+  _, err = io.ReadFull(c, buf)
+  if assert.Nil(t, err) {
+    assert.Equal(t, "hello", string(buf))
+  }
+  
+  // an open connection blocks shutdown until the deadline, then is closed
+  cxt, cancel := context.WithTimeout(context.Background(), time.Millisecond * 250)
+  defer cancel()
+  assert.Equal(t, context.DeadlineExceeded, s.Shutdown(cxt))
+  assert.Nil(t, <- errs)
+  // handlers have finished by the time shutdown returns
+  assert.Equal(t, int64(0), s.Stats().OpenConnections)
+  
+  c.SetReadDeadline(time.Now().Add(time.Second))
+  _, err = c.Read(buf)
+  assert.Equal(t, io.EOF, err)
+  
+  // the listener no longer accepts connections
+  _, err = net.Dial("tcp", r.Listen)
+  assert.NotNil(t, err)
+}
+
+// Start a backend which greets connections with its name and return its address
+func namedBackend(t *testing.T, name string) (net.Listener, string) {
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  go func() {
+    for {
+      c, err := l.Accept()
+      if err != nil {
+        return
+      }
+      c.Write([]byte(name))
+      c.Close()
+    }
+  }()
+  return l, l.Addr().String()
+}
+
+// Read a backend's greeting through the service
+func readGreeting(t *testing.T, addr string) string {
+  c := dialService(t, addr)
+  defer c.Close()
+  c.SetReadDeadline(time.Now().Add(time.Second))
+  b, _ := ioutil.ReadAll(c)
+  return string(b)
+}
+
+func TestReload(t *testing.T) {
+  b1, baddr1 := namedBackend(t, "one")
+  defer b1.Close()
+  b2, baddr2 := namedBackend(t, "two")
+  defer b2.Close()
+  
+  laddr1, laddr2 := freeAddr(t), freeAddr(t)
+  r1, err := route.Parse(laddr1 +"="+ baddr1)
+  if !assert.Nil(t, err) {
+    return
+  }
+  
+  s := New(Config{Routes:[]*route.Route{r1}, ConnTimeout:time.Second})
+  go s.Run(context.Background())
+  defer s.Shutdown(context.Background())
+  assert.Equal(t, "one", readGreeting(t, laddr1))
+  
+  // swap the backend for the existing route and add a new route
+  r1, _ = route.Parse(laddr1 +"="+ baddr2)
+  r2, _ := route.Parse(laddr2 +"="+ baddr1)
+  if assert.Nil(t, s.Reload([]*route.Route{r1, r2})) {
+    assert.Equal(t, "two", readGreeting(t, laddr1))
+    assert.Equal(t, "one", readGreeting(t, laddr2))
+  }
+  
+  // remove the first route
+  if assert.Nil(t, s.Reload([]*route.Route{r2})) {
+    _, err = net.Dial("tcp", laddr1)
+    assert.NotNil(t, err)
+    assert.Equal(t, "one", readGreeting(t, laddr2))
+    assert.Equal(t, 1, len(s.Routes()))
+  }
+  
+  // duplicate listeners are rejected and nothing changes
+  assert.NotNil(t, s.Reload([]*route.Route{r1, r1}))
+  assert.Equal(t, "one", readGreeting(t, laddr2))
+}
+
+func TestDialRetry(t *testing.T) {
+  b, baddr := namedBackend(t, "live")
+  defer b.Close()
+  
+  laddr := freeAddr(t)
+  r, err := route.Parse(laddr +"="+ freeAddr(t) +","+ baddr)
+  if !assert.Nil(t, err) {
+    return
+  }
+  
+  s := New(Config{Routes:[]*route.Route{r}, ConnTimeout:time.Second, DialAttempts:2})
+  go s.Run(context.Background())
+  defer s.Shutdown(context.Background())
+  
+  // every connection reaches the live backend, even when the dead one is next in the rotation
+  for i := 0; i < 4; i++ {
+    assert.Equal(t, "live", readGreeting(t, laddr))
+  }
+}
+
+func TestPriority(t *testing.T) {
+  p, paddr := namedBackend(t, "primary")
+  b, baddr := namedBackend(t, "backup")
+  defer b.Close()
+  
+  laddr := freeAddr(t)
+  r, err := route.Parse(laddr +"="+ baddr +"(priority='1'),"+ paddr +"(outlier_failures='1')")
+  if !assert.Nil(t, err) {
+    return
+  }
+  
+  s := New(Config{Routes:[]*route.Route{r}, ConnTimeout:time.Second, DialAttempts:2})
+  go s.Run(context.Background())
+  defer s.Shutdown(context.Background())
+  
+  // the lower priority backend is not used while the primary is available
+  for i := 0; i < 4; i++ {
+    assert.Equal(t, "primary", readGreeting(t, laddr))
+  }
+  
+  // traffic spills over to the lower priority tier once the primary is gone
+  p.Close()
+  for i := 0; i < 4; i++ {
+    assert.Equal(t, "backup", readGreeting(t, laddr))
+  }
+}
+
+func TestClientAffinity(t *testing.T) {
+  a, aaddr := namedBackend(t, "a")
+  defer a.Close()
+  b, baddr := namedBackend(t, "b")
+  defer b.Close()
+  
+  laddr := freeAddr(t)
+  r, err := route.Parse(laddr +"="+ aaddr +"(affinity='client_ip'),"+ baddr)
+  if !assert.Nil(t, err) {
+    return
+  }
+  
+  s := New(Config{Routes:[]*route.Route{r}, ConnTimeout:time.Second})
+  go s.Run(context.Background())
+  defer s.Shutdown(context.Background())
+  
+  // every connection from the client lands on the backend it first reached
+  first := readGreeting(t, laddr)
+  for i := 0; i < 4; i++ {
+    assert.Equal(t, first, readGreeting(t, laddr))
+  }
+  
+  stats := s.Stats()
+  assert.Equal(t, 1, stats.Affinity.Size)
+  assert.Equal(t, int64(4), stats.Affinity.Hits)
+  assert.Equal(t, int64(1), stats.Affinity.Misses)
+}
+
+func TestProxyProtocol(t *testing.T) {
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if !assert.Nil(t, err) {
+    return
+  }
+  defer l.Close()
+  go func() {
+    for {
+      c, err := l.Accept()
+      if err != nil {
+        return
+      }
+      // reply with the header the backend received
+      h, _ := bufio.NewReader(c).ReadString('\n')
+      c.Write([]byte(h))
+      c.Close()
+    }
+  }()
+  
+  laddr := freeAddr(t)
+  r, err := route.Parse(laddr +"="+ l.Addr().String() +"(proxy_protocol='v1')")
+  if !assert.Nil(t, err) {
+    return
+  }
+  
+  s := New(Config{Routes:[]*route.Route{r}, ConnTimeout:time.Second})
+  go s.Run(context.Background())
+  defer s.Shutdown(context.Background())
+  
+  c := dialService(t, laddr)
+  defer c.Close()
+  h, err := ioutil.ReadAll(c)
+  if assert.Nil(t, err) {
+    assert.Equal(t, fmt.Sprintf("PROXY TCP4 127.0.0.1 127.0.0.1 %d %d\r\n", c.LocalAddr().(*net.TCPAddr).Port, c.RemoteAddr().(*net.TCPAddr).Port), string(h))
+  }
+}
+
+func TestAcceptProxyProtocol(t *testing.T) {
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if !assert.Nil(t, err) {
+    return
+  }
+  defer l.Close()
+  go func() {
+    for {
+      c, err := l.Accept()
+      if err != nil {
+        return
+      }
+      // reply with the header the backend received
+      h, _ := bufio.NewReader(c).ReadString('\n')
+      c.Write([]byte(h))
+      c.Close()
+    }
+  }()
+  
+  laddr := freeAddr(t)
+  r, err := route.Parse(laddr +"(proxy_protocol='any', proxy_trusted='127.0.0.0/8')="+ l.Addr().String() +"(proxy_protocol='v1')")
+  if !assert.Nil(t, err) {
+    return
+  }
+  
+  s := New(Config{Routes:[]*route.Route{r}, ConnTimeout:time.Second})
+  go s.Run(context.Background())
+  defer s.Shutdown(context.Background())
+  
+  // the backend sees the client described by the header the service accepted
+  c := dialService(t, laddr)
+  defer c.Close()
+  _, err = c.Write([]byte("PROXY TCP4 203.0.113.7 198.51.100.1 40000 443\r\n"))
+  if !assert.Nil(t, err) {
+    return
+  }
+  h, err := ioutil.ReadAll(c)
+  if assert.Nil(t, err) {
+    assert.Equal(t, "PROXY TCP4 203.0.113.7 198.51.100.1 40000 443\r\n", string(h))
+  }
+}
+
+func TestTLSTermination(t *testing.T) {
+  f, err := tlstest.Generate()
+  if !assert.Nil(t, err) {
+    return
+  }
+  defer f.Remove()
+  
+  b, baddr := namedBackend(t, "secure")
+  defer b.Close()
+  
+  laddr := freeAddr(t)
+  r, err := route.Parse(fmt.Sprintf("%s(tls_cert='%s', tls_key='%s', tls_client_ca='%s')=%s", laddr, f.ServerCert, f.ServerKey, f.CA, baddr))
+  if !assert.Nil(t, err) {
+    return
+  }
+  
+  s := New(Config{Routes:[]*route.Route{r}, ConnTimeout:time.Second})
+  go s.Run(context.Background())
+  defer s.Shutdown(context.Background())
+  dialService(t, laddr).Close()
+  
+  roots, err := tlsconfig.LoadCA(f.CA)
+  if !assert.Nil(t, err) {
+    return
+  }
+  cert, err := tls.LoadX509KeyPair(f.ClientCert, f.ClientKey)
+  if !assert.Nil(t, err) {
+    return
+  }
+  
+  // a client presenting a certificate signed by the CA is proxied
+  c, err := tls.Dial("tcp", laddr, &tls.Config{RootCAs:roots, Certificates:[]tls.Certificate{cert}})
+  if assert.Nil(t, err) {
+    v, err := ioutil.ReadAll(c)
+    assert.Nil(t, err)
+    assert.Equal(t, "secure", string(v))
+    c.Close()
+  }
+  
+  // a client without one is not
+  c, err = tls.Dial("tcp", laddr, &tls.Config{RootCAs:roots})
+  if err == nil {
+    _, err = ioutil.ReadAll(c)
+    c.Close()
+  }
+  assert.NotNil(t, err)
+}
+
+func TestBackendMutualTLS(t *testing.T) {
+  f, err := tlstest.Generate()
+  if !assert.Nil(t, err) {
+    return
+  }
+  defer f.Remove()
+  
+  conf, err := tlsconfig.Server(map[string]string{tlsconfig.ParamCert: f.ServerCert, tlsconfig.ParamKey: f.ServerKey, tlsconfig.ParamClientCA: f.CA})
+  if !assert.Nil(t, err) {
+    return
+  }
+  conf.NextProtos = []string{"greeting"}
+  l, err := tls.Listen("tcp", "127.0.0.1:0", conf)
+  if !assert.Nil(t, err) {
+    return
+  }
+  defer l.Close()
+  go func() {
+    for {
+      c, err := l.Accept()
+      if err != nil {
+        return
+      }
+      // reply with the client certificate and protocol the backend received
+      x := c.(*tls.Conn)
+      if x.Handshake() == nil {
+        s := x.ConnectionState()
+        fmt.Fprintf(c, "%s/%s", s.PeerCertificates[0].Subject.CommonName, s.NegotiatedProtocol)
+      }
+      c.Close()
+    }
+  }()
+  
+  laddr := freeAddr(t)
+  r, err := route.Parse(fmt.Sprintf("%s=%s(tls='localhost', tls_ca='%s', tls_cert='%s', tls_key='%s', tls_alpn='greeting')", laddr, l.Addr(), f.CA, f.ClientCert, f.ClientKey))
+  if !assert.Nil(t, err) {
+    return
+  }
+  
+  s := New(Config{Routes:[]*route.Route{r}, ConnTimeout:time.Second})
+  go s.Run(context.Background())
+  defer s.Shutdown(context.Background())
+  
+  assert.Equal(t, "client/greeting", readGreeting(t, laddr))
+}
+
+// Start a TLS backend which greets clients with its name
+func tlsBackend(t *testing.T, f tlstest.Files, name string) (net.Listener, string) {
+  conf, err := tlsconfig.Server(map[string]string{tlsconfig.ParamCert: f.ServerCert, tlsconfig.ParamKey: f.ServerKey})
+  if err != nil {
+    t.Fatal(err)
+  }
+  l, err := tls.Listen("tcp", "127.0.0.1:0", conf)
+  if err != nil {
+    t.Fatal(err)
+  }
+  go func() {
+    for {
+      c, err := l.Accept()
+      if err != nil {
+        return
+      }
+      c.Write([]byte(name))
+      c.Close()
+    }
+  }()
+  return l, l.Addr().String()
+}
+
+func TestSNIRouting(t *testing.T) {
+  f, err := tlstest.Generate()
+  if !assert.Nil(t, err) {
+    return
+  }
+  defer f.Remove()
+  
+  a, aaddr := tlsBackend(t, f, "exact")
+  defer a.Close()
+  b, baddr := tlsBackend(t, f, "wildcard")
+  defer b.Close()
+  c, caddr := tlsBackend(t, f, "default")
+  defer c.Close()
+  
+  laddr := freeAddr(t)
+  var routes []*route.Route
+  for _, e := range []string{
+    laddr +"(sni='api.example.com')="+ aaddr,
+    laddr +"(sni='*.example.com')="+ baddr,
+    laddr +"(sni='*')="+ caddr,
+  }{
+    r, err := route.Parse(e)
+    if !assert.Nil(t, err) {
+      return
+    }
+    routes = append(routes, r)
+  }
+  
+  s := New(Config{Routes:routes, ConnTimeout:time.Second})
+  go s.Run(context.Background())
+  defer s.Shutdown(context.Background())
+  dialService(t, laddr).Close()
+  
+  for name, expect := range map[string]string{
+    "api.example.com": "exact",
+    "web.example.com": "wildcard",
+    "a.b.example.com": "wildcard",
+    "example.com": "default",
+    "": "default",
+  }{
+    x, err := tls.Dial("tcp", laddr, &tls.Config{ServerName:name, InsecureSkipVerify:true})
+    if assert.Nil(t, err, name) {
+      v, err := ioutil.ReadAll(x)
+      assert.Nil(t, err)
+      assert.Equal(t, expect, string(v), name)
+      x.Close()
+    }
+  }
+  
+  // without the catch-all route, unmatched names are not proxied
+  err = s.Reload(routes[:2])
+  if assert.Nil(t, err) {
+    x, err := tls.Dial("tcp", laddr, &tls.Config{ServerName:"example.com", InsecureSkipVerify:true})
+    if err == nil {
+      _, err = ioutil.ReadAll(x)
+      x.Close()
+    }
+    assert.NotNil(t, err)
+  }
+  
+  // routes which share a listener must be selected by server name
+  r, _ := route.Parse(laddr +"="+ caddr)
+  assert.NotNil(t, s.Reload(append(routes[:2:2], r)))
+}
+
+// Start an HTTP backend which responds with its name and how the request was
+// forwarded to it
+func httpBackend(name string) *httptest.Server {
+  return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    fmt.Fprintf(w, "%s %s %s %s", name, r.URL.Path, r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Forwarded-Proto"))
+  }))
+}
+
+func TestHTTPRouting(t *testing.T) {
+  a := httpBackend("api")
+  defer a.Close()
+  b := httpBackend("v1")
+  defer b.Close()
+  c := httpBackend("static")
+  defer c.Close()
+  
+  laddr := freeAddr(t)
+  var routes []*route.Route
+  for _, e := range []string{
+    laddr +"(mode='http', host='api.example.com')="+ strings.TrimPrefix(a.URL, "http://"),
+    laddr +"(mode='http', host='api.example.com', path='/v1')="+ strings.TrimPrefix(b.URL, "http://"),
+    laddr +"(mode='http', path='/static')="+ strings.TrimPrefix(c.URL, "http://"),
+  }{
+    r, err := route.Parse(e)
+    if !assert.Nil(t, err) {
+      return
+    }
+    routes = append(routes, r)
+  }
+  
+  s := New(Config{Routes:routes, ConnTimeout:time.Second})
+  go s.Run(context.Background())
+  defer s.Shutdown(context.Background())
+  dialService(t, laddr).Close()
+  
+  // requests on the same connection may be routed to different backends
+  client := &http.Client{Transport:&http.Transport{MaxIdleConnsPerHost:1}}
+  for _, e := range []struct{
+    Host, Path string
+    Status int
+    Expect string
+  }{
+    {"api.example.com", "/users", http.StatusOK, "api /users 127.0.0.1 http"},
+    {"api.example.com:80", "/v1/users", http.StatusOK, "v1 /v1/users 127.0.0.1 http"},
+    {"api.example.com", "/v10", http.StatusOK, "api /v10 127.0.0.1 http"},
+    {"web.example.com", "/static/app.js", http.StatusOK, "static /static/app.js 127.0.0.1 http"},
+    {"web.example.com", "/", http.StatusNotFound, ""},
+  }{
+    req, err := http.NewRequest("GET", "http://"+ laddr + e.Path, nil)
+    if !assert.Nil(t, err) {
+      return
+    }
+    req.Host = e.Host
+    rsp, err := client.Do(req)
+    if assert.Nil(t, err, e.Path) {
+      v, err := ioutil.ReadAll(rsp.Body)
+      rsp.Body.Close()
+      assert.Nil(t, err)
+      assert.Equal(t, e.Status, rsp.StatusCode, e.Path)
+      if e.Status == http.StatusOK {
+        assert.Equal(t, e.Expect, string(v), e.Path)
+      }
+    }
+  }
+  
+  // forwarded addresses are appended to those the client provides
+  req, _ := http.NewRequest("GET", "http://"+ laddr +"/users", nil)
+  req.Host = "api.example.com"
+  req.Header.Set("X-Forwarded-For", "10.0.0.1")
+  rsp, err := client.Do(req)
+  if assert.Nil(t, err) {
+    v, _ := ioutil.ReadAll(rsp.Body)
+    rsp.Body.Close()
+    assert.Equal(t, "api /users 10.0.0.1, 127.0.0.1 http", string(v))
+  }
+  
+  // routes which share a listener must all be HTTP routes
+  r, _ := route.Parse(laddr +"(sni='*')="+ strings.TrimPrefix(a.URL, "http://"))
+  assert.NotNil(t, s.Reload(append(routes[:2:2], r)))
+}
+
+// Start a gRPC backend whose health service reports only the named service as
+// serving and return its address
+func TestHTTPTimeouts(t *testing.T) {
+  // a backend which stalls partway through the body of responses to /stall
+  // and otherwise never responds
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer l.Close()
+  go func() {
+    for {
+      c, err := l.Accept()
+      if err != nil {
+        return
+      }
+      go func(){
+        defer c.Close()
+        req, err := http.ReadRequest(bufio.NewReader(c))
+        if err == nil && req.URL.Path == "/stall" {
+          c.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\npartial"))
+        }
+        io.Copy(ioutil.Discard, c)
+      }()
+    }
+  }()
+  
+  laddr := freeAddr(t)
+  r, err := route.Parse(laddr +"(mode='http')="+ l.Addr().String())
+  if !assert.Nil(t, err) {
+    return
+  }
+  s := New(Config{Routes:[]*route.Route{r}, ConnTimeout:time.Second, ReadTimeout:time.Millisecond * 200, WriteTimeout:time.Millisecond * 200})
+  go s.Run(context.Background())
+  defer s.Shutdown(context.Background())
+  
+  // a client which trickles its request header is disconnected
+  c := dialService(t, laddr)
+  defer c.Close()
+  c.Write([]byte("GET / HTTP/1.1\r\n"))
+  c.SetReadDeadline(time.Now().Add(time.Second * 2))
+  _, err = c.Read(make([]byte, 1))
+  assert.Equal(t, io.EOF, err)
+  
+  // a backend which doesn't respond fails the request
+  x := dialService(t, laddr)
+  defer x.Close()
+  x.SetDeadline(time.Now().Add(time.Second * 2))
+  x.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+  rsp, err := http.ReadResponse(bufio.NewReader(x), nil)
+  if assert.Nil(t, err) {
+    assert.Equal(t, http.StatusBadGateway, rsp.StatusCode)
+  }
+  
+  // a client which stalls partway through its request body fails the request
+  y := dialService(t, laddr)
+  defer y.Close()
+  y.SetDeadline(time.Now().Add(time.Second * 2))
+  y.Write([]byte("POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 100\r\n\r\npartial"))
+  rsp, err = http.ReadResponse(bufio.NewReader(y), nil)
+  if assert.Nil(t, err) {
+    assert.Equal(t, http.StatusBadGateway, rsp.StatusCode)
+  }
+  
+  // a backend which stalls partway through its response body is disconnected
+  z := dialService(t, laddr)
+  defer z.Close()
+  z.SetDeadline(time.Now().Add(time.Second * 2))
+  z.Write([]byte("GET /stall HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+  rsp, err = http.ReadResponse(bufio.NewReader(z), nil)
+  if assert.Nil(t, err) {
+    assert.Equal(t, http.StatusOK, rsp.StatusCode)
+    b, err := ioutil.ReadAll(rsp.Body)
+    assert.Equal(t, "partial", string(b))
+    assert.Equal(t, io.ErrUnexpectedEOF, err)
+  }
+}
+
+func grpcBackend(t *testing.T, name string) (*grpc.Server, string) {
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  h := health.NewServer()
+  h.SetServingStatus(name, grpc_health_v1.HealthCheckResponse_SERVING)
+  g := grpc.NewServer()
+  grpc_health_v1.RegisterHealthServer(g, h)
+  go g.Serve(l)
+  return g, l.Addr().String()
+}
+
+func TestGRPCRouting(t *testing.T) {
+  a, aaddr := grpcBackend(t, "a")
+  defer a.Stop()
+  b, baddr := grpcBackend(t, "b")
+  defer b.Stop()
+  
+  r, err := route.Parse(freeAddr(t) +"(mode='grpc')="+ aaddr +","+ baddr)
+  if !assert.Nil(t, err) {
+    return
+  }
+  
+  s := New(Config{Routes:[]*route.Route{r}, ConnTimeout:time.Second})
+  go s.Run(context.Background())
+  defer s.Shutdown(context.Background())
+  dialService(t, r.Listen).Close()
+  
+  conn, err := grpc.Dial(r.Listen, grpc.WithInsecure())
+  if !assert.Nil(t, err) {
+    return
+  }
+  defer conn.Close()
+  
+  // calls over one client connection are balanced across both backends; the
+  // status of failed calls is carried in trailers
+  client := grpc_health_v1.NewHealthClient(conn)
+  var served, missing int
+  for i := 0; i < 10; i++ {
+    cxt, cancel := context.WithTimeout(context.Background(), time.Second)
+    rsp, err := client.Check(cxt, &grpc_health_v1.HealthCheckRequest{Service:"a"})
+    cancel()
+    if err == nil {
+      assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, rsp.Status)
+      served++
+    }else if assert.Equal(t, codes.NotFound, status.Code(err), err) {
+      missing++
+    }
+  }
+  assert.Equal(t, 5, served)
+  assert.Equal(t, 5, missing)
+  assert.Equal(t, int64(10), s.Stats().TotalConnections)
+  
+  // streamed messages are flushed as they arrive and deadlines are passed on
+  cxt, cancel := context.WithTimeout(context.Background(), time.Millisecond * 250)
+  defer cancel()
+  w, err := client.Watch(cxt, &grpc_health_v1.HealthCheckRequest{Service:"a"})
+  if assert.Nil(t, err) {
+    rsp, err := w.Recv()
+    if assert.Nil(t, err) {
+      assert.NotEqual(t, grpc_health_v1.HealthCheckResponse_UNKNOWN, rsp.Status)
+    }
+    _, err = w.Recv()
+    assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+  }
+  
+  // backend connections are shared, so they cannot send the PROXY protocol
+  x, _ := route.Parse(r.Listen +"(mode='grpc')="+ aaddr +"(proxy_protocol='v1')")
+  assert.NotNil(t, s.Reload([]*route.Route{x}))
+}
+
+// Start a UDP backend which replies to datagrams with its name and the
+// datagram and return its address
+func TestGRPCTransports(t *testing.T) {
+  s := New(Config{})
+  a := route.Backend{Addr:"127.0.0.1:9000"}
+  b := route.Backend{Addr:"127.0.0.1:9000", Params:map[string]string{tlsconfig.ParamTLS:"true"}}
+  
+  // backends with the same address but different params don't share a transport
+  x := s.transports.Get(a)
+  assert.True(t, x == s.transports.Get(a))
+  assert.False(t, x == s.transports.Get(b))
+  
+  // a backend whose params changed gets a new transport
+  r, err := route.New(":9001", []route.Backend{b})
+  if assert.Nil(t, err) {
+    s.transports.Retain([]*route.Route{r})
+    assert.False(t, x == s.transports.Get(a))
+  }
+}
+
+func udpBackend(t *testing.T, name string) (net.PacketConn, string) {
+  p, err := net.ListenPacket("udp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  go func() {
+    buf := make([]byte, 1024)
+    for {
+      n, addr, err := p.ReadFrom(buf)
+      if err != nil {
+        return
+      }
+      p.WriteTo([]byte(name +" "+ string(buf[:n])), addr)
+    }
+  }()
+  return p, p.LocalAddr().String()
+}
+
+// Send a datagram and read the reply
+func exchange(t *testing.T, c net.Conn, m string) string {
+  c.SetDeadline(time.Now().Add(time.Second))
+  _, err := c.Write([]byte(m))
+  if err != nil {
+    t.Fatal(err)
+  }
+  buf := make([]byte, 1024)
+  n, err := c.Read(buf)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return string(buf[:n])
+}
+
+func TestUDPRoute(t *testing.T) {
+  a, aaddr := udpBackend(t, "a")
+  defer a.Close()
+  b, baddr := udpBackend(t, "b")
+  defer b.Close()
+  
+  laddr := freeAddr(t)
+  r, err := route.Parse("udp:"+ laddr +"(flow_timeout='250ms')="+ aaddr +","+ baddr)
+  if !assert.Nil(t, err) {
+    return
+  }
+  
+  s := New(Config{Routes:[]*route.Route{r}, ConnTimeout:time.Second})
+  go s.Run(context.Background())
+  defer s.Shutdown(context.Background())
+  <- time.After(time.Millisecond * 50)
+  
+  // each client is assigned a backend for the life of its flow
+  x, err := net.Dial("udp", laddr)
+  if !assert.Nil(t, err) {
+    return
+  }
+  defer x.Close()
+  y, err := net.Dial("udp", laddr)
+  if !assert.Nil(t, err) {
+    return
+  }
+  defer y.Close()
+  
+  vx := exchange(t, x, "one")
+  vy := exchange(t, y, "one")
+  assert.NotEqual(t, vx[:1], vy[:1])
+  assert.Equal(t, vx[:1] +" two", exchange(t, x, "two"))
+  assert.Equal(t, vy[:1] +" two", exchange(t, y, "two"))
+  
+  stats := s.Stats()
+  assert.Equal(t, int64(2), stats.OpenConnections)
+  assert.Equal(t, int64(2), stats.TotalConnections)
+  
+  // idle flows expire
+  <- time.After(time.Millisecond * 500)
+  assert.Equal(t, int64(0), s.Stats().OpenConnections)
+  assert.True(t, strings.HasSuffix(exchange(t, x, "three"), " three"))
+  assert.Equal(t, int64(3), s.Stats().TotalConnections)
+}
+
+func TestUDPRejected(t *testing.T) {
+  a, aaddr := udpBackend(t, "a")
+  defer a.Close()
+  
+  laddr := freeAddr(t)
+  r, err := route.Parse("udp:"+ laddr +"(flow_timeout='300ms', rate='4', rate_burst='1')="+ aaddr)
+  if !assert.Nil(t, err) {
+    return
+  }
+  
+  s := New(Config{Routes:[]*route.Route{r}, ConnTimeout:time.Second})
+  go s.Run(context.Background())
+  defer s.Shutdown(context.Background())
+  <- time.After(time.Millisecond * 50)
+  
+  x, err := net.Dial("udp", laddr)
+  if !assert.Nil(t, err) {
+    return
+  }
+  defer x.Close()
+  y, err := net.Dial("udp", laddr)
+  if !assert.Nil(t, err) {
+    return
+  }
+  defer y.Close()
+  assert.Equal(t, "a one", exchange(t, x, "one"))
+  
+  // a rejected client is not reconsidered for every datagram
+  for i := 0; i < 5; i++ {
+    y.Write([]byte("dropped"))
+  }
+  <- time.After(time.Millisecond * 100)
+  assert.Equal(t, int64(1), s.Stats().RateLimits.Limited)
+  
+  // but is once the flow timeout has passed
+  <- time.After(time.Millisecond * 300)
+  assert.Equal(t, "a two", exchange(t, y, "two"))
+}
+
+func TestUnixSockets(t *testing.T) {
+  dir, err := ioutil.TempDir("", "perc-unix-")
+  if !assert.Nil(t, err) {
+    return
+  }
+  defer os.RemoveAll(dir)
+  
+  // an echo backend on a socket
+  bpath := filepath.Join(dir, "backend.sock")
+  b, err := net.Listen("unix", bpath)
+  if !assert.Nil(t, err) {
+    return
+  }
+  defer b.Close()
+  go func() {
+    for {
+      c, err := b.Accept()
+      if err != nil {
+        return
+      }
+      go func(){
+        defer c.Close()
+        io.Copy(c, c)
+      }()
+    }
+  }()
+  
+  // a socket file left behind by a process which is no longer listening
+  lpath := filepath.Join(dir, "perc.sock")
+  stale, err := net.ListenUnix("unix", &net.UnixAddr{Name:lpath, Net:"unix"})
+  if !assert.Nil(t, err) {
+    return
+  }
+  stale.SetUnlinkOnClose(false)
+  stale.Close()
+  
+  r, err := route.Parse("unix:"+ lpath +"(socket_mode='0600')=unix:"+ bpath)
+  if !assert.Nil(t, err) {
+    return
+  }
+  s := New(Config{Routes:[]*route.Route{r}, ConnTimeout:time.Second, RateLimit:0.1, RateBurst:1})
+  go s.Run(context.Background())
+  
+  var c net.Conn
+  for i := 0; i < 50; i++ {
+    if c, err = net.Dial("unix", lpath); err == nil {
+      break
+    }
+    <- time.After(time.Millisecond * 20)
+  }
+  if assert.Nil(t, err) {
+    buf := make([]byte, 5)
+    c.Write([]byte("hello"))
+    _, err = io.ReadFull(c, buf)
+    if assert.Nil(t, err) {
+      assert.Equal(t, "hello", string(buf))
+    }
+    c.Close()
+  }
+  
+  // socket clients have no address, so they don't share the per-client limit
+  c, err = net.Dial("unix", lpath)
+  if assert.Nil(t, err) {
+    assert.Equal(t, "again", echo(t, c, "again"))
+    c.Close()
+  }
+  
+  fi, err := os.Stat(lpath)
+  if assert.Nil(t, err) {
+    assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+  }
+  
+  // a socket in use is not replaced, and the socket file is removed when the
+  // route is no longer served
+  x := New(Config{Routes:[]*route.Route{r}})
+  assert.NotNil(t, x.Reload([]*route.Route{r}))
+  s.Shutdown(context.Background())
+  _, err = os.Stat(lpath)
+  assert.True(t, os.IsNotExist(err))
+}
+
+// Write a message through a connection and read it back from an echo backend
+func echo(t *testing.T, c net.Conn, m string) string {
+  c.SetDeadline(time.Now().Add(time.Second * 2))
+  c.Write([]byte(m))
+  buf := make([]byte, len(m))
+  n, _ := io.ReadFull(c, buf)
+  return string(buf[:n])
+}
+
+func TestConnLimits(t *testing.T) {
+  a, aaddr := echoBackend(t)
+  defer a.Close()
+  b, baddr := echoBackend(t)
+  defer b.Close()
+  c, caddr := namedBackend(t, "backup")
+  defer c.Close()
+  
+  laddr1, laddr2, laddr3 := freeAddr(t), freeAddr(t), freeAddr(t)
+  r1, err := route.Parse(laddr1 +"(max_conns='1')="+ aaddr)
+  if !assert.Nil(t, err) {
+    return
+  }
+  r2, err := route.Parse(laddr2 +"(max_conns='1', queue_timeout='5s')="+ aaddr)
+  if !assert.Nil(t, err) {
+    return
+  }
+  r3, err := route.Parse(laddr3 +"="+ baddr +"(max_conns='1'),"+ caddr +"(priority='1')")
+  if !assert.Nil(t, err) {
+    return
+  }
+  
+  s := New(Config{Routes:[]*route.Route{r1, r2, r3}, ConnTimeout:time.Second, DialAttempts:1})
+  go s.Run(context.Background())
+  defer s.Shutdown(context.Background())
+  
+  // a connection over the route's limit is rejected
+  c1 := dialService(t, laddr1)
+  defer c1.Close()
+  assert.Equal(t, "one", echo(t, c1, "one"))
+  x := dialService(t, laddr1)
+  x.SetReadDeadline(time.Now().Add(time.Second))
+  _, err = x.Read(make([]byte, 1))
+  assert.Equal(t, io.EOF, err)
+  x.Close()
+  
+  // a connection over the limit of a route which queues waits for a slot
+  c2 := dialService(t, laddr2)
+  assert.Equal(t, "two", echo(t, c2, "two"))
+  done := make(chan string, 1)
+  go func() {
+    x := dialService(t, laddr2)
+    defer x.Close()
+    done <- echo(t, x, "queued")
+  }()
+  <- time.After(time.Millisecond * 100)
+  select {
+    case <- done:
+      t.Error("Queued connection was handled over the limit")
+    default:
+  }
+  c2.Close()
+  assert.Equal(t, "queued", <- done)
+  
+  // a backend at its limit is passed over without using an attempt
+  c3 := dialService(t, laddr3)
+  defer c3.Close()
+  assert.Equal(t, "three", echo(t, c3, "three"))
+  assert.Equal(t, "backup", readGreeting(t, laddr3))
+  
+  l := s.Stats().Limits
+  assert.Equal(t, int64(0), l.Rejected)
+  assert.Equal(t, int64(1), l.RejectedByRoute[r1.Key()])
+  assert.Equal(t, int64(0), l.RejectedByRoute[r2.Key()])
+  assert.Equal(t, int64(1), l.RejectedByBackend[baddr])
+}
+
+func TestConnectBudgetLimit(t *testing.T) {
+  a, aaddr := echoBackend(t)
+  defer a.Close()
+  b := route.Backend{Addr:aaddr, Params:map[string]string{route.ParamMaxConns:"1"}}
+  
+  c, x := net.Pipe()
+  defer c.Close()
+  defer x.Close()
+  
+  // a budget which has expired before any target is attempted
+  s := New(Config{DialBudget:time.Nanosecond})
+  _, _, err := s.connect(c, []target{{b, aaddr}}, nil)
+  if assert.NotNil(t, err) {
+    assert.NotEqual(t, ErrBackendsFull, err)
+  }
+  
+  // the backend's only slot was not consumed
+  assert.True(t, s.limits.Reserve(aaddr, b))
+  s.limits.Unreserve(aaddr)
+}
+
+func TestTargetsUnavailable(t *testing.T) {
+  r, err := route.Parse(":9000=a:1(outlier_failures='1'),b:1(outlier_failures='1')")
+  if !assert.Nil(t, err) {
+    return
+  }
+  s := New(Config{})
+  
+  // an ejected backend is not attempted at all
+  s.detector.Failure("a:1", r.Backends[0])
+  v, err := s.targets(r, "", "")
+  if assert.Nil(t, err) && assert.Len(t, v, 1) {
+    assert.Equal(t, "b:1", v[0].addr)
+  }
+  
+  // nor is anything attempted once every backend is ejected
+  s.detector.Failure("b:1", r.Backends[1])
+  _, err = s.targets(r, "", "")
+  assert.Equal(t, ErrUnavailable, err)
+}
+
+func TestGlobalConnLimit(t *testing.T) {
+  a, aaddr := echoBackend(t)
+  defer a.Close()
+  
+  laddr := freeAddr(t)
+  r, err := route.Parse(laddr +"="+ aaddr)
+  if !assert.Nil(t, err) {
+    return
+  }
+  
+  s := New(Config{Routes:[]*route.Route{r}, ConnTimeout:time.Second, MaxConns:1})
+  go s.Run(context.Background())
+  defer s.Shutdown(context.Background())
+  
+  c := dialService(t, laddr)
+  defer c.Close()
+  assert.Equal(t, "one", echo(t, c, "one"))
+  
+  x := dialService(t, laddr)
+  x.SetReadDeadline(time.Now().Add(time.Second))
+  _, err = x.Read(make([]byte, 1))
+  assert.Equal(t, io.EOF, err)
+  x.Close()
+  assert.Equal(t, int64(1), s.Stats().Limits.Rejected)
+  
+  // the slot is freed when the connection closes
+  c.Close()
+  <- time.After(time.Millisecond * 100)
+  y := dialService(t, laddr)
+  defer y.Close()
+  assert.Equal(t, "two", echo(t, y, "two"))
+}
+
+func TestRateLimit(t *testing.T) {
+  b, baddr := namedBackend(t, "b")
+  defer b.Close()
+  
+  laddr1, laddr2 := freeAddr(t), freeAddr(t)
+  r1, err := route.Parse(laddr1 +"(rate='1', rate_burst='2')="+ baddr)
+  if !assert.Nil(t, err) {
+    return
+  }
+  r2, err := route.Parse(laddr2 +"(rate='5', rate_burst='1', rate_delay='1s')="+ baddr)
+  if !assert.Nil(t, err) {
+    return
+  }
+  
+  s := New(Config{Routes:[]*route.Route{r1, r2}, ConnTimeout:time.Second})
+  go s.Run(context.Background())
+  defer s.Shutdown(context.Background())
+  
+  // connections beyond the burst are closed
+  assert.Equal(t, "b", readGreeting(t, laddr1))
+  assert.Equal(t, "b", readGreeting(t, laddr1))
+  assert.Equal(t, "", readGreeting(t, laddr1))
+  assert.Equal(t, "", readGreeting(t, laddr1))
+  
+  // or delayed until a token is available
+  start := time.Now()
+  assert.Equal(t, "b", readGreeting(t, laddr2))
+  assert.Equal(t, "b", readGreeting(t, laddr2))
+  assert.True(t, time.Since(start) >= time.Millisecond * 150)
+  
+  l := s.Stats().RateLimits
+  assert.Equal(t, int64(2), l.Limited)
+  assert.Equal(t, int64(1), l.Delayed)
+  if assert.Len(t, l.TopClients, 1) {
+    assert.Equal(t, "127.0.0.1", l.TopClients[0].Addr)
+    assert.Equal(t, int64(2), l.TopClients[0].Limited)
+  }
+}
+
+func TestGlobalRateLimit(t *testing.T) {
+  b, baddr := namedBackend(t, "b")
+  defer b.Close()
+  
+  laddr1, laddr2 := freeAddr(t), freeAddr(t)
+  r1, _ := route.Parse(laddr1 +"="+ baddr)
+  r2, _ := route.Parse(laddr2 +"="+ baddr)
+  
+  // the limit applies to a client's connections across every route
+  s := New(Config{Routes:[]*route.Route{r1, r2}, ConnTimeout:time.Second, RateLimit:0.1, RateBurst:2})
+  go s.Run(context.Background())
+  defer s.Shutdown(context.Background())
+  
+  assert.Equal(t, "b", readGreeting(t, laddr1))
+  assert.Equal(t, "b", readGreeting(t, laddr2))
+  assert.Equal(t, "", readGreeting(t, laddr1))
+  assert.Equal(t, int64(1), s.Stats().RateLimits.Limited)
+}
+
+func TestAccessControl(t *testing.T) {
+  b, baddr := namedBackend(t, "b")
+  defer b.Close()
+  h := httpBackend("h")
+  defer h.Close()
+  
+  laddr1, laddr2, laddr3, laddr4 := freeAddr(t), freeAddr(t), freeAddr(t), freeAddr(t)
+  routes := make([]*route.Route, 0)
+  for _, e := range []string{
+    laddr1 +"(allow='127.0.0.0/8')="+ baddr,
+    laddr2 +"(allow='10.0.0.0/8')="+ baddr,
+    laddr3 +"(allow='127.0.0.0/8', deny='127.0.0.1', acl_log='true')="+ baddr,
+    laddr4 +"(mode='http', path='/private', deny='127.0.0.1')="+ h.Listener.Addr().String(),
+    laddr4 +"(mode='http')="+ h.Listener.Addr().String(),
+  }{
+    r, err := route.Parse(e)
+    if !assert.Nil(t, err, e) {
+      return
+    }
+    routes = append(routes, r)
+  }
+  
+  s := New(Config{Routes:routes, ConnTimeout:time.Second})
+  go s.Run(context.Background())
+  defer s.Shutdown(context.Background())
+  
+  assert.Equal(t, "b", readGreeting(t, laddr1))
+  assert.Equal(t, "", readGreeting(t, laddr2))
+  assert.Equal(t, "", readGreeting(t, laddr3))
+  
+  // requests are checked against the route they are selected for
+  dialService(t, laddr4).Close()
+  rsp, err := http.Get("http://"+ laddr4 +"/private/x")
+  if assert.Nil(t, err) {
+    rsp.Body.Close()
+    assert.Equal(t, http.StatusForbidden, rsp.StatusCode)
+  }
+  rsp, err = http.Get("http://"+ laddr4 +"/public")
+  if assert.Nil(t, err) {
+    rsp.Body.Close()
+    assert.Equal(t, http.StatusOK, rsp.StatusCode)
+  }
+}
+
+func TestAccessControlBeforeRateLimit(t *testing.T) {
+  b, baddr := namedBackend(t, "b")
+  defer b.Close()
+  
+  laddr := freeAddr(t)
+  r, err := route.Parse(laddr +"(deny='127.0.0.1')="+ baddr)
+  if !assert.Nil(t, err) {
+    return
+  }
+  
+  // denied clients don't use the global rate limit's tokens
+  s := New(Config{Routes:[]*route.Route{r}, ConnTimeout:time.Second, RateLimit:0.1, RateBurst:1})
+  go s.Run(context.Background())
+  defer s.Shutdown(context.Background())
+  
+  for i := 0; i < 3; i++ {
+    assert.Equal(t, "", readGreeting(t, laddr))
+  }
+  assert.Equal(t, int64(0), s.Stats().RateLimits.Limited)
+}
+
+func TestHalfClose(t *testing.T) {
+  // a backend which replies once its client has finished sending
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer l.Close()
+  go func() {
+    for {
+      c, err := l.Accept()
+      if err != nil {
+        return
+      }
+      go func(){
+        defer c.Close()
+        b, _ := ioutil.ReadAll(c)
+        c.Write([]byte(strings.ToUpper(string(b))))
+      }()
+    }
+  }()
+  
+  // whether connections are copied or spliced
+  for _, optimize := range []bool{false, true} {
+    laddr := freeAddr(t)
+    r, err := route.Parse(laddr +"="+ l.Addr().String())
+    if !assert.Nil(t, err) {
+      return
+    }
+    
+    s := New(Config{Routes:[]*route.Route{r}, ConnTimeout:time.Second, ReadTimeout:time.Second * 5, Optimize:optimize})
+    go s.Run(context.Background())
+    
+    c := dialService(t, laddr)
+    c.SetDeadline(time.Now().Add(time.Second * 2))
+    _, err = c.Write([]byte("hello"))
+    if assert.Nil(t, err) {
+      assert.Nil(t, c.(*net.TCPConn).CloseWrite())
+      b, err := ioutil.ReadAll(c)
+      assert.Nil(t, err)
+      assert.Equal(t, "HELLO", string(b))
+    }
+    c.Close()
+    s.Shutdown(context.Background())
+  }
+}
+
+func TestConnPool(t *testing.T) {
+  // an echo backend which counts the connections it accepts
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer l.Close()
+  var accepted int64
+  go func() {
+    for {
+      c, err := l.Accept()
+      if err != nil {
+        return
+      }
+      atomic.AddInt64(&accepted, 1)
+      go func(){
+        defer c.Close()
+        io.Copy(c, c)
+      }()
+    }
+  }()
+  await := func(n int64) bool {
+    for i := 0; i < 100 && atomic.LoadInt64(&accepted) < n; i++ {
+      <- time.After(time.Millisecond * 20)
+    }
+    return atomic.LoadInt64(&accepted) >= n
+  }
+  
+  baddr := l.Addr().String()
+  laddr := freeAddr(t)
+  r, err := route.Parse(laddr +"="+ baddr +"(pool_min='2', pool_idle='1s')")
+  if !assert.Nil(t, err) {
+    return
+  }
+  
+  s := New(Config{Routes:[]*route.Route{r}, ConnTimeout:time.Second})
+  go s.Run(context.Background())
+  defer s.Shutdown(context.Background())
+  
+  // the pool is filled before any client connects
+  assert.True(t, await(2))
+  
+  // a client is handed an idle connection and the pool is refilled
+  c := dialService(t, laddr)
+  defer c.Close()
+  assert.Equal(t, "pooled", echo(t, c, "pooled"))
+  assert.True(t, await(3))
+  p := s.Stats().BackendPools[baddr]
+  assert.Equal(t, int64(1), p.Hits)
+  assert.Equal(t, int64(0), p.Misses)
+  
+  // idle connections expire and are replaced
+  assert.True(t, await(5))
+  assert.True(t, s.Stats().BackendPools[baddr].Expired >= 2)
+  
+  // pooled backends cannot send the PROXY protocol
+  x, err := route.Parse(laddr +"="+ baddr +"(pool_min='2', proxy_protocol='v1')")
+  if assert.Nil(t, err) {
+    assert.NotNil(t, s.Reload([]*route.Route{x}))
+  }
+}
@@ -0,0 +1,66 @@
+package service
+
+import (
+  "io"
+  "net"
+  "time"
+  "bytes"
+  "errors"
+  "crypto/tls"
+)
+
+// Returned when a ClientHello has been read
+var errPeeked = errors.New("Peeked ClientHello")
+
+// Read the server name a client requests in its TLS ClientHello. The bytes
+// read are not consumed: the returned connection replays them before reading
+// anything further from the client. If the client does not request a name,
+// the name is empty.
+func peekServerName(c net.Conn, timeout time.Duration) (string, net.Conn, error) {
+  var name string
+  var peeked bool
+  buf := &bytes.Buffer{}
+  
+  c.SetReadDeadline(time.Now().Add(timeout))
+  err := tls.Server(readOnlyConn{io.TeeReader(c, buf)}, &tls.Config{
+    GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+      name, peeked = h.ServerName, true
+      return nil, errPeeked
+    },
+  }).Handshake()
+  if !peeked {
+    return "", nil, err
+  }
+  c.SetReadDeadline(time.Time{})
+  
+  return name, &peekedConn{c, io.MultiReader(buf, c)}, nil
+}
+
+// A connection which replays bytes that were already read from it
+type peekedConn struct {
+  net.Conn
+  reader io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+  return c.reader.Read(b)
+}
+
+func (c *peekedConn) CloseWrite() error {
+  return closeWrite(c.Conn)
+}
+
+// A connection which can only be read from, used to parse a ClientHello
+// without responding to it
+type readOnlyConn struct {
+  reader io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)         { return c.reader.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
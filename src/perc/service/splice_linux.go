@@ -0,0 +1,134 @@
+package service
+
+import (
+  "io"
+  "os"
+  "net"
+  "syscall"
+  "sync/atomic"
+)
+
+import (
+  "golang.org/x/sys/unix"
+  "golang.org/x/net/trace"
+  "github.com/bww/go-alert"
+  "github.com/bww/go-util/debug"
+  "github.com/rcrowley/go-metrics"
+)
+
+// Splices never block; the runtime's poller waits for the sockets instead
+const spliceFlags = unix.SPLICE_F_MOVE | unix.SPLICE_F_NONBLOCK
+
+// Whether zero-copy transfer is supported on this platform
+const ZeroCopy = true
+
+// Determine whether data can be spliced from one connection to another. Both
+// must be plain sockets; connections which are encrypted or which have
+// buffered data that has already been read, like those which accepted a PROXY
+// protocol header, must be copied.
+func spliceable(dst, src net.Conn) bool {
+  return isSocket(dst) && isSocket(src)
+}
+
+// Determine whether a connection is a plain socket
+func isSocket(c net.Conn) bool {
+  switch c.(type) {
+    case *net.TCPConn, *net.UnixConn:
+      return true
+    default:
+      return false
+  }
+}
+
+// Copy from a source to destination connection with splice(2), moving data
+// through a pipe in the kernel rather than through user space. At most size
+// bytes are moved at once, bytes are accounted for, and deadlines are applied
+// as they are by copyGeneric. If a pipe can't be created the connections are
+// copied instead.
+func (s *Service) copySplice(dst, src net.Conn, size int, tr trace.Trace, xfer metrics.Meter, errs chan<- error) {
+  var p [2]int
+  err := unix.Pipe2(p[:], unix.O_CLOEXEC | unix.O_NONBLOCK)
+  if err != nil {
+    if debug.VERBOSE {
+      alt.Debugf("service: Could not create pipe; copying instead: %v", err)
+    }
+    s.copyGeneric(dst, src, size, tr, xfer, errs)
+    return
+  }
+  defer unix.Close(p[0])
+  defer unix.Close(p[1])
+  
+  rc, err := src.(syscall.Conn).SyscallConn()
+  if err != nil {
+    s.copyGeneric(dst, src, size, tr, xfer, errs)
+    return
+  }
+  wc, err := dst.(syscall.Conn).SyscallConn()
+  if err != nil {
+    s.copyGeneric(dst, src, size, tr, xfer, errs)
+    return
+  }
+  
+  var copied int64
+  atomic.AddInt64(&s.copyOpen, 1)
+  defer func(){
+    atomic.AddInt64(&s.copyOpen, -1)
+    close(errs)
+  }()
+  
+  deadlines := newDeadlines(src, s.rto, s.wto)
+  for {
+    // fill the pipe from the source
+    var nr int64
+    var er error
+    err = rc.Read(func(fd uintptr) bool {
+      nr, er = unix.Splice(int(fd), nil, p[1], nil, size, spliceFlags)
+      return er != unix.EAGAIN && er != unix.EINTR
+    })
+    if err == nil && er != nil {
+      err = os.NewSyscallError("splice", er)
+    }
+    if nr > 0 {
+      xfer.Mark(nr) // read side is instrumented
+      atomic.AddInt64(&s.handlerXfer, nr)
+    }
+    deadlines.Extend()
+    if err != nil {
+      errs <- err
+      break
+    }
+    if nr == 0 {
+      break // EOF
+    }
+  
+    // drain the pipe into the destination
+    for nr > 0 && err == nil {
+      var nw int64
+      var ew error
+      err = wc.Write(func(fd uintptr) bool {
+        nw, ew = unix.Splice(p[0], nil, int(fd), nil, int(nr), spliceFlags)
+        return ew != unix.EAGAIN && ew != unix.EINTR
+      })
+      if err == nil && ew != nil {
+        err = os.NewSyscallError("splice", ew)
+      }
+      if nw > 0 {
+        nr -= nw
+        copied += nw
+      }else if err == nil {
+        err = io.ErrShortWrite
+      }
+    }
+    if err != nil {
+      errs <- err
+      break
+    }
+  }
+  
+  if debug.VERBOSE && copied > 0 {
+    alt.Debugf("%v -> %v: spliced %d", src.RemoteAddr(), dst.RemoteAddr(), copied)
+  }
+  if tr != nil {
+    tr.LazyPrintf("%v -> %v: spliced %d", src.RemoteAddr(), dst.RemoteAddr(), copied)
+  }
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+
+package service
+
+import (
+  "net"
+)
+
+import (
+  "golang.org/x/net/trace"
+  "github.com/rcrowley/go-metrics"
+)
+
+// Whether zero-copy transfer is supported on this platform
+const ZeroCopy = false
+
+// Data is never spliced on this platform
+func spliceable(dst, src net.Conn) bool {
+  return false
+}
+
+// Copy from a source to destination connection
+func (s *Service) copySplice(dst, src net.Conn, size int, tr trace.Trace, xfer metrics.Meter, errs chan<- error) {
+  s.copyGeneric(dst, src, size, tr, xfer, errs)
+}
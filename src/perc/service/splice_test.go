@@ -0,0 +1,112 @@
+package service
+
+import (
+  "io"
+  "net"
+  "bytes"
+  "testing"
+  "runtime"
+  "io/ioutil"
+  "math/rand"
+  
+  "perc/route"
+)
+
+import (
+  "golang.org/x/net/trace"
+  "github.com/stretchr/testify/assert"
+  "github.com/rcrowley/go-metrics"
+)
+
+// Open a pair of connected TCP connections
+func tcpPair(t testing.TB) (net.Conn, net.Conn) {
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer l.Close()
+  a, err := net.Dial("tcp", l.Addr().String())
+  if err != nil {
+    t.Fatal(err)
+  }
+  b, err := l.Accept()
+  if err != nil {
+    t.Fatal(err)
+  }
+  return a, b
+}
+
+func TestSplice(t *testing.T) {
+  s := New(Config{Optimize:true})
+  in, src := tcpPair(t)
+  defer in.Close()
+  defer src.Close()
+  dst, out := tcpPair(t)
+  defer dst.Close()
+  defer out.Close()
+  assert.Equal(t, runtime.GOOS == "linux", spliceable(dst, src))
+  
+  data := make([]byte, 1024 * 1024 + 17)
+  rand.Read(data)
+  errs := make(chan error, 1)
+  xfer := metrics.NewMeter()
+  go s.transfer(dst, src, route.DefaultBufferSize, nil, xfer, errs)
+  go func() {
+    in.Write(data)
+    in.(*net.TCPConn).CloseWrite()
+  }()
+  
+  buf := make([]byte, len(data))
+  _, err := io.ReadFull(out, buf)
+  if assert.Nil(t, err) {
+    assert.True(t, bytes.Equal(data, buf))
+  }
+  err, ok := <- errs
+  assert.False(t, ok, "Unexpected error: %v", err)
+  assert.Equal(t, int64(len(data)), xfer.Count())
+  assert.Equal(t, int64(len(data)), s.Stats().BytesTransferred)
+}
+
+// Measure transfer between connections with the provided copier
+func benchmarkTransfer(b *testing.B, copier func(*Service) func(net.Conn, net.Conn, int, trace.Trace, metrics.Meter, chan<- error)) {
+  s := New(Config{Optimize:true})
+  in, src := tcpPair(b)
+  defer in.Close()
+  defer src.Close()
+  dst, out := tcpPair(b)
+  defer dst.Close()
+  defer out.Close()
+  
+  chunk := make([]byte, 64 * 1024)
+  errs := make(chan error, 1)
+  go copier(s)(dst, src, route.DefaultBufferSize, nil, metrics.NewMeter(), errs)
+  done := make(chan int64)
+  go func() {
+    n, _ := io.Copy(ioutil.Discard, out)
+    done <- n
+  }()
+  
+  b.SetBytes(int64(len(chunk)))
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    in.Write(chunk)
+  }
+  in.(*net.TCPConn).CloseWrite()
+  <- errs
+  dst.(*net.TCPConn).CloseWrite()
+  if n := <- done; n != int64(b.N * len(chunk)) {
+    b.Fatalf("Transferred %d bytes; expected %d", n, b.N * len(chunk))
+  }
+}
+
+func BenchmarkCopyGeneric(b *testing.B) {
+  benchmarkTransfer(b, func(s *Service) func(net.Conn, net.Conn, int, trace.Trace, metrics.Meter, chan<- error) {
+    return s.copyGeneric
+  })
+}
+
+func BenchmarkCopySplice(b *testing.B) {
+  benchmarkTransfer(b, func(s *Service) func(net.Conn, net.Conn, int, trace.Trace, metrics.Meter, chan<- error) {
+    return s.copySplice
+  })
+}
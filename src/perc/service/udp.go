@@ -0,0 +1,369 @@
+package service
+
+import (
+  "fmt"
+  "net"
+  "sync"
+  "time"
+  "sync/atomic"
+  
+  "perc/route"
+)
+
+import (
+  "golang.org/x/net/trace"
+  "github.com/bww/go-alert"
+  "github.com/bww/go-util/debug"
+  "github.com/rcrowley/go-metrics"
+)
+
+// The largest datagram which may be proxied
+const maxDatagram = 64 * 1024
+
+// The most clients of a UDP server whose rejection is remembered at once
+const maxRejected = 4096
+
+var (
+  proxyFlowExpire metrics.Meter
+  proxyPacketError metrics.Meter
+)
+
+func init() {
+  proxyFlowExpire = metrics.NewMeter()
+  metrics.Register("percolator.proxy.flow.expire", proxyFlowExpire)
+  proxyPacketError = metrics.NewMeter()
+  metrics.Register("percolator.proxy.packet.error", proxyPacketError)
+}
+
+// A flow is the datagrams exchanged between one client of a UDP route and the
+// backend address it was assigned. Datagrams from the client are sent to the
+// backend and its replies are relayed back until the flow has been idle for
+// the route's flow timeout.
+type flow struct {
+  route   *route.Route
+  client  net.Addr
+  target  target
+  conn    net.Conn
+  tr      trace.Trace
+  limit   *limiter
+  last    int64 // when a datagram was last exchanged, in nanoseconds
+  closed  int32
+}
+
+// Record activity on a flow
+func (f *flow) touch() {
+  atomic.StoreInt64(&f.last, time.Now().UnixNano())
+}
+
+// Obtain when a flow expires if there is no more activity
+func (f *flow) expires() time.Time {
+  return time.Unix(0, atomic.LoadInt64(&f.last)).Add(f.route.FlowTimeout())
+}
+
+// Close a flow's backend connection, which ends its relay
+func (f *flow) close() {
+  if atomic.CompareAndSwapInt32(&f.closed, 0, 1) {
+    f.conn.Close()
+  }
+}
+
+// Handle datagrams for a UDP server until it is closed. Each client address
+// is assigned a backend address by the route's balancer when its first
+// datagram arrives and the flow between them is tracked until it expires. A
+// client which is rejected has its datagrams dropped for the route's flow
+// timeout before it is considered again.
+func (s *Service) serveUDP(e *server) {
+  var lock sync.Mutex
+  var relays sync.WaitGroup
+  flows := make(map[string]*flow)
+  rejected := make(map[string]time.Time)
+  defer func() {
+    lock.Lock()
+    for _, f := range flows {
+      f.close()
+    }
+    lock.Unlock()
+    relays.Wait()
+  }()
+  
+  buf := make([]byte, maxDatagram)
+  for {
+    n, addr, err := e.packets.ReadFrom(buf)
+    if err != nil {
+      if s.isClosing(e) {
+        return
+      }
+      alt.Errorf("service: Could not read datagram: %v", err)
+      continue
+    }
+    proxyBytesWriteRate.Mark(int64(n))
+    atomic.AddInt64(&s.handlerXfer, int64(n))
+  
+    k := addr.String()
+    lock.Lock()
+    f := flows[k]
+    lock.Unlock()
+    if f == nil || atomic.LoadInt32(&f.closed) != 0 {
+      if t, ok := rejected[k]; ok {
+        if time.Now().Before(t) {
+          proxyPacketError.Mark(1)
+          continue
+        }
+        delete(rejected, k)
+      }
+      var ok bool
+      f, ok = s.openFlow(e, addr)
+      if f == nil {
+        proxyPacketError.Mark(1)
+        if !ok {
+          s.reject(e, rejected, k)
+        }
+        continue
+      }
+      lock.Lock()
+      flows[k] = f
+      lock.Unlock()
+      relays.Add(1)
+      go func(){
+        defer relays.Done()
+        s.relay(e, f)
+        lock.Lock()
+        if flows[k] == f {
+          delete(flows, k)
+        }
+        lock.Unlock()
+      }()
+    }
+  
+    f.touch()
+    _, err = f.conn.Write(buf[:n])
+    if err != nil {
+      // the backend refused a previous datagram; the next datagram from this
+      // client starts a new flow
+      proxyPacketError.Mark(1)
+      s.detector.Failure(f.target.addr, f.target.backend)
+      if debug.VERBOSE {
+        alt.Debugf("service: %v -> %v (%v): Could not send datagram: %v", addr, f.target.addr, f.target.backend, err)
+      }
+      if f.tr != nil {
+        f.tr.LazyPrintf("%v -> %v (%v): Could not send datagram: %v", addr, f.target.addr, f.target.backend, err)
+        f.tr.SetError()
+      }
+      f.close()
+    }
+  }
+}
+
+// Remember that a client of a UDP server was rejected until the route's flow
+// timeout has passed. When too many clients are remembered those which have
+// expired are forgotten, and if none have the client is not remembered.
+func (s *Service) reject(e *server, rejected map[string]time.Time, k string) {
+  now := time.Now()
+  if len(rejected) >= maxRejected {
+    for c, t := range rejected {
+      if !now.Before(t) {
+        delete(rejected, c)
+      }
+    }
+    if len(rejected) >= maxRejected {
+      return
+    }
+  }
+  s.Lock()
+  d := e.frontends[0].route.FlowTimeout()
+  s.Unlock()
+  rejected[k] = now.Add(d)
+}
+
+// Open a flow for a client of a UDP server. Failures are logged and traced
+// and nil is returned; if the client was rejected by access control or a
+// limit, rather than failing to reach a backend, false is also returned.
+func (s *Service) openFlow(e *server, client net.Addr) (*flow, bool) {
+  s.Lock()
+  f := e.frontends[0]
+  s.Unlock()
+  r := f.route
+  
+  var caddr string
+  if h, _, err := net.SplitHostPort(client.String()); err == nil {
+    caddr = h
+  }else{
+    caddr = "<unknown>"
+  }
+  if !s.permit(f, caddr) {
+    return nil, false
+  }
+  
+  var tr trace.Trace
+  if s.debug {
+    var b string
+    if r.Service {
+      b = r.Any().String()
+    }else{
+      b = "<next>"
+    }
+    tr = trace.New("perc.Service", fmt.Sprintf("%v -> %v (udp)", caddr, b))
+  }
+  
+  // the read loop can't wait for a token or a slot, so flows over a limit
+  // are rejected
+  if !s.throttle(nil, caddr, nil) || !s.throttle(r, caddr, nil) {
+    if debug.VERBOSE {
+      alt.Debugf("service: %v: Rejected flow; client exceeded the rate limit", client)
+    }
+    if tr != nil {
+      tr.LazyPrintf("Client exceeded the rate limit")
+      tr.SetError()
+      tr.Finish()
+    }
+    return nil, false
+  }
+  x, ok := s.limits.Admit(r, e.done, false)
+  if !ok {
+    if debug.VERBOSE {
+      alt.Debugf("service: %v: Rejected flow; route is at its connection limit: %v", client, r.Key())
+    }
+    if tr != nil {
+      tr.LazyPrintf("Route is at its connection limit")
+      tr.SetError()
+      tr.Finish()
+    }
+    return nil, false
+  }
+  
+  start := time.Now()
+  targets, bound, err := s.resolve(r, caddr, tr)
+  if err != nil {
+    x.Release()
+    if tr != nil {
+      tr.Finish()
+    }
+    return nil, true
+  }
+  proxyResolveTimer.Update(time.Since(start))
+  
+  var t target
+  var p net.Conn
+  var i int
+  for _, v := range targets {
+    if i >= s.attempts {
+      break
+    }
+    if !s.limits.Reserve(v.addr, v.backend) {
+      continue
+    }
+    if i > 0 {
+      proxyDialRetry.Mark(1)
+    }
+    i++
+    t = v
+    p, err = net.DialTimeout("udp", t.addr, s.cto)
+    if err == nil {
+      break
+    }
+    s.limits.Unreserve(t.addr)
+    s.detector.Failure(t.addr, t.backend)
+    if tr != nil {
+      tr.LazyPrintf("%v: Could not connect to backend: %v (%v): %v", client, t.addr, t.backend, err)
+    }
+  }
+  if i == 0 && len(targets) > 0 {
+    err = ErrBackendsFull
+  }else{
+    s.count(r, t, caddr)
+  }
+  if p == nil {
+    x.Release()
+    proxyConnError.Mark(1)
+    if debug.VERBOSE {
+      alt.Debugf("service: %v: Could not connect to any backend: %v", client, err)
+    }
+    if tr != nil {
+      tr.LazyPrintf("%v: Could not connect to any backend: %v", client, err)
+      tr.SetError()
+      tr.Finish()
+    }
+    return nil, true
+  }
+  s.bind(r, caddr, bound, t.addr)
+  
+  if debug.VERBOSE {
+    alt.Debugf("%v: Opened flow: %v (%v)", client, t.addr, t.backend)
+  }
+  if tr != nil {
+    tr.LazyPrintf("%v: Opened flow: %v (%v)", client, t.addr, t.backend)
+  }
+  return &flow{route:r, client:client, target:t, conn:p, tr:tr, limit:x, last:time.Now().UnixNano()}, true
+}
+
+// Relay replies from a flow's backend to its client until the flow expires or
+// is closed
+func (s *Service) relay(e *server, f *flow) {
+  t := f.target
+  balancer := f.route.Balancer()
+  balancer.Acquire(t.addr)
+  atomic.AddInt64(&s.handlerOpen, 1)
+  atomic.AddInt64(&s.handlerTotal, 1)
+  defer func() {
+    f.close()
+    atomic.AddInt64(&s.handlerOpen, -1)
+    balancer.Release(t.addr)
+    s.limits.Unreserve(t.addr)
+    f.limit.Release()
+    if f.tr != nil {
+      f.tr.Finish()
+    }
+  }()
+  
+  var replied bool
+  buf := make([]byte, maxDatagram)
+  for {
+    f.conn.SetReadDeadline(f.expires())
+    n, err := f.conn.Read(buf)
+    if err != nil {
+      if atomic.LoadInt32(&f.closed) != 0 {
+        return
+      }
+      if isTimeout(err) {
+        if time.Now().Before(f.expires()) {
+          continue // the client sent something since the deadline was set
+        }
+        proxyFlowExpire.Mark(1)
+        if debug.VERBOSE {
+          alt.Debugf("%v: Flow expired: %v (%v)", f.client, t.addr, t.backend)
+        }
+        if f.tr != nil {
+          f.tr.LazyPrintf("%v: Flow expired: %v (%v)", f.client, t.addr, t.backend)
+        }
+        return
+      }
+      proxyPacketError.Mark(1)
+      s.detector.Failure(t.addr, t.backend)
+      if debug.VERBOSE {
+        alt.Debugf("service: %v -> %v (%v): Could not receive datagram: %v", f.client, t.addr, t.backend, err)
+      }
+      if f.tr != nil {
+        f.tr.LazyPrintf("%v -> %v (%v): Could not receive datagram: %v", f.client, t.addr, t.backend, err)
+        f.tr.SetError()
+      }
+      return
+    }
+  
+    if !replied {
+      s.detector.Success(t.addr, t.backend)
+      replied = true
+    }
+    f.touch()
+    proxyBytesReadRate.Mark(int64(n))
+    atomic.AddInt64(&s.handlerXfer, int64(n))
+    if _, err := e.packets.WriteTo(buf[:n], f.client); err != nil {
+      if s.isClosing(e) {
+        return
+      }
+      proxyXferError.Mark(1)
+      if debug.VERBOSE {
+        alt.Debugf("service: %v -> %v (%v): Could not relay datagram: %v", f.client, t.addr, t.backend, err)
+      }
+    }
+  }
+}
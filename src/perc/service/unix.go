@@ -0,0 +1,96 @@
+package service
+
+import (
+  "os"
+  "fmt"
+  "net"
+  "time"
+  "strconv"
+  "os/user"
+  
+  "perc/route"
+)
+
+// Listen on a Unix socket for a route. A socket file left behind by a process
+// which is no longer listening on it is removed first, and the new socket
+// file is given the permissions and ownership the route's params describe.
+// Abstract sockets, whose names begin with '@', have no file.
+func listenUnix(r *route.Route) (net.Listener, error) {
+  path := r.Addr()
+  abstract := path[0] == '@'
+  if !abstract {
+    if err := removeStale(path); err != nil {
+      return nil, err
+    }
+  }
+  
+  l, err := net.Listen("unix", path)
+  if err != nil {
+    return nil, err
+  }
+  if abstract {
+    return l, nil
+  }
+  
+  if v, ok := r.Params[route.ParamSocketMode]; ok {
+    m, _ := strconv.ParseUint(v, 8, 32)
+    err = os.Chmod(path, os.FileMode(m))
+  }
+  if err == nil {
+    err = chown(path, r.Params[route.ParamSocketOwner], r.Params[route.ParamSocketGroup])
+  }
+  if err != nil {
+    l.Close()
+    return nil, err
+  }
+  return l, nil
+}
+
+// Remove a socket file if nothing is listening on it
+func removeStale(path string) error {
+  fi, err := os.Lstat(path)
+  if os.IsNotExist(err) {
+    return nil
+  }else if err != nil {
+    return err
+  }
+  if fi.Mode() & os.ModeSocket == 0 {
+    return fmt.Errorf("Listen path exists and is not a socket: %v", path)
+  }
+  c, err := net.DialTimeout("unix", path, time.Second)
+  if err == nil {
+    c.Close()
+    return fmt.Errorf("Socket is in use: %v", path)
+  }
+  return os.Remove(path)
+}
+
+// Change the ownership of a file to a user and group, by name or id. An empty
+// user or group is left unchanged.
+func chown(path, owner, group string) error {
+  if owner == "" && group == "" {
+    return nil
+  }
+  uid, gid := -1, -1
+  if owner != "" {
+    u, err := user.Lookup(owner)
+    if err != nil {
+      u, err = user.LookupId(owner)
+    }
+    if err != nil {
+      return fmt.Errorf("Invalid socket owner: %v", owner)
+    }
+    uid, _ = strconv.Atoi(u.Uid)
+  }
+  if group != "" {
+    g, err := user.LookupGroup(group)
+    if err != nil {
+      g, err = user.LookupGroupId(group)
+    }
+    if err != nil {
+      return fmt.Errorf("Invalid socket group: %v", group)
+    }
+    gid, _ = strconv.Atoi(g.Gid)
+  }
+  return os.Chown(path, uid, gid)
+}
@@ -0,0 +1,126 @@
+package tlsconfig
+
+import (
+  "fmt"
+  "net"
+  "sync"
+  "strings"
+  "crypto/tls"
+  
+  "perc/route"
+)
+
+// Backend params which configure TLS origination. The tls param enables TLS
+// and is the name the backend's certificate is verified against; if it is
+// empty the host of the backend's address is used. The certificate, key, and
+// version params are shared with listeners, but on a backend they configure
+// the client certificate presented to it.
+const (
+  ParamTLS    = "tls"
+  ParamCA     = "tls_ca"    // a CA bundle the backend's certificate is verified against; the system roots by default
+  ParamALPN   = "tls_alpn"  // comma-separated application protocols offered to the backend
+)
+
+// The number of TLS sessions cached for resumption per backend config
+const sessionCacheSize = 64
+
+// Client configs are derived from these params
+var clientParams = []string{ParamTLS, ParamCA, ParamCert, ParamKey, ParamMinVersion, ParamALPN}
+
+var (
+  clientLock    sync.Mutex
+  clientConfigs = make(map[string]*tls.Config)
+)
+
+// Obtain a config for originating TLS to a backend address from backend
+// params. Certificates and CA bundles are loaded once and the config is shared
+// by every connection with the same params until Reset is called. If the
+// params do not enable TLS, nil is returned. The returned config must not be
+// modified.
+func Client(p map[string]string, addr string) (*tls.Config, error) {
+  name, ok := p[ParamTLS]
+  if !ok {
+    for _, e := range clientParams {
+      if _, ok := p[e]; ok {
+        return nil, fmt.Errorf("TLS param requires the %v param: %v", ParamTLS, e)
+      }
+    }
+    return nil, nil
+  }
+  
+  c, err := client(p)
+  if err != nil {
+    return nil, err
+  }
+  if name == "" {
+    if h, _, err := net.SplitHostPort(addr); err == nil {
+      c = c.Clone()
+      c.ServerName = h
+    }
+  }
+  return c, nil
+}
+
+// Validate the TLS params for a backend
+func Validate(b route.Backend) error {
+  _, err := Client(b.Params, b.Addr)
+  return err
+}
+
+// Discard every cached client config, so the files they were loaded from are
+// read again the next time they are used
+func Reset() {
+  clientLock.Lock()
+  defer clientLock.Unlock()
+  clientConfigs = make(map[string]*tls.Config)
+}
+
+// Obtain the cached config for params, creating it if necessary
+func client(p map[string]string) (*tls.Config, error) {
+  var k string
+  for _, e := range clientParams {
+    if v, ok := p[e]; ok {
+      k += e +"="+ v +";"
+    }
+  }
+  
+  clientLock.Lock()
+  defer clientLock.Unlock()
+  if c, ok := clientConfigs[k]; ok {
+    return c, nil
+  }
+  
+  var err error
+  c := &tls.Config{ServerName:p[ParamTLS], ClientSessionCache:tls.NewLRUClientSessionCache(sessionCacheSize)}
+  if c.MinVersion, err = version(p, ParamMinVersion, 0); err != nil {
+    return nil, err
+  }
+  if v, ok := p[ParamCA]; ok {
+    if c.RootCAs, err = LoadCA(v); err != nil {
+      return nil, err
+    }
+  }
+  
+  cert, hasCert := p[ParamCert]
+  key, hasKey := p[ParamKey]
+  if hasCert != hasKey {
+    return nil, fmt.Errorf("TLS client certificate requires both %v and %v", ParamCert, ParamKey)
+  }else if hasCert {
+    pair, err := tls.LoadX509KeyPair(cert, key)
+    if err != nil {
+      return nil, fmt.Errorf("Could not load TLS client certificate: %v", err)
+    }
+    c.Certificates = []tls.Certificate{pair}
+  }
+  
+  if v, ok := p[ParamALPN]; ok {
+    for _, e := range strings.Split(v, ",") {
+      if e = strings.TrimSpace(e); e != "" {
+        c.NextProtos = append(c.NextProtos, e)
+      }
+    }
+  }
+  
+  clientConfigs[k] = c
+  return c, nil
+}
@@ -0,0 +1,70 @@
+package tlsconfig
+
+import (
+  "testing"
+  "crypto/tls"
+  
+  "perc/route"
+  "perc/tlsconfig/tlstest"
+)
+
+import (
+  "github.com/stretchr/testify/assert"
+)
+
+func TestClient(t *testing.T) {
+  f, err := tlstest.Generate()
+  if !assert.Nil(t, err) {
+    return
+  }
+  defer f.Remove()
+  
+  c, err := Client(map[string]string{}, "localhost:443")
+  assert.Nil(t, err)
+  assert.Nil(t, c)
+  
+  p := map[string]string{ParamTLS: "example.com", ParamCA: f.CA, ParamCert: f.ClientCert, ParamKey: f.ClientKey, ParamMinVersion: "1.2", ParamALPN: "h2, http/1.1"}
+  c, err = Client(p, "localhost:443")
+  if assert.Nil(t, err) {
+    assert.Equal(t, "example.com", c.ServerName)
+    assert.NotNil(t, c.RootCAs)
+    assert.Equal(t, 1, len(c.Certificates))
+    assert.Equal(t, uint16(tls.VersionTLS12), c.MinVersion)
+    assert.Equal(t, []string{"h2", "http/1.1"}, c.NextProtos)
+  }
+  
+  // configs are shared until they are reset
+  x, err := Client(p, "other:443")
+  if assert.Nil(t, err) {
+    assert.True(t, c == x)
+  }
+  Reset()
+  x, err = Client(p, "localhost:443")
+  if assert.Nil(t, err) {
+    assert.False(t, c == x)
+  }
+  
+  // without a name, the address' host is verified
+  c, err = Client(map[string]string{ParamTLS: ""}, "localhost:443")
+  if assert.Nil(t, err) {
+    assert.Equal(t, "localhost", c.ServerName)
+  }
+}
+
+func TestClientErrors(t *testing.T) {
+  f, err := tlstest.Generate()
+  if !assert.Nil(t, err) {
+    return
+  }
+  defer f.Remove()
+  
+  for _, e := range []map[string]string{
+    {ParamCA: f.CA},
+    {ParamTLS: "", ParamCert: f.ClientCert},
+    {ParamTLS: "", ParamCert: f.ClientCert, ParamKey: f.ServerKey},
+    {ParamTLS: "", ParamCA: f.ClientKey},
+    {ParamTLS: "", ParamMinVersion: "1.4"},
+  }{
+    assert.NotNil(t, Validate(route.Backend{Addr:"localhost:443", Params:e}), e)
+  }
+}
@@ -0,0 +1,144 @@
+package tlsconfig
+
+import (
+  "fmt"
+  "strings"
+  "crypto/tls"
+  "crypto/x509"
+  "io/ioutil"
+)
+
+// Listener params which configure TLS termination
+const (
+  ParamCert         = "tls_cert"        // the certificate file, in PEM format; setting it enables TLS
+  ParamKey          = "tls_key"         // the private key file for the certificate, in PEM format
+  ParamClientCA     = "tls_client_ca"   // a CA bundle client certificates are verified against
+  ParamClientAuth   = "tls_client_auth" // whether client certificates are required or optional: require, optional
+  ParamMinVersion   = "tls_min_version" // the minimum TLS version accepted: 1.0, 1.1, 1.2, 1.3
+  ParamMaxVersion   = "tls_max_version" // the maximum TLS version accepted
+  ParamCiphers      = "tls_ciphers"     // comma-separated cipher suites accepted for TLS 1.2 and earlier
+)
+
+// Client authentication modes
+const (
+  ClientAuthRequire   = "require"
+  ClientAuthOptional  = "optional"
+)
+
+// The minimum TLS version accepted by default
+const DefaultMinVersion = tls.VersionTLS12
+
+var versions = map[string]uint16{
+  "1.0": tls.VersionTLS10,
+  "1.1": tls.VersionTLS11,
+  "1.2": tls.VersionTLS12,
+  "1.3": tls.VersionTLS13,
+}
+
+// Create a config for terminating TLS on a listener from its params. The
+// certificate and any CA bundle are loaded from disk. If the params do not
+// enable TLS, nil is returned.
+func Server(p map[string]string) (*tls.Config, error) {
+  cert, ok := p[ParamCert]
+  if !ok {
+    for _, e := range []string{ParamKey, ParamClientCA, ParamClientAuth, ParamMinVersion, ParamMaxVersion, ParamCiphers} {
+      if _, ok := p[e]; ok {
+        return nil, fmt.Errorf("TLS param requires a certificate: %v", e)
+      }
+    }
+    return nil, nil
+  }
+  
+  key, ok := p[ParamKey]
+  if !ok {
+    return nil, fmt.Errorf("TLS certificate requires a key: %v", cert)
+  }
+  pair, err := tls.LoadX509KeyPair(cert, key)
+  if err != nil {
+    return nil, fmt.Errorf("Could not load TLS certificate: %v", err)
+  }
+  
+  c := &tls.Config{Certificates:[]tls.Certificate{pair}}
+  if c.MinVersion, err = version(p, ParamMinVersion, DefaultMinVersion); err != nil {
+    return nil, err
+  }
+  if c.MaxVersion, err = version(p, ParamMaxVersion, 0); err != nil {
+    return nil, err
+  }
+  if c.MaxVersion != 0 && c.MaxVersion < c.MinVersion {
+    return nil, fmt.Errorf("Maximum TLS version is less than the minimum")
+  }
+  if v, ok := p[ParamCiphers]; ok {
+    if c.CipherSuites, err = ciphers(v); err != nil {
+      return nil, err
+    }
+  }
+  
+  if v, ok := p[ParamClientCA]; ok {
+    if c.ClientCAs, err = LoadCA(v); err != nil {
+      return nil, err
+    }
+    switch a := p[ParamClientAuth]; a {
+      case "", ClientAuthRequire:
+        c.ClientAuth = tls.RequireAndVerifyClientCert
+      case ClientAuthOptional:
+        c.ClientAuth = tls.VerifyClientCertIfGiven
+      default:
+        return nil, fmt.Errorf("Unsupported TLS client authentication: %v", a)
+    }
+  }else if _, ok := p[ParamClientAuth]; ok {
+    return nil, fmt.Errorf("TLS client authentication requires a CA bundle")
+  }
+  
+  return c, nil
+}
+
+// Validate the TLS params for a listener
+func ValidateListener(p map[string]string) error {
+  _, err := Server(p)
+  return err
+}
+
+// Load a CA bundle, in PEM format
+func LoadCA(path string) (*x509.CertPool, error) {
+  d, err := ioutil.ReadFile(path)
+  if err != nil {
+    return nil, fmt.Errorf("Could not load CA bundle: %v", err)
+  }
+  pool := x509.NewCertPool()
+  if !pool.AppendCertsFromPEM(d) {
+    return nil, fmt.Errorf("No certificates in CA bundle: %v", path)
+  }
+  return pool, nil
+}
+
+// Parse a TLS version param
+func version(p map[string]string, name string, def uint16) (uint16, error) {
+  v, ok := p[name]
+  if !ok {
+    return def, nil
+  }
+  n, ok := versions[v]
+  if !ok {
+    return 0, fmt.Errorf("Unsupported TLS version: %v", v)
+  }
+  return n, nil
+}
+
+// Parse a list of cipher suite names
+func ciphers(v string) ([]uint16, error) {
+  known := make(map[string]uint16)
+  for _, e := range tls.CipherSuites() {
+    known[e.Name] = e.ID
+  }
+  var c []uint16
+  for _, e := range strings.Split(v, ",") {
+    n := strings.TrimSpace(e)
+    id, ok := known[n]
+    if !ok {
+      return nil, fmt.Errorf("Unsupported TLS cipher suite: %v", n)
+    }
+    c = append(c, id)
+  }
+  return c, nil
+}
@@ -0,0 +1,72 @@
+package tlsconfig
+
+import (
+  "testing"
+  "crypto/tls"
+  
+  "perc/tlsconfig/tlstest"
+)
+
+import (
+  "github.com/stretchr/testify/assert"
+)
+
+func TestServer(t *testing.T) {
+  f, err := tlstest.Generate()
+  if !assert.Nil(t, err) {
+    return
+  }
+  defer f.Remove()
+  
+  c, err := Server(map[string]string{})
+  assert.Nil(t, err)
+  assert.Nil(t, c)
+  
+  c, err = Server(map[string]string{ParamCert: f.ServerCert, ParamKey: f.ServerKey})
+  if assert.Nil(t, err) {
+    assert.Equal(t, 1, len(c.Certificates))
+    assert.Equal(t, uint16(tls.VersionTLS12), c.MinVersion)
+    assert.Equal(t, tls.NoClientCert, c.ClientAuth)
+  }
+  
+  c, err = Server(map[string]string{
+    ParamCert: f.ServerCert,
+    ParamKey: f.ServerKey,
+    ParamClientCA: f.CA,
+    ParamMinVersion: "1.3",
+    ParamCiphers: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+  })
+  if assert.Nil(t, err) {
+    assert.Equal(t, uint16(tls.VersionTLS13), c.MinVersion)
+    assert.Equal(t, tls.RequireAndVerifyClientCert, c.ClientAuth)
+    assert.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}, c.CipherSuites)
+  }
+  
+  c, err = Server(map[string]string{ParamCert: f.ServerCert, ParamKey: f.ServerKey, ParamClientCA: f.CA, ParamClientAuth: ClientAuthOptional})
+  if assert.Nil(t, err) {
+    assert.Equal(t, tls.VerifyClientCertIfGiven, c.ClientAuth)
+  }
+}
+
+func TestServerErrors(t *testing.T) {
+  f, err := tlstest.Generate()
+  if !assert.Nil(t, err) {
+    return
+  }
+  defer f.Remove()
+  
+  for _, e := range []map[string]string{
+    {ParamKey: f.ServerKey},
+    {ParamCert: f.ServerCert},
+    {ParamCert: f.ServerCert, ParamKey: f.ClientKey},
+    {ParamCert: f.ServerCert, ParamKey: f.ServerKey, ParamMinVersion: "2.0"},
+    {ParamCert: f.ServerCert, ParamKey: f.ServerKey, ParamMinVersion: "1.3", ParamMaxVersion: "1.2"},
+    {ParamCert: f.ServerCert, ParamKey: f.ServerKey, ParamCiphers: "TLS_ROT13"},
+    {ParamCert: f.ServerCert, ParamKey: f.ServerKey, ParamClientAuth: ClientAuthRequire},
+    {ParamCert: f.ServerCert, ParamKey: f.ServerKey, ParamClientCA: f.CA, ParamClientAuth: "sometimes"},
+    {ParamCert: f.ServerCert, ParamKey: f.ServerKey, ParamClientCA: f.ServerKey},
+  }{
+    _, err := Server(e)
+    assert.NotNil(t, err, e)
+  }
+}
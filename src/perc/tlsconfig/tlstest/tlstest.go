@@ -0,0 +1,124 @@
+package tlstest
+
+import (
+  "os"
+  "net"
+  "time"
+  "math/big"
+  "crypto/rand"
+  "crypto/x509"
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "encoding/pem"
+  "path/filepath"
+  "io/ioutil"
+  "crypto/x509/pkix"
+)
+
+// Certificate files generated for a test. The server certificate is valid for
+// localhost and 127.0.0.1; both it and the client certificate are signed by
+// the CA.
+type Files struct {
+  Dir         string
+  CA          string
+  ServerCert  string
+  ServerKey   string
+  ClientCert  string
+  ClientKey   string
+}
+
+// Remove the generated files
+func (f Files) Remove() error {
+  return os.RemoveAll(f.Dir)
+}
+
+// Generate a CA, a server certificate, and a client certificate in a new
+// temporary directory
+func Generate() (Files, error) {
+  dir, err := ioutil.TempDir("", "perc-tls-")
+  if err != nil {
+    return Files{}, err
+  }
+  f := Files{
+    Dir: dir,
+    CA: filepath.Join(dir, "ca.pem"),
+    ServerCert: filepath.Join(dir, "server.pem"),
+    ServerKey: filepath.Join(dir, "server-key.pem"),
+    ClientCert: filepath.Join(dir, "client.pem"),
+    ClientKey: filepath.Join(dir, "client-key.pem"),
+  }
+  
+  caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {
+    return f, err
+  }
+  ca := &x509.Certificate{
+    SerialNumber: big.NewInt(1),
+    Subject: pkix.Name{CommonName:"Test CA"},
+    NotBefore: time.Now().Add(-time.Hour),
+    NotAfter: time.Now().Add(time.Hour),
+    IsCA: true,
+    KeyUsage: x509.KeyUsageCertSign,
+    BasicConstraintsValid: true,
+  }
+  der, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+  if err != nil {
+    return f, err
+  }
+  if err = writePEM(f.CA, "CERTIFICATE", der); err != nil {
+    return f, err
+  }
+  
+  server := &x509.Certificate{
+    SerialNumber: big.NewInt(2),
+    Subject: pkix.Name{CommonName:"localhost"},
+    DNSNames: []string{"localhost"},
+    IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+    NotBefore: time.Now().Add(-time.Hour),
+    NotAfter: time.Now().Add(time.Hour),
+    KeyUsage: x509.KeyUsageDigitalSignature,
+    ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+  }
+  if err = issue(server, ca, caKey, f.ServerCert, f.ServerKey); err != nil {
+    return f, err
+  }
+  
+  client := &x509.Certificate{
+    SerialNumber: big.NewInt(3),
+    Subject: pkix.Name{CommonName:"client"},
+    NotBefore: time.Now().Add(-time.Hour),
+    NotAfter: time.Now().Add(time.Hour),
+    KeyUsage: x509.KeyUsageDigitalSignature,
+    ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+  }
+  if err = issue(client, ca, caKey, f.ClientCert, f.ClientKey); err != nil {
+    return f, err
+  }
+  
+  return f, nil
+}
+
+// Issue a certificate signed by a CA and write it and its key
+func issue(c, ca *x509.Certificate, caKey *ecdsa.PrivateKey, cert, key string) error {
+  k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {
+    return err
+  }
+  der, err := x509.CreateCertificate(rand.Reader, c, ca, &k.PublicKey, caKey)
+  if err != nil {
+    return err
+  }
+  if err = writePEM(cert, "CERTIFICATE", der); err != nil {
+    return err
+  }
+  der, err = x509.MarshalECPrivateKey(k)
+  if err != nil {
+    return err
+  }
+  return writePEM(key, "EC PRIVATE KEY", der)
+}
+
+// Write a PEM block to a file
+func writePEM(path, kind string, der []byte) error {
+  return ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type:kind, Bytes:der}), 0600)
+}